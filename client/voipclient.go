@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/Unknwon/goconfig"
 	"github.com/mangalaman93/nfs/voip"
@@ -46,6 +47,7 @@ func (v *VoipClient) Close() {
 	v.conn.Close()
 }
 
+// empty host lets the nfs scheduler choose the host
 func (v *VoipClient) AddServer(host string, shares int) (string, error) {
 	return v.doRequest(&voip.Request{
 		Code: voip.ReqStartServer,
@@ -67,6 +69,18 @@ func (v *VoipClient) AddClient(host string, shares int, server string) (string,
 	})
 }
 
+// places the client on the same host as the given router (snort) if possible
+func (v *VoipClient) AddClientNear(router string, shares int, server string) (string, error) {
+	return v.doRequest(&voip.Request{
+		Code: voip.ReqStartClient,
+		KeyVal: map[string]string{
+			"affinity": router,
+			"shares":   strconv.Itoa(shares),
+			"server":   server,
+		},
+	})
+}
+
 func (v *VoipClient) AddSnort(host string, shares int) (string, error) {
 	return v.doRequest(&voip.Request{
 		Code: voip.ReqStartSnort,
@@ -77,6 +91,34 @@ func (v *VoipClient) AddSnort(host string, shares int) (string, error) {
 	})
 }
 
+// ctrl is the control algorithm (ref, pid or queue) for the snort
+func (v *VoipClient) AddSnortWith(host string, shares int, ctrl string) (string, error) {
+	return v.doRequest(&voip.Request{
+		Code: voip.ReqStartSnort,
+		KeyVal: map[string]string{
+			"host":       host,
+			"shares":     strconv.Itoa(shares),
+			"controller": ctrl,
+		},
+	})
+}
+
+// starts an NF of the kind in the catalogue of nfs, params are substituted
+// in its env and cmd. Empty host lets the nfs scheduler choose the host.
+func (v *VoipClient) AddNF(kind, host string, shares int, params map[string]string) (string, error) {
+	kv := make(map[string]string)
+	for key, value := range params {
+		kv[key] = value
+	}
+	kv["kind"] = kind
+	kv["host"] = host
+	kv["shares"] = strconv.Itoa(shares)
+	return v.doRequest(&voip.Request{
+		Code:   voip.ReqStartNF,
+		KeyVal: kv,
+	})
+}
+
 func (v *VoipClient) Stop(cont string) error {
 	_, err := v.doRequest(&voip.Request{
 		Code: voip.ReqStopCont,
@@ -101,6 +143,106 @@ func (v *VoipClient) Route(client, router, server string) error {
 	return err
 }
 
+// routes the client through the hops in order to the server, and the
+// replies back through the same hops if symmetric. Returns the chain id.
+func (v *VoipClient) Chain(client, server string, symmetric bool, hops ...string) (string, error) {
+	return v.doRequest(&voip.Request{
+		Code: voip.ReqRouteCont,
+		KeyVal: map[string]string{
+			"client":    client,
+			"server":    server,
+			"hops":      strings.Join(hops, ","),
+			"symmetric": strconv.FormatBool(symmetric),
+		},
+	})
+}
+
+// spreads the traffic of the client to the server across the replicas
+// by their shares, a replica in a pool brings in the whole pool and the
+// chain follows the pool as it scales. Returns the chain id.
+func (v *VoipClient) Balance(client, server string, replicas ...string) (string, error) {
+	return v.doRequest(&voip.Request{
+		Code: voip.ReqRouteCont,
+		KeyVal: map[string]string{
+			"client":   client,
+			"server":   server,
+			"hops":     strings.Join(replicas, ","),
+			"balanced": "true",
+		},
+	})
+}
+
+// index is the position of the hop in the chain, -1 appends it
+func (v *VoipClient) InsertHop(chain, hop string, index int) error {
+	kv := map[string]string{
+		"chain": chain,
+		"hop":   hop,
+	}
+	if index >= 0 {
+		kv["index"] = strconv.Itoa(index)
+	}
+
+	_, err := v.doRequest(&voip.Request{
+		Code:   voip.ReqInsertHop,
+		KeyVal: kv,
+	})
+	return err
+}
+
+func (v *VoipClient) RemoveHop(chain, hop string) error {
+	_, err := v.doRequest(&voip.Request{
+		Code: voip.ReqRemoveHop,
+		KeyVal: map[string]string{
+			"chain": chain,
+			"hop":   hop,
+		},
+	})
+
+	return err
+}
+
+func (v *VoipClient) DelChain(chain string) error {
+	_, err := v.doRequest(&voip.Request{
+		Code: voip.ReqDelChain,
+		KeyVal: map[string]string{
+			"chain": chain,
+		},
+	})
+
+	return err
+}
+
+// cont, if given, filters the chains going through the container
+func (v *VoipClient) Chains(cont string) ([]*voip.ChainInfo, error) {
+	resp, err := v.send(&voip.Request{
+		Code: voip.ReqListChains,
+		KeyVal: map[string]string{
+			"cont": cont,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Chains, nil
+}
+
+// differences between the chains and the flows on the bridges
+// found by the last reconcile, or by a new one if reconcile is true
+func (v *VoipClient) Drift(reconcile bool) ([]*voip.Drift, error) {
+	resp, err := v.send(&voip.Request{
+		Code: voip.ReqGetDrift,
+		KeyVal: map[string]string{
+			"reconcile": strconv.FormatBool(reconcile),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Drifts, nil
+}
+
 func (v *VoipClient) SetRate(client string, rate int) error {
 	_, err := v.doRequest(&voip.Request{
 		Code: voip.ReqSetRate,
@@ -113,19 +255,100 @@ func (v *VoipClient) SetRate(client string, rate int) error {
 	return err
 }
 
+// polices the traffic the client sends in the network, independent of
+// its rate. A zero kbps or pps is not limited, both zero remove the limit.
+func (v *VoipClient) SetLimit(client string, kbps, pps int64) error {
+	_, err := v.doRequest(&voip.Request{
+		Code: voip.ReqSetLimit,
+		KeyVal: map[string]string{
+			"client": client,
+			"kbps":   strconv.FormatInt(kbps, 10),
+			"pps":    strconv.FormatInt(pps, 10),
+		},
+	})
+
+	return err
+}
+
+// resources which are zero stay as they are, shares of
+// NFs may be changed by the controller afterwards
+func (v *VoipClient) SetResources(cont string, res voip.Resources) error {
+	kv := map[string]string{"cont": cont}
+	ints := map[string]int64{
+		"shares":       res.Shares,
+		"quota":        res.Quota,
+		"memory":       res.Memory,
+		"blkio_weight": res.BlkioWeight,
+		"net_prio":     res.NetPrio,
+	}
+	for key, val := range ints {
+		if val != 0 {
+			kv[key] = strconv.FormatInt(val, 10)
+		}
+	}
+	if res.Cpuset != "" {
+		kv["cpuset"] = res.Cpuset
+	}
+
+	_, err := v.doRequest(&voip.Request{
+		Code:   voip.ReqSetResources,
+		KeyVal: kv,
+	})
+
+	return err
+}
+
+// role (server, snort or client) filters the nodes, empty for all
+func (v *VoipClient) List(role string) ([]*voip.NodeInfo, error) {
+	resp, err := v.send(&voip.Request{
+		Code: voip.ReqListNodes,
+		KeyVal: map[string]string{
+			"role": role,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Nodes, nil
+}
+
+func (v *VoipClient) Get(cont string) (*voip.NodeInfo, error) {
+	resp, err := v.send(&voip.Request{
+		Code: voip.ReqGetNode,
+		KeyVal: map[string]string{
+			"cont": cont,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Nodes[0], nil
+}
+
 func (v *VoipClient) doRequest(req *voip.Request) (string, error) {
-	err := v.enc.Encode(req)
+	resp, err := v.send(req)
 	if err != nil {
 		return "", err
 	}
 
+	return resp.Result, nil
+}
+
+func (v *VoipClient) send(req *voip.Request) (*voip.Response, error) {
+	err := v.enc.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
 	var resp voip.Response
 	err = v.dec.Decode(&resp)
 	if err != nil {
-		return "", err
+		return nil, err
 	} else if resp.Err != "" {
-		return "", fmt.Errorf("%s", resp.Err)
+		return nil, fmt.Errorf("%s", resp.Err)
 	}
 
-	return resp.Result, nil
+	return &resp, nil
 }
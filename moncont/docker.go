@@ -12,6 +12,13 @@ const (
 	IMAGE_SNORT    = "mangalaman93/snort"
 	IMAGE_SURICATA = "mangalaman93/suricata"
 	SIPP_PATH_VOL  = "/data"
+
+	// as set by the catalogue of nfs
+	LABEL_KIND    = "nfs.kind"
+	LABEL_MONITOR = "nfs.monitor"
+	MON_SIPP      = "sipp"
+	MON_NFQUEUE   = "nfqueue"
+	MON_PCAP      = "pcap"
 )
 
 type DockerHandler struct {
@@ -67,9 +74,11 @@ func (h *DockerHandler) listen() {
 
 	for event := range h.echan {
 		log.Println("[INFO] event occurred:", event)
-		switch {
-		case event.Status == "start" && event.From == IMAGE_SIPP:
-			if _, ok := h.sippvols[event.ID]; ok {
+		switch event.Status {
+		case "start":
+			_, ok1 := h.sippvols[event.ID]
+			_, ok2 := h.nfconts[event.ID]
+			if ok1 || ok2 {
 				log.Println("[WARN] duplicate event for container", event.ID)
 				continue
 			}
@@ -78,38 +87,17 @@ func (h *DockerHandler) listen() {
 				log.Println("[WARN] unable to inspect container", event.ID)
 				continue
 			}
-			volume := cont.Volumes[SIPP_PATH_VOL]
-			if volume == "" {
-				for _, v := range cont.Mounts {
-					if v.Destination == SIPP_PATH_VOL {
-						volume = v.Source
-						break
-					}
-				}
-			}
-			if volume == "" {
-				log.Println("[WARN] unable to find volume for container", event.ID)
-				continue
-			}
-			scont := NewSippCont(cont.Name[1:], volume, cont.State.Pid, h.dbclient)
-			h.sippvols[event.ID] = scont
-			scont.Tail()
-			log.Println("[INFO] monitoring container", event.ID)
-		case event.Status == "start" && (event.From == IMAGE_SNORT || event.From == IMAGE_SURICATA):
-			if _, ok := h.nfconts[event.ID]; ok {
-				log.Println("[WARN] duplicate event for container", event.ID)
-				continue
-			}
-			cont, err := h.docker.InspectContainer(event.ID)
-			if err != nil {
-				log.Println("[WARN] unable to inspect container", event.ID)
-				continue
+
+			switch monitor := monitorOf(cont); monitor {
+			case MON_SIPP:
+				h.monitorSipp(event.ID, cont)
+			case MON_NFQUEUE, MON_PCAP:
+				nfcont := NewNFCont(cont.Name[1:], kindOf(cont), monitor, cont.State.Pid, h.dbclient)
+				h.nfconts[event.ID] = nfcont
+				nfcont.Tail(h.docker)
+				log.Println("[INFO] monitoring container", event.ID)
 			}
-			nfcont := NewNFCont(cont.Name[1:], cont.State.Pid, h.dbclient)
-			h.nfconts[event.ID] = nfcont
-			nfcont.Tail(h.docker)
-			log.Println("[INFO] monitoring container", event.ID)
-		case event.Status == "die" || event.Status == "kill" || event.Status == "stop":
+		case "die", "kill", "stop":
 			if scont, ok := h.sippvols[event.ID]; ok {
 				scont.StopTail()
 				delete(h.sippvols, event.ID)
@@ -126,3 +114,54 @@ func (h *DockerHandler) listen() {
 
 	log.Println("Exiting docker events listener loop!")
 }
+
+func (h *DockerHandler) monitorSipp(id string, cont *dockerclient.Container) {
+	volume := cont.Volumes[SIPP_PATH_VOL]
+	if volume == "" {
+		for _, v := range cont.Mounts {
+			if v.Destination == SIPP_PATH_VOL {
+				volume = v.Source
+				break
+			}
+		}
+	}
+	if volume == "" {
+		log.Println("[WARN] unable to find volume for container", id)
+		return
+	}
+	scont := NewSippCont(cont.Name[1:], volume, cont.State.Pid, h.dbclient)
+	h.sippvols[id] = scont
+	scont.Tail()
+	log.Println("[INFO] monitoring container", id)
+}
+
+// containers started by nfs have the way to monitor them in a
+// label, the others are known by their image if at all
+func monitorOf(cont *dockerclient.Container) string {
+	if cont.Config == nil {
+		return ""
+	}
+	if monitor, ok := cont.Config.Labels[LABEL_MONITOR]; ok {
+		return monitor
+	}
+
+	switch cont.Config.Image {
+	case IMAGE_SIPP:
+		return MON_SIPP
+	case IMAGE_SNORT, IMAGE_SURICATA:
+		return MON_NFQUEUE
+	default:
+		return ""
+	}
+}
+
+// kind of the NF names its measurements, snort unless known otherwise
+func kindOf(cont *dockerclient.Container) string {
+	if kind, ok := cont.Config.Labels[LABEL_KIND]; ok && kind != "" {
+		return kind
+	}
+	if cont.Config.Image == IMAGE_SURICATA {
+		return "suricata"
+	}
+	return "snort"
+}
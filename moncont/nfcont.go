@@ -14,17 +14,25 @@ import (
 	dockerclient "github.com/fsouza/go-dockerclient"
 )
 
+// NFCont writes the queue and drops of the NF as <kind>_queue_length and
+// <kind>_queue_drops. NFs behind nfqueue have the counters of the queue,
+// NFs capturing packets have the receive memory of their packet sockets
+// and the packets dropped by the interface.
 type NFCont struct {
 	id       string
+	kind     string
+	monitor  string
 	pid      int
 	stopchan chan bool
 	wg       sync.WaitGroup
 	dbclient *DBClient
 }
 
-func NewNFCont(id string, pid int, dbclient *DBClient) *NFCont {
+func NewNFCont(id, kind, monitor string, pid int, dbclient *DBClient) *NFCont {
 	return &NFCont{
 		id:       id,
+		kind:     kind,
+		monitor:  monitor,
 		pid:      pid,
 		stopchan: make(chan bool),
 		dbclient: dbclient,
@@ -32,7 +40,7 @@ func NewNFCont(id string, pid int, dbclient *DBClient) *NFCont {
 }
 
 func (n *NFCont) String() string {
-	return fmt.Sprintf("{id:%s, pid:%s}", n.id, n.pid)
+	return fmt.Sprintf("{id:%s, kind:%s, pid:%d}", n.id, n.kind, n.pid)
 }
 
 func (n *NFCont) Tail(docker *dockerclient.Client) {
@@ -50,7 +58,10 @@ func (n *NFCont) tail(docker *dockerclient.Client) {
 	defer n.wg.Done()
 
 	// wait for queue to be created
-	netfilter_file := path.Join(HOST_PROC_PATH, strconv.Itoa(n.pid), "/net/netfilter/nfnetlink_queue")
+	queue_file := path.Join(HOST_PROC_PATH, strconv.Itoa(n.pid), "/net/netfilter/nfnetlink_queue")
+	if n.monitor == MON_PCAP {
+		queue_file = path.Join(HOST_PROC_PATH, strconv.Itoa(n.pid), "/net/packet")
+	}
 	dev_file := path.Join(HOST_PROC_PATH, strconv.Itoa(n.pid), "/net/dev")
 	for {
 		timeout := time.After(FILES_CHECK_INTERVAL * time.Millisecond)
@@ -65,8 +76,8 @@ func (n *NFCont) tail(docker *dockerclient.Client) {
 			log.Printf("[WARN] %s file not found!\n", dev_file)
 			continue
 		}
-		if _, err := os.Stat(netfilter_file); err != nil {
-			log.Printf("[WARN] %s file not found!\n", netfilter_file)
+		if _, err := os.Stat(queue_file); err != nil {
+			log.Printf("[WARN] %s file not found!\n", queue_file)
 			continue
 		}
 		break
@@ -81,32 +92,17 @@ func (n *NFCont) tail(docker *dockerclient.Client) {
 			time.Sleep(time.Duration(READ_PERIOD) * time.Millisecond)
 		}
 
-		out, err := ioutil.ReadFile(netfilter_file)
+		out, err := ioutil.ReadFile(queue_file)
 		curtime := time.Now()
 		if err != nil {
-			log.Println("[WARN] unable to read netfilter file:", err)
+			log.Println("[WARN] unable to read queue file:", err)
 			return
 		}
-		row := strings.Fields(string(out))
-		if len(row) < 9 {
-			log.Println("[WARN] incorrect parsing of netfilter file, parsed line:", row)
+		if n.monitor == MON_PCAP {
+			n.writePacket(string(out), curtime)
+		} else if !n.writeNetfilter(string(out), curtime) {
 			continue
 		}
-		if fval, err := strconv.ParseFloat(row[2], 64); err != nil {
-			log.Println("[WARN] unable to parse", row[2], "err:", err)
-		} else {
-			n.dbclient.Write("snort_queue_length", n.id, map[string]interface{}{"value": fval}, curtime)
-		}
-		if ival, err := strconv.ParseInt(row[5], 10, 64); err != nil {
-			log.Println("[WARN] unable to parse", row[5], "err:", err)
-		} else {
-			n.dbclient.Write("snort_queue_drops", n.id, map[string]interface{}{"value": ival}, curtime)
-		}
-		if ival, err := strconv.ParseInt(row[6], 10, 64); err != nil {
-			log.Println("[WARN] unable to parse", row[6], "err:", err)
-		} else {
-			n.dbclient.Write("snort_user_drops", n.id, map[string]interface{}{"value": ival}, curtime)
-		}
 
 		// dev file
 		out, err = ioutil.ReadFile(dev_file)
@@ -129,7 +125,7 @@ func (n *NFCont) tail(docker *dockerclient.Client) {
 		} else {
 			index = 2
 		}
-		row = strings.Fields(rows[index])
+		row := strings.Fields(rows[index])
 		if len(row) < 17 {
 			log.Println("[WARN] incorrect parsing of dev file, parsed line:", row)
 			continue
@@ -144,6 +140,13 @@ func (n *NFCont) tail(docker *dockerclient.Client) {
 		} else {
 			n.dbclient.Write("tx_packets", n.id, map[string]interface{}{"value": fval}, curtime)
 		}
+		if n.monitor == MON_PCAP {
+			if ival, err := strconv.ParseInt(row[4], 10, 64); err != nil {
+				log.Println("[WARN] unable to parse", row[4], "err:", err)
+			} else {
+				n.dbclient.Write(n.kind+"_queue_drops", n.id, map[string]interface{}{"value": ival}, curtime)
+			}
+		}
 
 		// available shares
 		cont, err := docker.InspectContainer(n.id)
@@ -156,3 +159,46 @@ func (n *NFCont) tail(docker *dockerclient.Client) {
 
 	log.Println("[INFO] exiting Tail for container", n.id)
 }
+
+// queue length and drops of the nfqueue, false if the file can't be parsed
+func (n *NFCont) writeNetfilter(out string, curtime time.Time) bool {
+	row := strings.Fields(out)
+	if len(row) < 9 {
+		log.Println("[WARN] incorrect parsing of netfilter file, parsed line:", row)
+		return false
+	}
+	if fval, err := strconv.ParseFloat(row[2], 64); err != nil {
+		log.Println("[WARN] unable to parse", row[2], "err:", err)
+	} else {
+		n.dbclient.Write(n.kind+"_queue_length", n.id, map[string]interface{}{"value": fval}, curtime)
+	}
+	if ival, err := strconv.ParseInt(row[5], 10, 64); err != nil {
+		log.Println("[WARN] unable to parse", row[5], "err:", err)
+	} else {
+		n.dbclient.Write(n.kind+"_queue_drops", n.id, map[string]interface{}{"value": ival}, curtime)
+	}
+	if ival, err := strconv.ParseInt(row[6], 10, 64); err != nil {
+		log.Println("[WARN] unable to parse", row[6], "err:", err)
+	} else {
+		n.dbclient.Write(n.kind+"_user_drops", n.id, map[string]interface{}{"value": ival}, curtime)
+	}
+	return true
+}
+
+// bytes waiting in the packet sockets of the NF, after the header line
+// sk RefCnt Type Proto Iface R Rmem User Inode
+func (n *NFCont) writePacket(out string, curtime time.Time) {
+	var queue int64
+	for _, line := range strings.Split(out, "\n")[1:] {
+		row := strings.Fields(line)
+		if len(row) < 9 {
+			continue
+		}
+		if ival, err := strconv.ParseInt(row[6], 10, 64); err != nil {
+			log.Println("[WARN] unable to parse", row[6], "err:", err)
+		} else {
+			queue += ival
+		}
+	}
+	n.dbclient.Write(n.kind+"_queue_length", n.id, map[string]interface{}{"value": queue}, curtime)
+}
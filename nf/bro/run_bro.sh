@@ -0,0 +1,5 @@
+#!/bin/sh
+export PATH=/usr/local/bro/bin:$PATH
+
+cd /log
+bro -i eth0 -C ${ARGS:-local}
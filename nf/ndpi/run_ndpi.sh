@@ -0,0 +1,2 @@
+#!/bin/sh
+ndpiReader -i eth0 ${ARGS}
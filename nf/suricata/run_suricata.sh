@@ -1,3 +1,3 @@
 #!/bin/sh
 iptables -A FORWARD -j NFQUEUE
-suricata -q 0
+suricata ${ARGS:--q 0}
@@ -5,12 +5,14 @@ import (
 	"net"
 
 	"github.com/Unknwon/goconfig"
+	"github.com/mangalaman93/nfs/pkg/record"
 	"github.com/mangalaman93/nfs/voip"
 )
 
 var (
 	apps   map[string]AppLine
 	server *StoppableServer
+	rec    *record.Recorder
 )
 
 func Start(config *goconfig.ConfigFile) error {
@@ -23,10 +25,26 @@ func Start(config *goconfig.ConfigFile) error {
 		return err
 	}
 
+	// optionally record all the data and actions of the experiment
+	if s, _ := config.GetSection("RECORD"); s != nil {
+		dir, err := config.GetValue("RECORD", "dir")
+		if err != nil {
+			return err
+		}
+		rec, err = record.NewRecorder(dir,
+			config.MustInt64("RECORD", "max_size", record.DEF_MAX_SIZE),
+			config.MustInt("RECORD", "max_files", record.DEF_MAX_FILES))
+		if err != nil {
+			return err
+		}
+		vl.RecordTo(rec)
+		log.Println("[INFO] recording data and actions in", dir)
+	}
+
 	apps = make(map[string]AppLine)
 	apps[vl.GetDB()] = vl
 	log.Println("[INFO] registered db", vl.GetDB(), "with VoipLine instance")
-	server, err = NewStoppableServer(config, apps)
+	server, err = NewStoppableServer(config, apps, rec)
 	if err != nil {
 		return err
 	}
@@ -53,5 +71,9 @@ func Stop() {
 		app.Stop()
 	}
 	log.Println("[INFO] stopped all applications")
+	if rec != nil {
+		rec.Close()
+		log.Println("[INFO] closed recorder")
+	}
 	log.Println("[INFO] exiting control loop")
 }
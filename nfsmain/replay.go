@@ -0,0 +1,113 @@
+package nfsmain
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/influxdb/influxdb/models"
+	"github.com/mangalaman93/nfs/pkg/record"
+)
+
+// Replayer feeds recorded data points to an application. Timestamps are
+// rewritten relative to the start of the replay. With speed 1 points are
+// replayed in real time, with speed s the replay is s times faster and
+// with speed 0 the replay runs as fast as possible (virtual time).
+type Replayer struct {
+	app    AppLine
+	speed  float64
+	window time.Duration
+	rename map[string]string
+}
+
+func NewReplayer(app AppLine, speed float64, window time.Duration) *Replayer {
+	return &Replayer{
+		app:    app,
+		speed:  speed,
+		window: window,
+		rename: make(map[string]string),
+	}
+}
+
+// points of container from are replayed as points of container to
+func (r *Replayer) Rename(from, to string) {
+	r.rename[from] = to
+}
+
+// sends points to the app in batches of <window> duration
+func (r *Replayer) Replay(points models.Points) {
+	if len(points) == 0 {
+		return
+	}
+
+	sort.Sort(byTime(points))
+	t0 := points[0].Time()
+	start := time.Now()
+	for i := 0; i < len(points); {
+		wend := points[i].Time().Add(r.window)
+		j := i
+		for j < len(points) && points[j].Time().Before(wend) {
+			j++
+		}
+
+		if r.speed > 0 {
+			wall := start.Add(time.Duration(float64(wend.Sub(t0)) / r.speed))
+			time.Sleep(wall.Sub(time.Now()))
+		}
+
+		batch := points[i:j]
+		for _, point := range batch {
+			point.SetTime(start.Add(point.Time().Sub(t0)))
+			if to, ok := r.rename[point.Tags()["container_name"]]; ok {
+				point.AddTag("container_name", to)
+			}
+		}
+		r.app.Update(batch)
+		i = j
+	}
+
+	log.Println("[INFO] replayed", len(points), "points in", time.Since(start))
+}
+
+// reads line protocol data points, separated by new lines
+func ReadPoints(rd io.Reader, precision string) (models.Points, error) {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.ParsePointsWithPrecision(data, time.Now().UTC(), precision)
+}
+
+// reads data points of database db from a record log, timestamps
+// missing in the line protocol default to the time of receiving them
+func ReadRecord(rd io.Reader, db string) (models.Points, error) {
+	entries, err := record.ReadEntries(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make(models.Points, 0)
+	for _, e := range entries {
+		if e.Type != record.TYPE_WRITE || e.DB != db {
+			continue
+		}
+
+		batch, err := models.ParsePointsWithPrecision([]byte(e.Body), e.Time, e.Precision)
+		if err != nil {
+			log.Println("[WARN] skipping unparsable batch recorded at", e.Time, err)
+			continue
+		}
+		points = append(points, batch...)
+	}
+
+	return points, nil
+}
+
+type byTime models.Points
+
+func (b byTime) Len() int           { return len(b) }
+func (b byTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTime) Less(i, j int) bool { return b[i].Time().Before(b[j].Time()) }
@@ -0,0 +1,102 @@
+package nfsmain
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/models"
+	"github.com/mangalaman93/nfs/pkg/record"
+)
+
+// fakeApp keeps the batches it is given and when it got them
+type fakeApp struct {
+	sync.Mutex
+	batches []models.Points
+	times   []time.Time
+}
+
+func (f *fakeApp) Start() error  { return nil }
+func (f *fakeApp) Stop()         {}
+func (f *fakeApp) GetDB() string { return "cadvisor" }
+
+func (f *fakeApp) Update(points models.Points) {
+	f.Lock()
+	defer f.Unlock()
+	f.batches = append(f.batches, points)
+	f.times = append(f.times, time.Now())
+}
+
+func TestReplayRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// batches arrive out of order and for another db as well
+	r, err := record.NewRecorder(dir, record.DEF_MAX_SIZE, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write("cadvisor", "s", []byte("snort_queue_length,container_name=snort value=30 102\n"+
+		"snort_queue_length,container_name=snort value=20 101"))
+	r.Write("telegraf", "s", []byte("cpu,host=h1 value=1 101"))
+	r.Action("set_shares", "snort", map[string]string{"shares": "512"})
+	r.Write("cadvisor", "s", []byte("snort_queue_length,container_name=snort value=10 100\n"+
+		"rx_packets,container_name=client value=5 100"))
+	r.Close()
+
+	file, err := os.Open(path.Join(dir, record.FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	points, err := ReadRecord(file, "cadvisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 4 {
+		t.Fatalf("expected 4 points of db cadvisor, got %d", len(points))
+	}
+
+	// 2s of data 20 times faster, a batch per second
+	app := &fakeApp{}
+	replayer := NewReplayer(app, 20, time.Second)
+	replayer.Rename("snort", "c2")
+	start := time.Now()
+	replayer.Replay(points)
+	elapsed := time.Since(start)
+
+	if len(app.batches) != 3 || len(app.batches[0]) != 2 || len(app.batches[1]) != 1 || len(app.batches[2]) != 1 {
+		t.Fatalf("expected a batch per second of the trace, got %v", app.batches)
+	}
+	if elapsed < 140*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the trace replayed in about 150ms, took %v", elapsed)
+	}
+	if gap := app.times[2].Sub(app.times[1]); gap < 40*time.Millisecond {
+		t.Errorf("expected batches 50ms apart, got %v", gap)
+	}
+
+	values := make([]float64, 0)
+	t0 := app.batches[0][0].Time()
+	for i, batch := range app.batches {
+		for _, point := range batch {
+			if point.Name() == "snort_queue_length" {
+				values = append(values, point.Fields()["value"].(float64))
+				if point.Tags()["container_name"] != "c2" {
+					t.Errorf("expected snort replayed as c2, got %v", point.Tags())
+				}
+			}
+			if offset := point.Time().Sub(t0); offset != time.Duration(i)*time.Second {
+				t.Errorf("expected point %d seconds into the replay, got %v", i, offset)
+			}
+		}
+	}
+	if len(values) != 3 || values[0] != 10 || values[1] != 20 || values[2] != 30 {
+		t.Errorf("expected points in time order, got %v", values)
+	}
+}
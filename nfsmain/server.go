@@ -14,6 +14,7 @@ import (
 
 	"github.com/Unknwon/goconfig"
 	"github.com/influxdb/influxdb/models"
+	"github.com/mangalaman93/nfs/pkg/record"
 )
 
 type StoppableServer struct {
@@ -21,9 +22,11 @@ type StoppableServer struct {
 	listener *StoppableListener
 	apps     map[string]AppLine
 	endpoint string
+	rec      *record.Recorder
 }
 
-func NewStoppableServer(config *goconfig.ConfigFile, apps map[string]AppLine) (*StoppableServer, error) {
+// rec may be nil if recording is not required
+func NewStoppableServer(config *goconfig.ConfigFile, apps map[string]AppLine, rec *record.Recorder) (*StoppableServer, error) {
 	var endpoint string
 	if s, _ := config.GetSection("VOIP.DB"); s != nil {
 		ihost, err := config.GetValue("VOIP.DB", "host")
@@ -40,6 +43,7 @@ func NewStoppableServer(config *goconfig.ConfigFile, apps map[string]AppLine) (*
 	return &StoppableServer{
 		apps:     apps,
 		endpoint: endpoint,
+		rec:      rec,
 	}, nil
 }
 
@@ -84,21 +88,26 @@ func (s *StoppableServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	defer body.Close()
 
-	// multiple reader on a map is ok
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.Println("[WARN] unable to read body of the request")
+		writeErr(w, err)
+		return
+	}
+
+	// we record every write, even for unregistered databases
 	database := r.FormValue("db")
+	if s.rec != nil {
+		s.rec.Write(database, precision, data)
+	}
+
+	// multiple reader on a map is ok
 	app, ok := s.apps[database]
 	if !ok {
 		log.Println("[WARN] unregistered database:", database)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-
-	data, err := ioutil.ReadAll(body)
-	if err != nil {
-		log.Println("[WARN] unable to read body of the request")
-		writeErr(w, err)
-		return
-	}
 	points, err := models.ParsePointsWithPrecision(data, time.Now().UTC(), precision)
 	if err != nil {
 		if err.Error() == "EOF" {
@@ -0,0 +1,233 @@
+package ipam
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrInvalidIP    = errors.New("ipam: invalid ipv4 address")
+	ErrOverlap      = errors.New("ipam: subnet overlaps with another subnet")
+	ErrNoSubnet     = errors.New("ipam: no subnet for host")
+	ErrExhausted    = errors.New("ipam: no free address left in subnet")
+	ErrOutOfRange   = errors.New("ipam: address not in subnet of host")
+	ErrConflict     = errors.New("ipam: address already in use")
+	ErrNotAllocated = errors.New("ipam: address not allocated")
+	ErrNotOwner     = errors.New("ipam: address allocated to another owner")
+)
+
+// subnet of one or more hosts, the first address is
+// the gateway (bridge) and is never handed out
+type subnet struct {
+	net   *net.IPNet
+	first uint32
+	last  uint32
+	next  uint32
+	used  map[uint32]string
+}
+
+// IPAM hands out ipv4 addresses from per host subnets. Freed addresses
+// are reused only after the rest of the subnet has been used once.
+type IPAM struct {
+	sync.Mutex
+	hosts   map[string]*subnet
+	subnets []*subnet
+	def     *subnet
+}
+
+func New() *IPAM {
+	return &IPAM{hosts: make(map[string]*subnet)}
+}
+
+// host "" sets the subnet of all the hosts without their own subnet.
+// Hosts may share a subnet, but different subnets may not overlap.
+func (a *IPAM) AddSubnet(host, cidr string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if ipnet.IP.To4() == nil {
+		return ErrInvalidIP
+	}
+
+	var s *subnet
+	for _, other := range a.subnets {
+		if other.net.String() == ipnet.String() {
+			s = other
+			break
+		}
+		if other.net.Contains(ipnet.IP) || ipnet.Contains(other.net.IP) {
+			return ErrOverlap
+		}
+	}
+
+	if s == nil {
+		base := toInt(ipnet.IP)
+		ones, bits := ipnet.Mask.Size()
+		size := uint32(1) << uint(bits-ones)
+		if size < 4 {
+			return ErrExhausted
+		}
+
+		// skip network, gateway and broadcast address
+		s = &subnet{
+			net:   ipnet,
+			first: base + 2,
+			last:  base + size - 2,
+			next:  base + 2,
+			used:  make(map[uint32]string),
+		}
+		a.subnets = append(a.subnets, s)
+	}
+
+	if host == "" {
+		a.def = s
+	} else {
+		a.hosts[host] = s
+	}
+	return nil
+}
+
+// allocates an address for owner (a container id) on host
+func (a *IPAM) Allocate(host, owner string) (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	s := a.subnet(host)
+	if s == nil {
+		return "", ErrNoSubnet
+	}
+
+	for i := s.first; i <= s.last; i++ {
+		ip := s.next
+		s.next++
+		if s.next > s.last {
+			s.next = s.first
+		}
+
+		if _, ok := s.used[ip]; !ok {
+			s.used[ip] = owner
+			return toIP(ip).String(), nil
+		}
+	}
+
+	return "", ErrExhausted
+}
+
+// marks an address in use, e.g. of a container taken over after a restart
+func (a *IPAM) Reserve(host, ip, owner string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	s := a.subnet(host)
+	if s == nil {
+		return ErrNoSubnet
+	}
+	n, err := parse(ip)
+	if err != nil {
+		return err
+	}
+	if !s.net.Contains(toIP(n)) || n < s.first || n > s.last {
+		return ErrOutOfRange
+	}
+
+	if cur, ok := s.used[n]; ok && cur != owner {
+		return ErrConflict
+	}
+	s.used[n] = owner
+	return nil
+}
+
+// only the owner can give the address back
+func (a *IPAM) Release(ip, owner string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	n, err := parse(ip)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range a.subnets {
+		if cur, ok := s.used[n]; ok {
+			if cur != owner {
+				return ErrNotOwner
+			}
+			delete(s.used, n)
+			return nil
+		}
+	}
+	return ErrNotAllocated
+}
+
+// owner of the address, empty if it is free
+func (a *IPAM) Owner(ip string) string {
+	a.Lock()
+	defer a.Unlock()
+
+	n, err := parse(ip)
+	if err != nil {
+		return ""
+	}
+	for _, s := range a.subnets {
+		if owner, ok := s.used[n]; ok {
+			return owner
+		}
+	}
+	return ""
+}
+
+// prefix length of the subnet of the host
+func (a *IPAM) Bits(host string) int {
+	a.Lock()
+	defer a.Unlock()
+
+	s := a.subnet(host)
+	if s == nil {
+		return 0
+	}
+	ones, _ := s.net.Mask.Size()
+	return ones
+}
+
+// first address of the subnet of the host, used by the bridge
+func (a *IPAM) Gateway(host string) string {
+	a.Lock()
+	defer a.Unlock()
+
+	s := a.subnet(host)
+	if s == nil {
+		return ""
+	}
+	return toIP(s.first - 1).String()
+}
+
+func (a *IPAM) subnet(host string) *subnet {
+	if s, ok := a.hosts[host]; ok {
+		return s
+	}
+	return a.def
+}
+
+func parse(ip string) (uint32, error) {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return 0, ErrInvalidIP
+	}
+	return toInt(parsed), nil
+}
+
+func toInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func toIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
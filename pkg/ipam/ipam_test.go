@@ -0,0 +1,147 @@
+package ipam
+
+import (
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	a := New()
+	if err := a.AddSubnet("h1", "10.1.0.0/29"); err != nil {
+		t.Fatal(err)
+	}
+	if gw := a.Gateway("h1"); gw != "10.1.0.1" {
+		t.Errorf("expected gateway 10.1.0.1, got %s", gw)
+	}
+
+	// .2 to .6 are usable in a /29
+	ips := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		ip, err := a.Allocate("h1", "c")
+		if err != nil {
+			t.Fatal("unable to allocate:", err)
+		}
+		if ips[ip] {
+			t.Fatal("duplicate address", ip)
+		}
+		ips[ip] = true
+	}
+	if _, err := a.Allocate("h1", "c"); err != ErrExhausted {
+		t.Errorf("expected %v, got %v", ErrExhausted, err)
+	}
+
+	if err := a.Release("10.1.0.4", "other"); err != ErrNotOwner {
+		t.Errorf("expected %v, got %v", ErrNotOwner, err)
+	}
+	if err := a.Release("10.1.0.4", "c"); err != nil {
+		t.Fatal("unable to release:", err)
+	}
+	if err := a.Release("10.1.0.4", "c"); err != ErrNotAllocated {
+		t.Errorf("expected %v, got %v", ErrNotAllocated, err)
+	}
+	if ip, err := a.Allocate("h1", "d"); err != nil || ip != "10.1.0.4" {
+		t.Errorf("expected freed address 10.1.0.4, got %s %v", ip, err)
+	}
+	if owner := a.Owner("10.1.0.4"); owner != "d" {
+		t.Errorf("expected owner d, got %q", owner)
+	}
+}
+
+func TestReuseOrder(t *testing.T) {
+	a := New()
+	a.AddSubnet("", "10.2.0.0/24")
+
+	ip1, _ := a.Allocate("h1", "c1")
+	a.Release(ip1, "c1")
+	ip2, _ := a.Allocate("h2", "c2")
+	if ip1 == ip2 {
+		t.Errorf("freed address %s reused immediately", ip1)
+	}
+}
+
+func TestSubnets(t *testing.T) {
+	a := New()
+	if err := a.AddSubnet("h1", "10.3.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddSubnet("h2", "10.3.0.0/24"); err != nil {
+		t.Error("hosts should be able to share a subnet:", err)
+	}
+	if err := a.AddSubnet("h3", "10.3.0.128/25"); err != ErrOverlap {
+		t.Errorf("expected %v, got %v", ErrOverlap, err)
+	}
+	if err := a.AddSubnet("h3", "10.0.0.0/8"); err != ErrOverlap {
+		t.Errorf("expected %v, got %v", ErrOverlap, err)
+	}
+	if _, err := a.Allocate("h9", "c"); err != ErrNoSubnet {
+		t.Errorf("expected %v, got %v", ErrNoSubnet, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	a := New()
+	a.AddSubnet("h1", "10.4.0.0/24")
+
+	if err := a.Reserve("h1", "10.4.0.2", "c1"); err != nil {
+		t.Fatal("unable to reserve:", err)
+	}
+	if err := a.Reserve("h1", "10.4.0.2", "c1"); err != nil {
+		t.Error("reserving again for the same owner should be fine:", err)
+	}
+	if err := a.Reserve("h1", "10.4.0.2", "c2"); err != ErrConflict {
+		t.Errorf("expected %v, got %v", ErrConflict, err)
+	}
+	if err := a.Reserve("h1", "10.5.0.2", "c2"); err != ErrOutOfRange {
+		t.Errorf("expected %v, got %v", ErrOutOfRange, err)
+	}
+	if err := a.Reserve("h1", "10.4.0.1", "c2"); err != ErrOutOfRange {
+		t.Errorf("gateway can't be reserved, got %v", err)
+	}
+
+	if ip, _ := a.Allocate("h1", "c3"); ip == "10.4.0.2" {
+		t.Error("reserved address allocated again")
+	}
+}
+
+func TestMACAllocator(t *testing.T) {
+	m, err := NewMACAllocator("00:16:3e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac, err := m.FromIP("10.1.2.3", "c1")
+	if err != nil || mac != "00:16:3e:01:02:03" {
+		t.Fatalf("expected 00:16:3e:01:02:03, got %s %v", mac, err)
+	}
+
+	// same last 3 bytes in another subnet
+	if _, err := m.FromIP("11.1.2.3", "c2"); err != ErrConflict {
+		t.Errorf("expected %v, got %v", ErrConflict, err)
+	}
+	if err := m.Reserve("00:16:3e:01:02:03", "c2"); err != ErrConflict {
+		t.Errorf("expected %v, got %v", ErrConflict, err)
+	}
+	if err := m.Reserve("00:16:3f:01:02:03", "c2"); err != ErrOutOfRange {
+		t.Errorf("expected %v, got %v", ErrOutOfRange, err)
+	}
+
+	seen := map[string]bool{mac: true}
+	m.Reserve("00:16:3e:00:00:02", "c3")
+	seen["00:16:3e:00:00:02"] = true
+	for i := 0; i < 10; i++ {
+		mac, err := m.Allocate("c")
+		if err != nil || seen[mac] {
+			t.Fatalf("expected unique mac, got %s %v", mac, err)
+		}
+		seen[mac] = true
+	}
+
+	if err := m.Release("00:16:3e:01:02:03", "c2"); err != ErrNotOwner {
+		t.Errorf("expected %v, got %v", ErrNotOwner, err)
+	}
+	if err := m.Release("00:16:3e:01:02:03", "c1"); err != nil {
+		t.Error("unable to release:", err)
+	}
+	if _, err := m.FromIP("11.1.2.3", "c2"); err != nil {
+		t.Error("released mac should be available:", err)
+	}
+}
@@ -0,0 +1,126 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	ErrInvalidMac = errors.New("ipam: invalid mac prefix")
+	ErrNoMacLeft  = errors.New("ipam: no free mac address left")
+)
+
+// MACAllocator hands out mac addresses under a 3 byte (OUI) prefix and
+// keeps track of them, so that no two containers get the same address
+type MACAllocator struct {
+	sync.Mutex
+	prefix net.HardwareAddr
+	next   uint32
+	used   map[uint32]string
+}
+
+// prefix is 3 bytes, e.g. 00:16:3e
+func NewMACAllocator(prefix string) (*MACAllocator, error) {
+	hw, err := net.ParseMAC(prefix + ":00:00:00")
+	if err != nil {
+		return nil, ErrInvalidMac
+	}
+
+	return &MACAllocator{
+		prefix: hw[:3],
+		next:   1,
+		used:   make(map[uint32]string),
+	}, nil
+}
+
+// derives the mac from the last 3 bytes of the ipv4 address
+func (m *MACAllocator) FromIP(ip, owner string) (string, error) {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return "", ErrInvalidIP
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	n := uint32(parsed[1])<<16 | uint32(parsed[2])<<8 | uint32(parsed[3])
+	if err := m.reserve(n, owner); err != nil {
+		return "", err
+	}
+	return m.format(n), nil
+}
+
+// next free mac address based on a counter
+func (m *MACAllocator) Allocate(owner string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for i := 0; i < 1<<24; i++ {
+		n := m.next
+		m.next = (m.next + 1) & 0xffffff
+		if _, ok := m.used[n]; !ok && n != 0 {
+			m.used[n] = owner
+			return m.format(n), nil
+		}
+	}
+
+	return "", ErrNoMacLeft
+}
+
+// marks the mac in use, e.g. of a container taken over after a restart
+func (m *MACAllocator) Reserve(mac, owner string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	n, err := m.parse(mac)
+	if err != nil {
+		return err
+	}
+	return m.reserve(n, owner)
+}
+
+// only the owner can give the mac back
+func (m *MACAllocator) Release(mac, owner string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	n, err := m.parse(mac)
+	if err != nil {
+		return err
+	}
+	if cur, ok := m.used[n]; !ok {
+		return ErrNotAllocated
+	} else if cur != owner {
+		return ErrNotOwner
+	}
+
+	delete(m.used, n)
+	return nil
+}
+
+func (m *MACAllocator) reserve(n uint32, owner string) error {
+	if cur, ok := m.used[n]; ok && cur != owner {
+		return ErrConflict
+	}
+
+	m.used[n] = owner
+	return nil
+}
+
+func (m *MACAllocator) parse(mac string) (uint32, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return 0, ErrInvalidMac
+	}
+	if hw[0] != m.prefix[0] || hw[1] != m.prefix[1] || hw[2] != m.prefix[2] {
+		return 0, ErrOutOfRange
+	}
+
+	return uint32(hw[3])<<16 | uint32(hw[4])<<8 | uint32(hw[5]), nil
+}
+
+func (m *MACAllocator) format(n uint32) string {
+	return fmt.Sprintf("%s:%02x:%02x:%02x", m.prefix, byte(n>>16), byte(n>>8), byte(n))
+}
@@ -0,0 +1,135 @@
+package ovs
+
+// Interface is a row of the Interface table
+type Interface struct {
+	Name        string
+	OfPort      int
+	ExternalIds map[string]string
+}
+
+func (c *Client) BridgeExists(name string) (bool, error) {
+	res, err := c.Transact(Select("Bridge", Where(Cond("name", "==", name)), "name"))
+	if err != nil {
+		return false, err
+	}
+
+	return len(res[0].Rows) != 0, nil
+}
+
+// adds a bridge with an internal port of the same name, protocols
+// are the openflow versions enabled on the bridge, e.g. OpenFlow13
+func (c *Client) AddBridge(name string, protocols ...string) error {
+	vals := make([]interface{}, 0, len(protocols))
+	for _, p := range protocols {
+		vals = append(vals, p)
+	}
+
+	_, err := c.Transact(
+		Insert("Interface", map[string]interface{}{
+			"name": name,
+			"type": "internal",
+		}, "iface"),
+		Insert("Port", map[string]interface{}{
+			"name":       name,
+			"interfaces": NamedUUID("iface"),
+		}, "port"),
+		Insert("Bridge", map[string]interface{}{
+			"name":      name,
+			"ports":     NamedUUID("port"),
+			"protocols": Set(vals...),
+		}, "bridge"),
+		Mutate(DB_NAME, Where(), Cond("bridges", "insert", Set(NamedUUID("bridge")))),
+	)
+	return err
+}
+
+// ports and interfaces of the bridge are garbage collected by ovsdb
+func (c *Client) DelBridge(name string) error {
+	id, err := c.find("Bridge", name)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Transact(Mutate(DB_NAME, Where(), Cond("bridges", "delete", Set(UUID(id)))))
+	return err
+}
+
+// adds port with one interface of the same name to the bridge
+func (c *Client) AddPort(bridge, name string, external_ids map[string]string) error {
+	_, err := c.Transact(
+		Insert("Interface", map[string]interface{}{
+			"name":         name,
+			"external_ids": Map(external_ids),
+		}, "iface"),
+		Insert("Port", map[string]interface{}{
+			"name":       name,
+			"interfaces": NamedUUID("iface"),
+		}, "port"),
+		Mutate("Bridge", Where(Cond("name", "==", bridge)),
+			Cond("ports", "insert", Set(NamedUUID("port")))),
+	)
+	return err
+}
+
+func (c *Client) DelPort(bridge, name string) error {
+	id, err := c.find("Port", name)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Transact(Mutate("Bridge", Where(Cond("name", "==", bridge)),
+		Cond("ports", "delete", Set(UUID(id)))))
+	if err != nil {
+		return err
+	}
+	if res[0].Count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// sets the columns of the interface, e.g. ingress_policing_rate
+func (c *Client) SetInterface(name string, columns map[string]interface{}) error {
+	res, err := c.Transact(Update("Interface", Where(Cond("name", "==", name)), columns))
+	if err != nil {
+		return err
+	}
+	if res[0].Count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// interfaces which have external_ids:key=value
+func (c *Client) FindInterfaces(key, value string) ([]*Interface, error) {
+	res, err := c.Transact(Select("Interface",
+		Where(Cond("external_ids", "includes", Map(map[string]string{key: value}))),
+		"name", "ofport", "external_ids"))
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := make([]*Interface, 0, len(res[0].Rows))
+	for _, row := range res[0].Rows {
+		name, _ := row["name"].(string)
+		ifaces = append(ifaces, &Interface{
+			Name:        name,
+			OfPort:      ToInt(row["ofport"]),
+			ExternalIds: ToMap(row["external_ids"]),
+		})
+	}
+	return ifaces, nil
+}
+
+// uuid of the row with given name
+func (c *Client) find(table, name string) (string, error) {
+	res, err := c.Transact(Select(table, Where(Cond("name", "==", name)), "_uuid"))
+	if err != nil {
+		return "", err
+	}
+	if len(res[0].Rows) == 0 {
+		return "", ErrNotFound
+	}
+
+	return ToUUID(res[0].Rows[0]["_uuid"]), nil
+}
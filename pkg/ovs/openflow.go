@@ -0,0 +1,714 @@
+package ovs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// openflow 1.3, as spoken on the management socket of a bridge
+const (
+	OFP_VERSION = 0x04
+
+	OFPT_HELLO             = 0
+	OFPT_ERROR             = 1
+	OFPT_ECHO_REQUEST      = 2
+	OFPT_ECHO_REPLY        = 3
+	OFPT_FLOW_MOD          = 14
+	OFPT_GROUP_MOD         = 15
+	OFPT_MULTIPART_REQUEST = 18
+	OFPT_MULTIPART_REPLY   = 19
+	OFPT_BARRIER_REQUEST   = 20
+	OFPT_BARRIER_REPLY     = 21
+
+	OFPFC_ADD           = 0
+	OFPFC_MODIFY        = 1
+	OFPFC_DELETE        = 3
+	OFPFC_DELETE_STRICT = 4
+
+	OFPGC_ADD    = 0
+	OFPGC_MODIFY = 1
+	OFPGC_DELETE = 2
+
+	// buckets of a select group are picked by a hash of the flow,
+	// packets of the same flow always take the same bucket
+	OFPGT_ALL    = 0
+	OFPGT_SELECT = 1
+
+	OFPET_GROUP_MOD_FAILED = 6
+	OFPGMFC_GROUP_EXISTS   = 0
+
+	OFPP_NORMAL = 0xfffffffa
+	OFPP_ANY    = 0xffffffff
+	OFPG_ANY    = 0xffffffff
+	OFP_NO_BUFF = 0xffffffff
+
+	OFPMP_FLOW        = 1
+	OFPMP_GROUP_DESC  = 7
+	OFPMPF_REPLY_MORE = 1
+	OFPTT_ALL         = 0xff
+)
+
+// oxm fields of the openflow basic class
+const (
+	oxmClassBasic = 0x8000
+	oxmInPort     = 0
+	oxmEthDst     = 3
+	oxmEthSrc     = 4
+	oxmEthType    = 5
+	oxmIpv4Src    = 11
+	oxmIpv4Dst    = 12
+)
+
+// instructions and actions
+const (
+	ofpitApplyActions = 4
+	ofpatOutput       = 0
+	ofpatGroup        = 22
+	ofpatSetField     = 25
+)
+
+var (
+	ErrVersion  = errors.New("ovs: switch doesn't support openflow 1.3")
+	ErrShortMsg = errors.New("ovs: truncated openflow message")
+)
+
+// OFError is an error message received from the switch
+type OFError struct {
+	Type uint16
+	Code uint16
+}
+
+func (e *OFError) Error() string {
+	return fmt.Sprintf("ovs: openflow error type %d code %d", e.Type, e.Code)
+}
+
+// Match fields which are zero are wildcarded
+type Match struct {
+	InPort  uint32
+	EthSrc  net.HardwareAddr
+	EthDst  net.HardwareAddr
+	EthType uint16
+	Ipv4Src net.IP // needs EthType 0x0800
+	Ipv4Dst net.IP // needs EthType 0x0800
+}
+
+type Action interface {
+	encode(buf *bytes.Buffer)
+}
+
+type Output struct {
+	Port uint32
+}
+
+type SetEthDst struct {
+	Addr net.HardwareAddr
+}
+
+// sends the packet to a group
+type Group struct {
+	GroupId uint32
+}
+
+type Bucket struct {
+	Weight  uint16 // relative, select groups only
+	Actions []Action
+}
+
+type GroupMod struct {
+	Command uint16
+	Type    uint8
+	GroupId uint32
+	Buckets []*Bucket
+}
+
+type FlowMod struct {
+	Command    uint8
+	Cookie     uint64
+	CookieMask uint64
+	Priority   uint16
+	Match      Match
+	Actions    []Action
+}
+
+// action of a type we don't decode, kept as it is
+type RawAction struct {
+	Type uint16
+	Data []byte
+}
+
+type FlowStats struct {
+	Cookie   uint64
+	Priority uint16
+	Match    Match
+	Actions  []Action // applied, other instructions are left out
+	Packets  uint64
+	Bytes    uint64
+}
+
+type GroupDesc struct {
+	Type    uint8
+	GroupId uint32
+	Buckets []*Bucket
+}
+
+type ofHeader struct {
+	Version uint8
+	Type    uint8
+	Length  uint16
+	Xid     uint32
+}
+
+type ofMessage struct {
+	header ofHeader
+	body   []byte
+}
+
+// OFConn is an openflow connection to a switch. Requests are
+// synchronous, echo requests are answered while waiting for a reply.
+type OFConn struct {
+	sync.Mutex
+	conn net.Conn
+	xid  uint32
+}
+
+// e.g. DialOF("unix", "/var/run/openvswitch/br0.mgmt")
+func DialOF(network, address string) (*OFConn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewOFConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// exchanges hello messages on the connection
+func NewOFConn(conn net.Conn) (*OFConn, error) {
+	c := &OFConn{conn: conn}
+	if err := c.send(OFPT_HELLO, c.nextXid(), nil); err != nil {
+		return nil, err
+	}
+
+	msg, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if msg.header.Type != OFPT_HELLO || msg.header.Version < OFP_VERSION {
+		return nil, ErrVersion
+	}
+	return c, nil
+}
+
+func (c *OFConn) Close() error {
+	return c.conn.Close()
+}
+
+// sends the flow mod followed by a barrier, so that we know
+// that the switch has processed the flow mod when we return
+func (c *OFConn) FlowMod(fm *FlowMod) error {
+	c.Lock()
+	defer c.Unlock()
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, fm.Cookie)
+	binary.Write(&buf, binary.BigEndian, fm.CookieMask)
+	buf.WriteByte(0)
+	buf.WriteByte(fm.Command)
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	binary.Write(&buf, binary.BigEndian, fm.Priority)
+	binary.Write(&buf, binary.BigEndian, uint32(OFP_NO_BUFF))
+	binary.Write(&buf, binary.BigEndian, uint32(OFPP_ANY))
+	binary.Write(&buf, binary.BigEndian, uint32(OFPG_ANY))
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	buf.Write(make([]byte, 2))
+	fm.Match.encode(&buf)
+	if len(fm.Actions) != 0 {
+		encodeApply(&buf, fm.Actions)
+	}
+
+	return c.request(OFPT_FLOW_MOD, buf.Bytes())
+}
+
+// sends the group mod followed by a barrier, like FlowMod
+func (c *OFConn) GroupMod(gm *GroupMod) error {
+	c.Lock()
+	defer c.Unlock()
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, gm.Command)
+	buf.WriteByte(gm.Type)
+	buf.WriteByte(0)
+	binary.Write(&buf, binary.BigEndian, gm.GroupId)
+	for _, b := range gm.Buckets {
+		var abuf bytes.Buffer
+		for _, a := range b.Actions {
+			a.encode(&abuf)
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(16+abuf.Len()))
+		binary.Write(&buf, binary.BigEndian, b.Weight)
+		binary.Write(&buf, binary.BigEndian, uint32(OFPP_ANY))
+		binary.Write(&buf, binary.BigEndian, uint32(OFPG_ANY))
+		buf.Write(make([]byte, 4))
+		buf.Write(abuf.Bytes())
+	}
+
+	return c.request(OFPT_GROUP_MOD, buf.Bytes())
+}
+
+// flows matching the given match (non strict) and cookie under mask
+func (c *OFConn) Flows(match Match, cookie, mask uint64) ([]*FlowStats, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteByte(OFPTT_ALL)
+	buf.Write(make([]byte, 3))
+	binary.Write(&buf, binary.BigEndian, uint32(OFPP_ANY))
+	binary.Write(&buf, binary.BigEndian, uint32(OFPG_ANY))
+	buf.Write(make([]byte, 4))
+	binary.Write(&buf, binary.BigEndian, cookie)
+	binary.Write(&buf, binary.BigEndian, mask)
+	match.encode(&buf)
+
+	replies, err := c.multipart(OFPMP_FLOW, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	flows := make([]*FlowStats, 0)
+	for _, body := range replies {
+		fs, err := decodeFlowStats(body)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, fs...)
+	}
+	return flows, nil
+}
+
+// all the groups of the switch with their buckets
+func (c *OFConn) Groups() ([]*GroupDesc, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	replies, err := c.multipart(OFPMP_GROUP_DESC, nil)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*GroupDesc, 0)
+	for _, body := range replies {
+		gs, err := decodeGroupDesc(body)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, gs...)
+	}
+	return groups, nil
+}
+
+// sends the multipart request of the type, body is without the
+// multipart header. Returns the bodies of all the replies.
+func (c *OFConn) multipart(typ uint16, body []byte) ([][]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, typ)
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	buf.Write(make([]byte, 4))
+	buf.Write(body)
+
+	xid := c.nextXid()
+	if err := c.send(OFPT_MULTIPART_REQUEST, xid, buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	replies := make([][]byte, 0)
+	for {
+		msg, err := c.wait(xid)
+		if err != nil {
+			return nil, err
+		}
+		if msg.header.Type != OFPT_MULTIPART_REPLY || len(msg.body) < 8 {
+			return nil, ErrShortMsg
+		}
+
+		replies = append(replies, msg.body[8:])
+		if binary.BigEndian.Uint16(msg.body[2:4])&OFPMPF_REPLY_MORE == 0 {
+			return replies, nil
+		}
+	}
+}
+
+// sends the message and a barrier, returns the error sent by the switch
+func (c *OFConn) request(typ uint8, body []byte) error {
+	xid := c.nextXid()
+	if err := c.send(typ, xid, body); err != nil {
+		return err
+	}
+	bxid := c.nextXid()
+	if err := c.send(OFPT_BARRIER_REQUEST, bxid, nil); err != nil {
+		return err
+	}
+
+	var reqerr error
+	for {
+		msg, err := c.recv()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case msg.header.Type == OFPT_ERROR && msg.header.Xid == xid:
+			reqerr = decodeError(msg.body)
+		case msg.header.Type == OFPT_BARRIER_REPLY && msg.header.Xid == bxid:
+			return reqerr
+		}
+	}
+}
+
+// waits for the reply with given xid
+func (c *OFConn) wait(xid uint32) (*ofMessage, error) {
+	for {
+		msg, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		if msg.header.Xid != xid {
+			continue
+		}
+		if msg.header.Type == OFPT_ERROR {
+			return nil, decodeError(msg.body)
+		}
+		return msg, nil
+	}
+}
+
+func (c *OFConn) nextXid() uint32 {
+	c.xid++
+	return c.xid
+}
+
+func (c *OFConn) send(typ uint8, xid uint32, body []byte) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &ofHeader{
+		Version: OFP_VERSION,
+		Type:    typ,
+		Length:  uint16(8 + len(body)),
+		Xid:     xid,
+	})
+	buf.Write(body)
+
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// reads the next message, answering echo requests on the way
+func (c *OFConn) recv() (*ofMessage, error) {
+	for {
+		msg := &ofMessage{}
+		if err := binary.Read(c.conn, binary.BigEndian, &msg.header); err != nil {
+			return nil, err
+		}
+		if msg.header.Length < 8 {
+			return nil, ErrShortMsg
+		}
+		msg.body = make([]byte, msg.header.Length-8)
+		if _, err := io.ReadFull(c.conn, msg.body); err != nil {
+			return nil, err
+		}
+
+		if msg.header.Type == OFPT_ECHO_REQUEST {
+			if err := c.send(OFPT_ECHO_REPLY, msg.header.Xid, msg.body); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func decodeError(body []byte) error {
+	if len(body) < 4 {
+		return ErrShortMsg
+	}
+
+	return &OFError{
+		Type: binary.BigEndian.Uint16(body[0:2]),
+		Code: binary.BigEndian.Uint16(body[2:4]),
+	}
+}
+
+func (m *Match) encode(buf *bytes.Buffer) {
+	var oxm bytes.Buffer
+	if m.InPort != 0 {
+		writeOxm(&oxm, oxmInPort, 4)
+		binary.Write(&oxm, binary.BigEndian, m.InPort)
+	}
+	if m.EthDst != nil {
+		writeOxm(&oxm, oxmEthDst, 6)
+		oxm.Write(m.EthDst)
+	}
+	if m.EthSrc != nil {
+		writeOxm(&oxm, oxmEthSrc, 6)
+		oxm.Write(m.EthSrc)
+	}
+	if m.EthType != 0 {
+		writeOxm(&oxm, oxmEthType, 2)
+		binary.Write(&oxm, binary.BigEndian, m.EthType)
+	}
+	if ip := m.Ipv4Src.To4(); ip != nil {
+		writeOxm(&oxm, oxmIpv4Src, 4)
+		oxm.Write(ip)
+	}
+	if ip := m.Ipv4Dst.To4(); ip != nil {
+		writeOxm(&oxm, oxmIpv4Dst, 4)
+		oxm.Write(ip)
+	}
+
+	// type oxm, length excludes padding
+	length := 4 + oxm.Len()
+	binary.Write(buf, binary.BigEndian, uint16(1))
+	binary.Write(buf, binary.BigEndian, uint16(length))
+	buf.Write(oxm.Bytes())
+	buf.Write(make([]byte, pad8(length)))
+}
+
+// returns the match and the number of bytes it took, with padding
+func decodeMatch(data []byte) (Match, int, error) {
+	var m Match
+	if len(data) < 4 {
+		return m, 0, ErrShortMsg
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	total := length + pad8(length)
+	if len(data) < total || length < 4 {
+		return m, 0, ErrShortMsg
+	}
+
+	oxm := data[4:length]
+	for len(oxm) >= 4 {
+		class := binary.BigEndian.Uint16(oxm[0:2])
+		field := oxm[2] >> 1
+		size := int(oxm[3])
+		if len(oxm) < 4+size {
+			return m, 0, ErrShortMsg
+		}
+		value := oxm[4 : 4+size]
+
+		if class == oxmClassBasic {
+			switch {
+			case field == oxmInPort && size == 4:
+				m.InPort = binary.BigEndian.Uint32(value)
+			case field == oxmEthDst && size == 6:
+				m.EthDst = net.HardwareAddr(append([]byte{}, value...))
+			case field == oxmEthSrc && size == 6:
+				m.EthSrc = net.HardwareAddr(append([]byte{}, value...))
+			case field == oxmEthType && size == 2:
+				m.EthType = binary.BigEndian.Uint16(value)
+			case field == oxmIpv4Src && size == 4:
+				m.Ipv4Src = net.IP(append([]byte{}, value...))
+			case field == oxmIpv4Dst && size == 4:
+				m.Ipv4Dst = net.IP(append([]byte{}, value...))
+			}
+		}
+		oxm = oxm[4+size:]
+	}
+
+	return m, total, nil
+}
+
+func decodeFlowStats(data []byte) ([]*FlowStats, error) {
+	flows := make([]*FlowStats, 0)
+	for len(data) > 0 {
+		if len(data) < 48 {
+			return nil, ErrShortMsg
+		}
+		length := int(binary.BigEndian.Uint16(data[0:2]))
+		if length < 48 || len(data) < length {
+			return nil, ErrShortMsg
+		}
+
+		match, n, err := decodeMatch(data[48:length])
+		if err != nil {
+			return nil, err
+		}
+		actions, err := decodeInstructions(data[48+n : length])
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, &FlowStats{
+			Priority: binary.BigEndian.Uint16(data[12:14]),
+			Cookie:   binary.BigEndian.Uint64(data[24:32]),
+			Packets:  binary.BigEndian.Uint64(data[32:40]),
+			Bytes:    binary.BigEndian.Uint64(data[40:48]),
+			Match:    match,
+			Actions:  actions,
+		})
+		data = data[length:]
+	}
+
+	return flows, nil
+}
+
+// actions of the apply actions instruction, if any
+func decodeInstructions(data []byte) ([]Action, error) {
+	actions := make([]Action, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrShortMsg
+		}
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < 8 || len(data) < length {
+			return nil, ErrShortMsg
+		}
+
+		if binary.BigEndian.Uint16(data[0:2]) == ofpitApplyActions {
+			as, err := decodeActions(data[8:length])
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, as...)
+		}
+		data = data[length:]
+	}
+
+	return actions, nil
+}
+
+func decodeActions(data []byte) ([]Action, error) {
+	actions := make([]Action, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrShortMsg
+		}
+		typ := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < 8 || len(data) < length {
+			return nil, ErrShortMsg
+		}
+
+		a := data[:length]
+		switch {
+		case typ == ofpatOutput && length == 16:
+			actions = append(actions, &Output{Port: binary.BigEndian.Uint32(a[4:8])})
+		case typ == ofpatGroup:
+			actions = append(actions, &Group{GroupId: binary.BigEndian.Uint32(a[4:8])})
+		case typ == ofpatSetField && length == 16 && binary.BigEndian.Uint16(a[4:6]) == oxmClassBasic &&
+			a[6]>>1 == oxmEthDst && a[7] == 6:
+			actions = append(actions, &SetEthDst{Addr: net.HardwareAddr(append([]byte{}, a[8:14]...))})
+		default:
+			actions = append(actions, &RawAction{Type: typ, Data: append([]byte{}, a[4:]...)})
+		}
+		data = data[length:]
+	}
+
+	return actions, nil
+}
+
+func decodeGroupDesc(data []byte) ([]*GroupDesc, error) {
+	groups := make([]*GroupDesc, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrShortMsg
+		}
+		length := int(binary.BigEndian.Uint16(data[0:2]))
+		if length < 8 || len(data) < length {
+			return nil, ErrShortMsg
+		}
+
+		g := &GroupDesc{
+			Type:    data[2],
+			GroupId: binary.BigEndian.Uint32(data[4:8]),
+			Buckets: make([]*Bucket, 0),
+		}
+		for b := data[8:length]; len(b) > 0; {
+			blen := 0
+			if len(b) >= 16 {
+				blen = int(binary.BigEndian.Uint16(b[0:2]))
+			}
+			if blen < 16 || len(b) < blen {
+				return nil, ErrShortMsg
+			}
+			actions, err := decodeActions(b[16:blen])
+			if err != nil {
+				return nil, err
+			}
+			g.Buckets = append(g.Buckets, &Bucket{
+				Weight:  binary.BigEndian.Uint16(b[2:4]),
+				Actions: actions,
+			})
+			b = b[blen:]
+		}
+		groups = append(groups, g)
+		data = data[length:]
+	}
+
+	return groups, nil
+}
+
+func writeOxm(buf *bytes.Buffer, field uint8, size uint8) {
+	binary.Write(buf, binary.BigEndian, uint16(oxmClassBasic))
+	buf.WriteByte(field << 1)
+	buf.WriteByte(size)
+}
+
+func encodeApply(buf *bytes.Buffer, actions []Action) {
+	var abuf bytes.Buffer
+	for _, a := range actions {
+		a.encode(&abuf)
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(ofpitApplyActions))
+	binary.Write(buf, binary.BigEndian, uint16(8+abuf.Len()))
+	buf.Write(make([]byte, 4))
+	buf.Write(abuf.Bytes())
+}
+
+func (a *Output) encode(buf *bytes.Buffer) {
+	binary.Write(buf, binary.BigEndian, uint16(ofpatOutput))
+	binary.Write(buf, binary.BigEndian, uint16(16))
+	binary.Write(buf, binary.BigEndian, a.Port)
+	binary.Write(buf, binary.BigEndian, uint16(0xffff))
+	buf.Write(make([]byte, 6))
+}
+
+func (a *SetEthDst) encode(buf *bytes.Buffer) {
+	// 4 bytes of action header, 4 of oxm header and 6 of address
+	binary.Write(buf, binary.BigEndian, uint16(ofpatSetField))
+	binary.Write(buf, binary.BigEndian, uint16(16))
+	writeOxm(buf, oxmEthDst, 6)
+	buf.Write(a.Addr)
+	buf.Write(make([]byte, 2))
+}
+
+func (a *Group) encode(buf *bytes.Buffer) {
+	binary.Write(buf, binary.BigEndian, uint16(ofpatGroup))
+	binary.Write(buf, binary.BigEndian, uint16(8))
+	binary.Write(buf, binary.BigEndian, a.GroupId)
+}
+
+func (a *RawAction) encode(buf *bytes.Buffer) {
+	binary.Write(buf, binary.BigEndian, a.Type)
+	binary.Write(buf, binary.BigEndian, uint16(4+len(a.Data)))
+	buf.Write(a.Data)
+}
+
+func pad8(n int) int {
+	return (8 - n%8) % 8
+}
+
+// mac address as a number, used as cookie of flows of a container
+func MacCookie(mac net.HardwareAddr) uint64 {
+	var cookie uint64
+	for _, b := range mac {
+		cookie = cookie<<8 | uint64(b)
+	}
+	return cookie
+}
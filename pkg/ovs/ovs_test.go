@@ -0,0 +1,492 @@
+package ovs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeDB is a tiny in-memory ovsdb server, enough for the operations we use
+type fakeDB struct {
+	tables map[string]map[string]map[string]interface{}
+	count  int
+}
+
+func newFakeDB() *fakeDB {
+	db := &fakeDB{tables: make(map[string]map[string]map[string]interface{})}
+	db.tables[DB_NAME] = map[string]map[string]interface{}{
+		"root": {"bridges": Set()},
+	}
+	return db
+}
+
+func (db *fakeDB) serve(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	// echo first, the client has to reply to it while waiting
+	enc.Encode(map[string]interface{}{"method": "echo", "params": []string{"x"}, "id": "echo"})
+	for {
+		var req map[string]interface{}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if req["method"] != "transact" {
+			continue
+		}
+
+		params := req["params"].([]interface{})
+		results := make([]interface{}, 0)
+		names := make(map[string]string)
+		for _, p := range params[1:] {
+			results = append(results, db.exec(p.(map[string]interface{}), names))
+		}
+		enc.Encode(map[string]interface{}{"result": results, "error": nil, "id": req["id"]})
+	}
+}
+
+func (db *fakeDB) exec(op map[string]interface{}, names map[string]string) map[string]interface{} {
+	table := op["table"].(string)
+	if db.tables[table] == nil {
+		db.tables[table] = make(map[string]map[string]interface{})
+	}
+
+	switch op["op"] {
+	case "insert":
+		db.count++
+		id := fmt.Sprintf("uuid-%d", db.count)
+		if name, ok := op["uuid-name"].(string); ok {
+			names[name] = id
+		}
+		row := op["row"].(map[string]interface{})
+		for k, v := range row {
+			row[k] = resolve(v, names)
+		}
+		db.tables[table][id] = row
+		return map[string]interface{}{"uuid": UUID(id)}
+	case "select":
+		rows := make([]interface{}, 0)
+		for id, row := range db.match(table, op["where"].([]interface{})) {
+			r := map[string]interface{}{"_uuid": UUID(id)}
+			for k, v := range row {
+				r[k] = v
+			}
+			if _, ok := r["ofport"]; !ok {
+				r["ofport"] = float64(len(rows) + 1)
+			}
+			rows = append(rows, r)
+		}
+		return map[string]interface{}{"rows": rows}
+	case "update":
+		count := 0
+		for _, row := range db.match(table, op["where"].([]interface{})) {
+			for k, v := range op["row"].(map[string]interface{}) {
+				row[k] = v
+			}
+			count++
+		}
+		return map[string]interface{}{"count": count}
+	case "mutate":
+		count := 0
+		for _, row := range db.match(table, op["where"].([]interface{})) {
+			for _, m := range op["mutations"].([]interface{}) {
+				mut := m.([]interface{})
+				col := mut[0].(string)
+				arg := resolve(mut[2], names).([]interface{})[1].([]interface{})
+				cur, _ := row[col].([]interface{})
+				var vals []interface{}
+				if cur != nil && cur[0] == "set" {
+					vals = cur[1].([]interface{})
+				} else if cur != nil {
+					vals = []interface{}{cur}
+				}
+				switch mut[1] {
+				case "insert":
+					vals = append(vals, arg...)
+				case "delete":
+					kept := make([]interface{}, 0)
+					for _, v := range vals {
+						if fmt.Sprint(v) != fmt.Sprint(arg[0]) {
+							kept = append(kept, v)
+						}
+					}
+					vals = kept
+				}
+				row[col] = Set(vals...)
+			}
+			count++
+		}
+		if table == "Bridge" && count == 0 {
+			return map[string]interface{}{"error": "constraint violation", "details": "no bridge"}
+		}
+		return map[string]interface{}{"count": count}
+	}
+
+	return map[string]interface{}{"error": "not supported"}
+}
+
+func (db *fakeDB) match(table string, where []interface{}) map[string]map[string]interface{} {
+	rows := make(map[string]map[string]interface{})
+	for id, row := range db.tables[table] {
+		ok := true
+		for _, c := range where {
+			cond := c.([]interface{})
+			switch cond[1] {
+			case "==":
+				ok = ok && row[cond[0].(string)] == cond[2]
+			case "includes":
+				have := ToMap(row[cond[0].(string)])
+				for k, v := range ToMap(cond[2]) {
+					ok = ok && have[k] == v
+				}
+			}
+		}
+		if ok {
+			rows[id] = row
+		}
+	}
+	return rows
+}
+
+// replaces named uuids with real ones
+func resolve(v interface{}, names map[string]string) interface{} {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) != 2 {
+		return v
+	}
+	switch arr[0] {
+	case "named-uuid":
+		return UUID(names[arr[1].(string)])
+	case "set":
+		vals := make([]interface{}, 0)
+		for _, e := range arr[1].([]interface{}) {
+			vals = append(vals, resolve(e, names))
+		}
+		return Set(vals...)
+	}
+	return v
+}
+
+// connected pair of buffered connections, unlike net.Pipe
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestOVSDB(t *testing.T) {
+	server, client := pipe(t)
+	db := newFakeDB()
+	go db.serve(server)
+	c := NewClient(client)
+	defer c.Close()
+
+	if ok, err := c.BridgeExists("br0"); err != nil || ok {
+		t.Fatalf("expected no bridge, got %v %v", ok, err)
+	}
+	if err := c.AddBridge("br0", "OpenFlow13"); err != nil {
+		t.Fatal("unable to add bridge:", err)
+	}
+	if ok, err := c.BridgeExists("br0"); err != nil || !ok {
+		t.Fatalf("expected bridge br0, got %v %v", ok, err)
+	}
+
+	ids := map[string]string{"attached-mac": "00:16:3e:00:00:01", "container_id": "c1"}
+	if err := c.AddPort("br0", "c1_l", ids); err != nil {
+		t.Fatal("unable to add port:", err)
+	}
+	ifaces, err := c.FindInterfaces("attached-mac", "00:16:3e:00:00:01")
+	if err != nil || len(ifaces) != 1 || ifaces[0].Name != "c1_l" || ifaces[0].ExternalIds["container_id"] != "c1" {
+		t.Fatalf("expected interface c1_l, got %v %v", ifaces, err)
+	}
+	if err := c.SetInterface("c1_l", map[string]interface{}{"ingress_policing_rate": 1000}); err != nil {
+		t.Error("unable to set interface:", err)
+	}
+	for _, row := range db.match("Interface", Where(Cond("name", "==", "c1_l"))) {
+		if row["ingress_policing_rate"] != float64(1000) {
+			t.Errorf("expected policing rate 1000, got %v", row["ingress_policing_rate"])
+		}
+	}
+	if err := c.SetInterface("c9_l", map[string]interface{}{"ingress_policing_rate": 0}); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if err := c.DelPort("br0", "c1_l"); err != nil {
+		t.Error("unable to delete port:", err)
+	}
+
+	err = c.AddPort("br9", "c2_l", ids)
+	if terr, ok := err.(*TransactError); !ok || terr.Index != 2 {
+		t.Errorf("expected transaction error for missing bridge, got %v", err)
+	}
+	if err := c.DelBridge("br9"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+// fakeSwitch keeps flows added with flow mods and answers flow stats,
+// groups are kept as the weights of their buckets and as sent for their
+// descriptions
+type fakeSwitch struct {
+	flows  []*FlowStats
+	instrs [][]byte
+	groups map[uint32][]uint16
+	descs  map[uint32][]byte
+}
+
+func (s *fakeSwitch) serve(conn net.Conn) {
+	defer conn.Close()
+	write := func(typ uint8, xid uint32, body []byte) {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, &ofHeader{OFP_VERSION, typ, uint16(8 + len(body)), xid})
+		buf.Write(body)
+		conn.Write(buf.Bytes())
+	}
+
+	for {
+		var h ofHeader
+		if err := binary.Read(conn, binary.BigEndian, &h); err != nil {
+			return
+		}
+		body := make([]byte, h.Length-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		switch h.Type {
+		case OFPT_HELLO:
+			write(OFPT_HELLO, h.Xid, nil)
+			write(OFPT_ECHO_REQUEST, 99, []byte("ping"))
+		case OFPT_ECHO_REPLY:
+		case OFPT_FLOW_MOD:
+			match, n, err := decodeMatch(body[40:])
+			if err != nil {
+				write(OFPT_ERROR, h.Xid, []byte{0, 5, 0, 1})
+				continue
+			}
+			cookie := binary.BigEndian.Uint64(body[0:8])
+			switch body[17] {
+			case OFPFC_ADD:
+				if match.EthSrc == nil {
+					write(OFPT_ERROR, h.Xid, []byte{0, 5, 0, 4})
+					continue
+				}
+				s.flows = append(s.flows, &FlowStats{
+					Cookie:   cookie,
+					Priority: binary.BigEndian.Uint16(body[22:24]),
+					Match:    match,
+				})
+				s.instrs = append(s.instrs, body[40+n:])
+			case OFPFC_DELETE:
+				kept := make([]*FlowStats, 0)
+				instrs := make([][]byte, 0)
+				for i, f := range s.flows {
+					if f.Match.EthSrc.String() != match.EthSrc.String() {
+						kept = append(kept, f)
+						instrs = append(instrs, s.instrs[i])
+					}
+				}
+				s.flows, s.instrs = kept, instrs
+			}
+		case OFPT_GROUP_MOD:
+			id := binary.BigEndian.Uint32(body[4:8])
+			weights := make([]uint16, 0)
+			for b := body[8:]; len(b) >= 16; b = b[binary.BigEndian.Uint16(b[0:2]):] {
+				weights = append(weights, binary.BigEndian.Uint16(b[2:4]))
+			}
+			_, exists := s.groups[id]
+			switch binary.BigEndian.Uint16(body[0:2]) {
+			case OFPGC_ADD:
+				if exists {
+					write(OFPT_ERROR, h.Xid, []byte{0, OFPET_GROUP_MOD_FAILED, 0, OFPGMFC_GROUP_EXISTS})
+					continue
+				}
+				s.groups[id] = weights
+				s.descs[id] = body[2:]
+			case OFPGC_MODIFY:
+				s.groups[id] = weights
+				s.descs[id] = body[2:]
+			case OFPGC_DELETE:
+				delete(s.groups, id)
+				delete(s.descs, id)
+			}
+		case OFPT_BARRIER_REQUEST:
+			write(OFPT_BARRIER_REPLY, h.Xid, nil)
+		case OFPT_MULTIPART_REQUEST:
+			var stats bytes.Buffer
+			if binary.BigEndian.Uint16(body[0:2]) == OFPMP_GROUP_DESC {
+				for _, desc := range s.descs {
+					binary.Write(&stats, binary.BigEndian, uint16(2+len(desc)))
+					stats.Write(desc)
+				}
+			} else {
+				for i, f := range s.flows {
+					var m bytes.Buffer
+					f.Match.encode(&m)
+					binary.Write(&stats, binary.BigEndian, uint16(48+m.Len()+len(s.instrs[i])))
+					stats.Write(make([]byte, 10))
+					binary.Write(&stats, binary.BigEndian, f.Priority)
+					stats.Write(make([]byte, 10))
+					binary.Write(&stats, binary.BigEndian, f.Cookie)
+					stats.Write(make([]byte, 16))
+					stats.Write(m.Bytes())
+					stats.Write(s.instrs[i])
+				}
+			}
+			reply := append(append([]byte{}, body[0:2]...), make([]byte, 6)...)
+			write(OFPT_MULTIPART_REPLY, h.Xid, append(reply, stats.Bytes()...))
+		}
+	}
+}
+
+func TestOpenFlow(t *testing.T) {
+	server, client := pipe(t)
+	sw := &fakeSwitch{groups: make(map[uint32][]uint16), descs: make(map[uint32][]byte)}
+	go sw.serve(server)
+	c, err := NewOFConn(client)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	defer c.Close()
+
+	cmac, _ := net.ParseMAC("00:16:3e:00:00:01")
+	rmac, _ := net.ParseMAC("00:16:3e:00:00:02")
+	smac, _ := net.ParseMAC("00:16:3e:00:00:03")
+	match := Match{
+		EthSrc:  cmac,
+		EthDst:  smac,
+		EthType: 0x0800,
+		Ipv4Src: net.ParseIP("10.0.0.1"),
+		Ipv4Dst: net.ParseIP("10.0.0.3"),
+	}
+	err = c.FlowMod(&FlowMod{
+		Command:  OFPFC_ADD,
+		Cookie:   MacCookie(cmac),
+		Priority: 100,
+		Match:    match,
+		Actions:  []Action{&SetEthDst{Addr: rmac}, &Output{Port: OFPP_NORMAL}},
+	})
+	if err != nil {
+		t.Fatal("unable to add flow:", err)
+	}
+
+	flows, err := c.Flows(Match{EthSrc: cmac}, MacCookie(cmac), ^uint64(0))
+	if err != nil || len(flows) != 1 {
+		t.Fatalf("expected 1 flow, got %v %v", flows, err)
+	}
+	f := flows[0]
+	if f.Cookie != MacCookie(cmac) || f.Priority != 100 || f.Match.EthDst.String() != smac.String() ||
+		f.Match.EthType != 0x0800 || f.Match.Ipv4Src.String() != "10.0.0.1" ||
+		f.Match.Ipv4Dst.String() != "10.0.0.3" {
+		t.Errorf("unexpected flow %+v", f)
+	}
+	if len(f.Actions) != 2 {
+		t.Fatalf("expected 2 actions, got %v", f.Actions)
+	}
+	if a, ok := f.Actions[0].(*SetEthDst); !ok || a.Addr.String() != rmac.String() {
+		t.Errorf("expected mod_dl_dst to %s, got %+v", rmac, f.Actions[0])
+	}
+	if a, ok := f.Actions[1].(*Output); !ok || a.Port != OFPP_NORMAL {
+		t.Errorf("expected output to normal, got %+v", f.Actions[1])
+	}
+
+	err = c.FlowMod(&FlowMod{Command: OFPFC_ADD, Priority: 100})
+	if oferr, ok := err.(*OFError); !ok || oferr.Type != 5 || oferr.Code != 4 {
+		t.Errorf("expected openflow error, got %v", err)
+	}
+
+	if err := c.FlowMod(&FlowMod{Command: OFPFC_DELETE, Match: Match{EthSrc: cmac}}); err != nil {
+		t.Fatal("unable to delete flows:", err)
+	}
+	if flows, err := c.Flows(Match{}, 0, 0); err != nil || len(flows) != 0 {
+		t.Errorf("expected no flows, got %v %v", flows, err)
+	}
+}
+
+func TestGroupMod(t *testing.T) {
+	server, client := pipe(t)
+	sw := &fakeSwitch{groups: make(map[uint32][]uint16), descs: make(map[uint32][]byte)}
+	go sw.serve(server)
+	c, err := NewOFConn(client)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	defer c.Close()
+
+	r1, _ := net.ParseMAC("00:16:3e:00:00:02")
+	r2, _ := net.ParseMAC("00:16:3e:00:00:03")
+	gm := &GroupMod{
+		Command: OFPGC_ADD,
+		Type:    OFPGT_SELECT,
+		GroupId: 7,
+		Buckets: []*Bucket{
+			{Weight: 512, Actions: []Action{&SetEthDst{Addr: r1}, &Output{Port: OFPP_NORMAL}}},
+			{Weight: 256, Actions: []Action{&SetEthDst{Addr: r2}, &Output{Port: 3}}},
+		},
+	}
+	if err := c.GroupMod(gm); err != nil {
+		t.Fatal("unable to add group:", err)
+	}
+	if w := sw.groups[7]; len(w) != 2 || w[0] != 512 || w[1] != 256 {
+		t.Errorf("unexpected weights %v", w)
+	}
+
+	err = c.GroupMod(gm)
+	if oferr, ok := err.(*OFError); !ok || oferr.Type != OFPET_GROUP_MOD_FAILED {
+		t.Errorf("expected group exists error, got %v", err)
+	}
+
+	gm.Command = OFPGC_MODIFY
+	gm.Buckets[1].Weight = 1024
+	if err := c.GroupMod(gm); err != nil {
+		t.Fatal("unable to modify group:", err)
+	}
+	if w := sw.groups[7]; len(w) != 2 || w[1] != 1024 {
+		t.Errorf("unexpected weights after modify %v", w)
+	}
+
+	groups, err := c.Groups()
+	if err != nil || len(groups) != 1 {
+		t.Fatalf("expected 1 group, got %v %v", groups, err)
+	}
+	if g := groups[0]; g.GroupId != 7 || g.Type != OFPGT_SELECT || len(g.Buckets) != 2 ||
+		g.Buckets[1].Weight != 1024 || len(g.Buckets[1].Actions) != 2 {
+		t.Fatalf("unexpected group %+v", g)
+	}
+	if a, ok := groups[0].Buckets[1].Actions[1].(*Output); !ok || a.Port != 3 {
+		t.Errorf("expected output to 3, got %+v", groups[0].Buckets[1].Actions[1])
+	}
+
+	err = c.FlowMod(&FlowMod{
+		Command:  OFPFC_ADD,
+		Priority: 100,
+		Match:    Match{EthSrc: r1},
+		Actions:  []Action{&Group{GroupId: 7}},
+	})
+	if err != nil {
+		t.Fatal("unable to add flow to group:", err)
+	}
+
+	if err := c.GroupMod(&GroupMod{Command: OFPGC_DELETE, GroupId: 7}); err != nil {
+		t.Fatal("unable to delete group:", err)
+	}
+	if _, ok := sw.groups[7]; ok {
+		t.Error("group not deleted")
+	}
+}
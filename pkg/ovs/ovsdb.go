@@ -0,0 +1,282 @@
+package ovs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	DB_NAME     = "Open_vSwitch"
+	DEF_DB_SOCK = "/var/run/openvswitch/db.sock"
+)
+
+var (
+	ErrNotFound  = errors.New("ovs: no such row")
+	ErrBadResult = errors.New("ovs: unexpected result from ovsdb")
+)
+
+// RPCError is an error returned by ovsdb for a json-rpc call
+type RPCError struct {
+	Method string
+	Err    interface{}
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("ovs: %s failed: %v", e.Method, e.Err)
+}
+
+// TransactError is the error of the first failed operation of a
+// transaction, Index is len(ops) if the commit itself failed
+type TransactError struct {
+	Index   int
+	Err     string
+	Details string
+}
+
+func (e *TransactError) Error() string {
+	return fmt.Sprintf("ovs: operation %d failed: %s (%s)", e.Index, e.Err, e.Details)
+}
+
+// Client talks to ovsdb-server using json-rpc (RFC 7047). Calls are
+// synchronous, echo requests of the server are answered while waiting.
+type Client struct {
+	sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+	id   int
+}
+
+type rpcRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	Id     interface{}   `json:"id"`
+}
+
+type rpcMessage struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  interface{}     `json:"error"`
+	Id     interface{}     `json:"id"`
+}
+
+// network is unix or tcp
+func Dial(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// sends the request and waits for the response with the same id
+func (c *Client) call(method string, params []interface{}, result interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.id++
+	id := c.id
+	err := c.enc.Encode(&rpcRequest{Method: method, Params: params, Id: id})
+	if err != nil {
+		return err
+	}
+
+	for {
+		var msg rpcMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return err
+		}
+
+		if msg.Method == "echo" {
+			var params []interface{}
+			json.Unmarshal(msg.Params, &params)
+			err := c.enc.Encode(map[string]interface{}{
+				"result": params,
+				"error":  nil,
+				"id":     msg.Id,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// json numbers are decoded as float64
+		if rid, ok := msg.Id.(float64); !ok || int(rid) != id {
+			continue
+		}
+		if msg.Error != nil {
+			return &RPCError{Method: method, Err: msg.Error}
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	}
+}
+
+func (c *Client) Echo() error {
+	return c.call("echo", []interface{}{"ping"}, nil)
+}
+
+// executes all the operations atomically
+func (c *Client) Transact(ops ...Operation) ([]*OpResult, error) {
+	params := make([]interface{}, 0, len(ops)+1)
+	params = append(params, DB_NAME)
+	for _, op := range ops {
+		params = append(params, op)
+	}
+
+	var results []*OpResult
+	if err := c.call("transact", params, &results); err != nil {
+		return nil, err
+	}
+	for i, res := range results {
+		if res != nil && res.Error != "" {
+			return nil, &TransactError{Index: i, Err: res.Error, Details: res.Details}
+		}
+	}
+	if len(results) < len(ops) {
+		return nil, ErrBadResult
+	}
+
+	return results, nil
+}
+
+// Operation is one operation of a transaction
+type Operation map[string]interface{}
+
+type OpResult struct {
+	Count   int                      `json:"count"`
+	UUID    []string                 `json:"uuid"`
+	Rows    []map[string]interface{} `json:"rows"`
+	Error   string                   `json:"error"`
+	Details string                   `json:"details"`
+}
+
+// uuid of the inserted row
+func (r *OpResult) Id() string {
+	if len(r.UUID) != 2 {
+		return ""
+	}
+	return r.UUID[1]
+}
+
+func Insert(table string, row map[string]interface{}, name string) Operation {
+	op := Operation{"op": "insert", "table": table, "row": row}
+	if name != "" {
+		op["uuid-name"] = name
+	}
+	return op
+}
+
+func Select(table string, where []interface{}, columns ...string) Operation {
+	op := Operation{"op": "select", "table": table, "where": where}
+	if len(columns) != 0 {
+		op["columns"] = columns
+	}
+	return op
+}
+
+func Update(table string, where []interface{}, row map[string]interface{}) Operation {
+	return Operation{"op": "update", "table": table, "where": where, "row": row}
+}
+
+func Mutate(table string, where []interface{}, mutations ...interface{}) Operation {
+	return Operation{"op": "mutate", "table": table, "where": where, "mutations": mutations}
+}
+
+func Delete(table string, where []interface{}) Operation {
+	return Operation{"op": "delete", "table": table, "where": where}
+}
+
+// condition or mutation, e.g. Cond("name", "==", "br0")
+func Cond(column, function string, value interface{}) []interface{} {
+	return []interface{}{column, function, value}
+}
+
+func Where(conds ...[]interface{}) []interface{} {
+	where := make([]interface{}, 0, len(conds))
+	for _, cond := range conds {
+		where = append(where, cond)
+	}
+	return where
+}
+
+func UUID(id string) []interface{} {
+	return []interface{}{"uuid", id}
+}
+
+func NamedUUID(name string) []interface{} {
+	return []interface{}{"named-uuid", name}
+}
+
+func Set(values ...interface{}) []interface{} {
+	return []interface{}{"set", values}
+}
+
+func Map(m map[string]string) []interface{} {
+	pairs := make([]interface{}, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, []interface{}{k, v})
+	}
+	return []interface{}{"map", pairs}
+}
+
+// decodes a map column of a row
+func ToMap(value interface{}) map[string]string {
+	m := make(map[string]string)
+	arr, ok := value.([]interface{})
+	if !ok || len(arr) != 2 || arr[0] != "map" {
+		return m
+	}
+
+	pairs, _ := arr[1].([]interface{})
+	for _, pair := range pairs {
+		kv, ok := pair.([]interface{})
+		if !ok || len(kv) != 2 {
+			continue
+		}
+		k, ok1 := kv[0].(string)
+		v, ok2 := kv[1].(string)
+		if ok1 && ok2 {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// decodes a uuid column of a row
+func ToUUID(value interface{}) string {
+	arr, ok := value.([]interface{})
+	if !ok || len(arr) != 2 || arr[0] != "uuid" {
+		return ""
+	}
+	id, _ := arr[1].(string)
+	return id
+}
+
+// decodes an optional integer column of a row, -1 if it is not set
+func ToInt(value interface{}) int {
+	if f, ok := value.(float64); ok {
+		return int(f)
+	}
+	return -1
+}
@@ -0,0 +1,163 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	TYPE_WRITE    = "write"
+	TYPE_ACTION   = "action"
+	FILE_NAME     = "nfs.rec"
+	DEF_MAX_SIZE  = 100 * 1024 * 1024
+	DEF_MAX_FILES = 10
+)
+
+// Entry is either an incoming write request or a control action,
+// one json object per line in the log
+type Entry struct {
+	Type      string            `json:"type"`
+	Time      time.Time         `json:"time"`
+	DB        string            `json:"db,omitempty"`
+	Precision string            `json:"precision,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Action    string            `json:"action,omitempty"`
+	Node      string            `json:"node,omitempty"`
+	Args      map[string]string `json:"args,omitempty"`
+}
+
+// Recorder appends entries to <dir>/nfs.rec and rotates the file when it
+// grows beyond max_size, keeping at most max_files old files (nfs.rec.N)
+type Recorder struct {
+	sync.Mutex
+	dir       string
+	max_size  int64
+	max_files int
+	file      *os.File
+	size      int64
+}
+
+func NewRecorder(dir string, max_size int64, max_files int) (*Recorder, error) {
+	r := &Recorder{
+		dir:       dir,
+		max_size:  max_size,
+		max_files: max_files,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) Close() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.file.Close()
+}
+
+// records body of a write request as received
+func (r *Recorder) Write(db, precision string, body []byte) {
+	r.append(&Entry{
+		Type:      TYPE_WRITE,
+		Time:      time.Now().UTC(),
+		DB:        db,
+		Precision: precision,
+		Body:      string(body),
+	})
+}
+
+// records a control action taken on a node
+func (r *Recorder) Action(action, node string, args map[string]string) {
+	r.append(&Entry{
+		Type:   TYPE_ACTION,
+		Time:   time.Now().UTC(),
+		Action: action,
+		Node:   node,
+		Args:   args,
+	})
+}
+
+// reads all the entries from a log
+func ReadEntries(rd io.Reader) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	dec := json.NewDecoder(bufio.NewReader(rd))
+	for {
+		var e Entry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &e)
+	}
+}
+
+func (r *Recorder) append(e *Entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("[WARN] unable to encode record entry:", err)
+		return
+	}
+	data = append(data, '\n')
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.size+int64(len(data)) > r.max_size && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			log.Println("[WARN] unable to rotate record file:", err)
+		}
+	}
+
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	if err != nil {
+		log.Println("[WARN] unable to write record entry:", err)
+	}
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(path.Join(r.dir, FILE_NAME), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// nfs.rec.(N-1) -> nfs.rec.N, ..., nfs.rec -> nfs.rec.1
+func (r *Recorder) rotate() error {
+	r.file.Close()
+
+	name := path.Join(r.dir, FILE_NAME)
+	os.Remove(fmt.Sprintf("%s.%d", name, r.max_files))
+	for i := r.max_files - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+	}
+	if r.max_files > 0 {
+		os.Rename(name, name+".1")
+	} else {
+		os.Remove(name)
+	}
+
+	log.Println("[INFO] rotated record file", name)
+	return r.open()
+}
@@ -0,0 +1,60 @@
+package record
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRecorder(dir, 1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		r.Write("cadvisor", "n", []byte("rx_packets,container_name=snort value=1 1"))
+		r.Action("set_shares", "snort", map[string]string{"shares": "512"})
+	}
+	r.Close()
+
+	if _, err := os.Stat(path.Join(dir, FILE_NAME+".2")); err != nil {
+		t.Error("expected rotated file:", err)
+	}
+	if _, err := os.Stat(path.Join(dir, FILE_NAME+".3")); err == nil {
+		t.Error("expected at most 2 rotated files")
+	}
+
+	file, err := os.Open(path.Join(dir, FILE_NAME+".1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, err := ReadEntries(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("expected entries in rotated file")
+	}
+	for _, e := range entries {
+		switch e.Type {
+		case TYPE_WRITE:
+			if e.DB != "cadvisor" || e.Precision != "n" || e.Body == "" {
+				t.Errorf("unexpected write entry %+v", e)
+			}
+		case TYPE_ACTION:
+			if e.Action != "set_shares" || e.Args["shares"] != "512" {
+				t.Errorf("unexpected action entry %+v", e)
+			}
+		default:
+			t.Errorf("unexpected entry type %s", e.Type)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/influxdb/influxdb/models"
+	"github.com/mangalaman93/nfs/nfsmain"
+	"github.com/mangalaman93/nfs/sim"
+	"github.com/mangalaman93/nfs/voip"
+)
+
+// replays recorded line protocol data to a voip controller running on top
+// of the simulator, so that control decisions can be reproduced offline
+func main() {
+	var cfile, precision, db string
+	var speed float64
+	var window time.Duration
+	var shares int
+	flag.StringVar(&cfile, "c", ".voip.conf", "abs path to configuration file")
+	flag.StringVar(&precision, "precision", "n", "precision of timestamps in the trace")
+	flag.StringVar(&db, "db", "", "database to replay from a record log, db of VOIP in the config by default")
+	flag.Float64Var(&speed, "speed", 1, "replay speed, 0 for as fast as possible")
+	flag.DurationVar(&window, "window", time.Second, "duration of data sent in one batch")
+	flag.IntVar(&shares, "shares", 1024, "initial cpu shares of snorts")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Printf("usage: %s [options] <trace file or record log>\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	config, err := goconfig.LoadConfigFile(cfile)
+	if err != nil {
+		log.Println("[ERROR] error in reading config file:", err)
+		panic(err)
+	}
+	if db == "" {
+		db = config.MustValue("VOIP", "db", "voip")
+	}
+	queue_table, err := config.GetValue("VOIP.CONTROL", "queue_table")
+	if err != nil {
+		log.Println("[ERROR] error in finding queue_table in config:", err)
+		panic(err)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Println("[ERROR] unable to open trace:", err)
+		panic(err)
+	}
+	// record logs are json, one entry per line
+	var points models.Points
+	rd := bufio.NewReader(file)
+	if b, perr := rd.Peek(1); perr == nil && b[0] == '{' {
+		points, err = nfsmain.ReadRecord(rd, db)
+	} else {
+		points, err = nfsmain.ReadPoints(rd, precision)
+	}
+	file.Close()
+	if err != nil {
+		log.Println("[ERROR] unable to parse trace:", err)
+		panic(err)
+	}
+
+	s, err := sim.NewSimulator(config)
+	if err != nil {
+		log.Println("[ERROR] unable to create simulator:", err)
+		panic(err)
+	}
+	vl, err := voip.NewVoipLineWith(config, s)
+	if err != nil {
+		log.Println("[ERROR] unable to create voip line:", err)
+		panic(err)
+	}
+
+	// every container with queue data in the trace is a snort
+	replayer := nfsmain.NewReplayer(vl, speed, window)
+	snorts := make(map[string]bool)
+	for _, point := range points {
+		name := point.Tags()["container_name"]
+		if point.Name() != queue_table || name == "" || snorts[name] {
+			continue
+		}
+		snorts[name] = true
+
+		resp := vl.HandleRequest(&voip.Request{
+			Code:   voip.ReqStartSnort,
+			KeyVal: map[string]string{"shares": strconv.Itoa(shares)},
+		})
+		if resp.Err != "" {
+			log.Println("[ERROR] unable to start snort:", resp.Err)
+			os.Exit(1)
+		}
+		replayer.Rename(name, resp.Result)
+		log.Println("[INFO] replaying", name, "as", resp.Result)
+	}
+
+	replayer.Replay(points)
+}
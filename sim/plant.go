@@ -0,0 +1,83 @@
+package sim
+
+import (
+	"time"
+
+	"github.com/mangalaman93/nfs/voip"
+)
+
+// plant is the model of one container. Counters are cumulative, as
+// reported by moncont and cadvisor, cpu is in ns.
+type plant struct {
+	node   *voip.Node
+	nf     *voip.NF
+	kind   string
+	shares int64
+	rate   float64
+	limit  float64 // pps the network lets through, 0 for no limit
+
+	queue float64
+	rx    float64
+	tx    float64
+	drops float64
+	cpu   float64
+}
+
+// routers are queues, clients send at their rate and servers only use cpu
+func model(nf *voip.NF) string {
+	switch {
+	case nf.Router:
+		return KIND_ROUTER
+	case nf.Kind == voip.ROLE_CLIENT:
+		return KIND_CLIENT
+	default:
+		return KIND_SERVER
+	}
+}
+
+// rate at which the traffic of a client reaches the network
+func (p *plant) sent() float64 {
+	if p.limit > 0 && p.limit < p.rate {
+		return p.limit
+	}
+	return p.rate
+}
+
+// moves the plant forward by dt seconds given arrival rate (packets per second),
+// service rate of one core and the maximum length of the queue
+func (p *plant) advance(dt, arrival, service, qsize float64) {
+	cores := float64(p.shares) / 1024
+	switch p.kind {
+	case KIND_CLIENT:
+		p.tx += p.sent() * dt
+		p.cpu += p.rate * dt / service * 1e9
+	case KIND_ROUTER:
+		p.rx += arrival * dt
+		p.queue += arrival * dt
+
+		served := cores * service * dt
+		if served > p.queue {
+			served = p.queue
+		}
+		p.queue -= served
+		p.tx += served
+		p.cpu += served / service * 1e9
+
+		if p.queue > qsize {
+			p.drops += p.queue - qsize
+			p.queue = qsize
+		}
+	}
+}
+
+func (p *plant) entry(ts time.Time) *TraceEntry {
+	return &TraceEntry{
+		Time:   ts,
+		Id:     p.node.Id(),
+		Shares: p.shares,
+		Queue:  p.queue,
+		Rx:     p.rx,
+		Tx:     p.tx,
+		Drops:  p.drops,
+	}
+}
@@ -0,0 +1,338 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/influxdb/influxdb/models"
+	"github.com/mangalaman93/nfs/nfsmain"
+	"github.com/mangalaman93/nfs/voip"
+)
+
+const (
+	DEF_TICK         = 10
+	DEF_INTERVAL     = 1000
+	DEF_SERVICE_RATE = 4000
+	DEF_QUEUE_SIZE   = 1024
+)
+
+// models of the NFs
+const (
+	KIND_SERVER = "server"
+	KIND_ROUTER = "router"
+	KIND_CLIENT = "client"
+)
+
+// Simulator implements voip.CManager in memory. Every router NF (e.g. snort)
+// is modelled as a queue served at a rate proportional to its cpu shares.
+// Time is virtual, therefore a simulation runs much faster than real time.
+type Simulator struct {
+	sync.Mutex
+
+	hosts   map[string]bool
+	catalog voip.Catalog
+	plants  map[string]*plant
+	routes  map[string]map[string]float64 // client -> hop -> part of its rate
+	count   int
+	clock   time.Time
+	trace   []*TraceEntry
+
+	// parameters, durations in ms
+	tick         int64
+	interval     int64
+	service_rate float64
+	queue_size   float64
+
+	// cpu of all the plants, the other tables are of the NFs
+	cpu_table string
+}
+
+func NewSimulator(config *goconfig.ConfigFile) (*Simulator, error) {
+	hosts := config.GetKeyList("VOIP.TOPO")
+	if hosts == nil {
+		return nil, voip.ErrNoHosts
+	}
+
+	cpu_table, err := config.GetValue("VOIP.CONTROL", "cpu_table")
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := voip.NewCatalog(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hmap := make(map[string]bool)
+	for _, host := range hosts {
+		hmap[host] = true
+	}
+
+	return &Simulator{
+		hosts:        hmap,
+		catalog:      catalog,
+		plants:       make(map[string]*plant),
+		routes:       make(map[string]map[string]float64),
+		clock:        time.Now(),
+		tick:         config.MustInt64("SIM", "tick", DEF_TICK),
+		interval:     config.MustInt64("SIM", "interval", DEF_INTERVAL),
+		service_rate: config.MustFloat64("SIM", "service_rate", DEF_SERVICE_RATE),
+		queue_size:   config.MustFloat64("SIM", "queue_size", DEF_QUEUE_SIZE),
+		cpu_table:    cpu_table,
+	}, nil
+}
+
+func (s *Simulator) Setup() error {
+	log.Println("[INFO] setup simulator with", len(s.hosts), "hosts")
+	return nil
+}
+
+func (s *Simulator) Destroy() {
+	log.Println("[INFO] destroyed simulator")
+}
+
+// params and resources besides shares don't change the model of the NF
+func (s *Simulator) StartNF(kind, host string, res voip.Resources, params map[string]string) (*voip.Node, error) {
+	nf, err := s.catalog.Get(kind)
+	if err != nil {
+		return nil, err
+	}
+	return s.start(host, nf, res.Shares)
+}
+
+func (s *Simulator) StopCont(node *voip.Node) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.plants[node.Id()]; !ok {
+		return voip.ErrIdNotExists
+	}
+
+	delete(s.plants, node.Id())
+	delete(s.routes, node.Id())
+	return nil
+}
+
+func (s *Simulator) Adopt(node *voip.Node) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.plants[node.Id()]; !ok {
+		return voip.ErrNotRunning
+	}
+	return nil
+}
+
+func (s *Simulator) List() ([]*voip.Node, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	nodes := make([]*voip.Node, 0, len(s.plants))
+	for _, p := range s.plants {
+		nodes = append(nodes, p.node)
+	}
+	return nodes, nil
+}
+
+// every hop of the chain sees all the traffic of the client, the
+// hops of a symmetric chain see the replies of the server as well
+func (s *Simulator) Route(chain []*voip.Node, symmetric bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, node := range chain {
+		if _, ok := s.plants[node.Id()]; !ok {
+			return voip.ErrIdNotExists
+		}
+	}
+
+	hops := make(map[string]float64)
+	for _, node := range chain[1 : len(chain)-1] {
+		hops[node.Id()] += 1
+		if symmetric {
+			hops[node.Id()] += 1
+		}
+	}
+	s.routes[chain[0].Id()] = hops
+	return nil
+}
+
+// each replica sees its part of the traffic of the client by weight
+func (s *Simulator) Balance(cnode *voip.Node, replicas []*voip.Node, weights []int64, snode *voip.Node) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, node := range append([]*voip.Node{cnode, snode}, replicas...) {
+		if _, ok := s.plants[node.Id()]; !ok {
+			return voip.ErrIdNotExists
+		}
+	}
+
+	var total int64
+	for _, weight := range weights {
+		total += weight
+	}
+	hops := make(map[string]float64)
+	for i, node := range replicas {
+		if total > 0 {
+			hops[node.Id()] += float64(weights[i]) / float64(total)
+		}
+	}
+	s.routes[cnode.Id()] = hops
+	return nil
+}
+
+func (s *Simulator) DeRoute(chain []*voip.Node) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.routes, chain[0].Id())
+	return nil
+}
+
+// the simulator has no flows that could drift
+func (s *Simulator) Routes() (map[string][]string, error) {
+	return nil, nil
+}
+
+func (s *Simulator) ChainRoutes(chain []*voip.Node, symmetric bool, weights []int64) (map[string][]string, error) {
+	return nil, nil
+}
+
+func (s *Simulator) PurgeRoutes(mac string) error {
+	return nil
+}
+
+// only packets are simulated, a client sends at most pps
+func (s *Simulator) SetLimit(node *voip.Node, limit voip.Limit) error {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.plants[node.Id()]
+	if !ok {
+		return voip.ErrIdNotExists
+	}
+
+	p.limit = float64(limit.Pps)
+	return nil
+}
+
+// only shares are modelled, the other resources are accepted as they are
+func (s *Simulator) SetResources(node *voip.Node, res voip.Resources) error {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.plants[node.Id()]
+	if !ok {
+		return voip.ErrIdNotExists
+	}
+
+	p.shares = res.Shares
+	log.Println("[INFO] set cpu limit for container", node.Id(), "to", res.Shares)
+	return nil
+}
+
+// sets the rate (packets per second) at which a client sends traffic
+func (s *Simulator) SetRate(client string, rate float64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.plants[client]
+	if !ok || p.kind != KIND_CLIENT {
+		return voip.ErrIdNotExists
+	}
+
+	p.rate = rate
+	return nil
+}
+
+// runs the simulation for duration d of virtual time, sending
+// data points to app after every interval
+func (s *Simulator) Run(app nfsmain.AppLine, d time.Duration) {
+	tick := time.Duration(s.tick) * time.Millisecond
+	interval := time.Duration(s.interval) * time.Millisecond
+
+	for elapsed := time.Duration(0); elapsed < d; elapsed += interval {
+		points := s.step(tick, interval)
+		if len(points) != 0 {
+			app.Update(points)
+		}
+	}
+}
+
+func (s *Simulator) Trace() []*TraceEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.trace
+}
+
+func (s *Simulator) start(host string, nf *voip.NF, shares int64) (*voip.Node, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.hosts[host] {
+		return nil, voip.ErrHostNotFound
+	}
+
+	s.count++
+	id := fmt.Sprintf("%s-%d", nf.Name, s.count)
+	ip := fmt.Sprintf("10.0.%d.%d", s.count/256, s.count%256)
+	mac := fmt.Sprintf("00:16:3e:00:%02x:%02x", s.count/256, s.count%256)
+	node := voip.NewNode(id, ip, mac, host)
+
+	s.plants[id] = &plant{
+		node:   node,
+		nf:     nf,
+		kind:   model(nf),
+		shares: shares,
+	}
+	log.Println("[INFO] started simulated container", id, "on host", host)
+	return node, nil
+}
+
+// advances the clock by one interval and returns data points for the interval
+func (s *Simulator) step(tick, interval time.Duration) models.Points {
+	s.Lock()
+	defer s.Unlock()
+
+	for t := time.Duration(0); t < interval; t += tick {
+		arrivals := make(map[string]float64)
+		for client, hops := range s.routes {
+			for hop, part := range hops {
+				arrivals[hop] += part * s.plants[client].sent()
+			}
+		}
+
+		for id, p := range s.plants {
+			p.advance(tick.Seconds(), arrivals[id], s.service_rate, s.queue_size)
+		}
+	}
+	s.clock = s.clock.Add(interval)
+
+	var buf bytes.Buffer
+	ts := s.clock.UnixNano()
+	for id, p := range s.plants {
+		fmt.Fprintf(&buf, "%s,container_name=%s value=%f %d\n", s.cpu_table, id, p.cpu, ts)
+		if p.kind != KIND_ROUTER {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%s,container_name=%s value=%f %d\n", p.nf.Tables[voip.RX_TABLE], id, p.rx, ts)
+		fmt.Fprintf(&buf, "%s,container_name=%s value=%f %d\n", p.nf.Tables[voip.TX_TABLE], id, p.tx, ts)
+		fmt.Fprintf(&buf, "%s,container_name=%s value=%f %d\n", p.nf.Tables[voip.QUEUE_TABLE], id, p.queue, ts)
+		fmt.Fprintf(&buf, "%s,container_name=%s value=%f %d\n", p.nf.Tables[voip.DROP_TABLE], id, p.drops, ts)
+		s.trace = append(s.trace, p.entry(s.clock))
+	}
+
+	points, err := models.ParsePointsWithPrecision(buf.Bytes(), s.clock, "n")
+	if err != nil {
+		log.Println("[WARN] unable to create simulated points:", err)
+		return nil
+	}
+
+	return points
+}
@@ -0,0 +1,150 @@
+package sim
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/mangalaman93/nfs/voip"
+)
+
+const testConfig = `
+[VOIP]
+unix_sock = /tmp/nfs-sim-test.sock
+db = cadvisor
+
+[VOIP.TOPO]
+h1 = localhost:2375
+h2 = localhost:2376
+
+[VOIP.CONTROL]
+step_length = 1000
+period_length = 5000
+reference = 2000
+alpha = 0.5
+controller = queue
+queue_high = 100
+queue_low = 10
+queue_step = 64
+cpu_table = cpu_usage_total
+rx_table = rx_packets
+tx_table = tx_packets
+queue_table = snort_queue_length
+`
+
+func setup(t *testing.T, extra string) (*Simulator, *voip.VoipLine) {
+	config, err := goconfig.LoadFromData([]byte(testConfig + extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSimulator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vl, err := voip.NewVoipLineWith(config, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, vl
+}
+
+func request(t *testing.T, vl *voip.VoipLine, code int, kv map[string]string) string {
+	resp := vl.HandleRequest(&voip.Request{Code: code, KeyVal: kv})
+	if resp.Err != "" {
+		t.Fatal("request failed:", resp.Err)
+	}
+
+	return resp.Result
+}
+
+func TestQueueControl(t *testing.T) {
+	s, vl := setup(t, "")
+
+	server := request(t, vl, voip.ReqStartServer, map[string]string{"shares": "1024"})
+	snort := request(t, vl, voip.ReqStartSnort, map[string]string{"shares": "256"})
+	client := request(t, vl, voip.ReqStartClient, map[string]string{
+		"shares": "1024", "server": server, "affinity": snort})
+	request(t, vl, voip.ReqRouteCont, map[string]string{
+		"client": client, "router": snort, "server": server})
+
+	// 3000 pps needs 768 shares at 4000 pps per core
+	s.SetRate(client, 3000)
+	s.Run(vl, 5*time.Minute)
+
+	// over the last minute, snort should keep up with the client
+	entries := make([]*TraceEntry, 0)
+	for _, e := range s.Trace() {
+		if e.Id == snort {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) < 60 {
+		t.Fatal("expected trace for at least 60 intervals, got", len(entries))
+	}
+	first, end := entries[len(entries)-60], entries[len(entries)-1]
+	if end.Shares <= 256 {
+		t.Errorf("expected more than 256 shares, got %d", end.Shares)
+	}
+	if tx, rx := end.Tx-first.Tx, end.Rx-first.Rx; tx < 0.95*rx {
+		t.Errorf("expected throughput close to %f, got %f", rx, tx)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteTrace(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(buf.Bytes(), []byte("\n")) != len(s.Trace())+1 {
+		t.Error("expected one line per trace entry and a header")
+	}
+}
+
+func TestScaleOut(t *testing.T) {
+	s, vl := setup(t, `
+[VOIP.SCALE]
+enable = true
+max_replicas = 2
+out_periods = 2
+
+[SIM]
+queue_size = 1000000
+`)
+
+	server := request(t, vl, voip.ReqStartServer, map[string]string{"shares": "1024"})
+	snort := request(t, vl, voip.ReqStartSnort, map[string]string{"shares": "1024"})
+	for i := 0; i < 2; i++ {
+		client := request(t, vl, voip.ReqStartClient, map[string]string{
+			"shares": "1024", "server": server})
+		request(t, vl, voip.ReqRouteCont, map[string]string{
+			"client": client, "router": snort, "server": server})
+		s.SetRate(client, 3000)
+	}
+
+	s.Run(vl, 5*time.Minute)
+
+	snorts := make(map[string]bool)
+	for _, e := range s.Trace() {
+		snorts[e.Id] = true
+	}
+	if len(snorts) != 2 {
+		t.Fatalf("expected a snort replica added, got %d snorts", len(snorts))
+	}
+
+	// each replica gets the traffic of one client
+	var prev, cur *TraceEntry
+	for _, e := range s.Trace() {
+		if e.Id == snort {
+			prev, cur = cur, e
+		}
+	}
+	if prev == nil {
+		t.Fatalf("expected trace of %s", snort)
+	}
+	rate := (cur.Rx - prev.Rx) / cur.Time.Sub(prev.Time).Seconds()
+	if math.Abs(rate-3000) > 150 {
+		t.Errorf("expected 3000 pps at %s after scale out, got %f", snort, rate)
+	}
+}
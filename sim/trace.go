@@ -0,0 +1,46 @@
+package sim
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// state of a snort at the end of an interval
+type TraceEntry struct {
+	Time   time.Time
+	Id     string
+	Shares int64
+	Queue  float64
+	Rx     float64
+	Tx     float64
+	Drops  float64
+}
+
+// writes the trace in csv format, one row per snort per interval
+func (s *Simulator) WriteTrace(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"time", "id", "shares", "queue", "rx", "tx", "drops"})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range s.Trace() {
+		err = cw.Write([]string{
+			strconv.FormatInt(e.Time.UnixNano(), 10),
+			e.Id,
+			strconv.FormatInt(e.Shares, 10),
+			strconv.FormatFloat(e.Queue, 'f', 0, 64),
+			strconv.FormatFloat(e.Rx, 'f', 0, 64),
+			strconv.FormatFloat(e.Tx, 'f', 0, 64),
+			strconv.FormatFloat(e.Drops, 'f', 0, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,275 @@
+package voip
+
+import (
+	"log"
+	"sort"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	DEF_MAX_REPLICAS   = 4
+	DEF_OUT_PERIODS    = 3
+	DEF_IN_PERIODS     = 6
+	DEF_IN_SHARES      = 256
+	DEF_REPLICA_SHARES = 512
+)
+
+// replicas of a snort sharing the clients routed through the pool
+type pool struct {
+	id      string
+	members []string
+}
+
+// state of a container as last seen by the scaler
+type scaleState struct {
+	periods int64
+	pqueue  int64
+	sat     int
+	idle    int
+}
+
+// Scaler adds snort replicas when a snort stays saturated (shares at
+// MAX_SHARES and queue not draining) and removes them when all of them are idle
+type Scaler struct {
+	enabled        bool
+	max_replicas   int
+	out_periods    int
+	in_periods     int
+	in_shares      int64
+	replica_shares int64
+	states         map[string]*scaleState
+}
+
+func NewScaler(config *goconfig.ConfigFile) (*Scaler, error) {
+	s := &Scaler{states: make(map[string]*scaleState)}
+	if sec, _ := config.GetSection("VOIP.SCALE"); sec == nil {
+		return s, nil
+	}
+
+	var err error
+	s.enabled, err = config.Bool("VOIP.SCALE", "enable")
+	if err != nil {
+		return nil, err
+	}
+	s.max_replicas = config.MustInt("VOIP.SCALE", "max_replicas", DEF_MAX_REPLICAS)
+	s.out_periods = config.MustInt("VOIP.SCALE", "out_periods", DEF_OUT_PERIODS)
+	s.in_periods = config.MustInt("VOIP.SCALE", "in_periods", DEF_IN_PERIODS)
+	s.in_shares = config.MustInt64("VOIP.SCALE", "in_shares", DEF_IN_SHARES)
+	s.replica_shares = config.MustInt64("VOIP.SCALE", "replica_shares", DEF_REPLICA_SHARES)
+	return s, nil
+}
+
+// looks at the container after each control period
+func (s *Scaler) observe(mcont *MContainer) *scaleState {
+	st, ok := s.states[mcont.node.id]
+	if !ok {
+		st = &scaleState{}
+		s.states[mcont.node.id] = st
+	}
+	if st.periods == mcont.periods {
+		return st
+	}
+
+	// a full queue doesn't grow anymore, it drops packets instead
+	if mcont.node.res.Shares >= MAX_SHARES && mcont.pqueue > 0 && mcont.pqueue >= st.pqueue {
+		st.sat++
+	} else {
+		st.sat = 0
+	}
+	if mcont.node.res.Shares <= s.in_shares && mcont.pqueue <= 0 {
+		st.idle++
+	} else {
+		st.idle = 0
+	}
+
+	st.periods = mcont.periods
+	st.pqueue = mcont.pqueue
+	return st
+}
+
+func (s *Scaler) forget(id string) {
+	delete(s.states, id)
+}
+
+func (vh *VoipHandler) autoscale() {
+	if !vh.scaler.enabled {
+		return
+	}
+
+	ids := make([]string, 0, len(vh.pools))
+	for id := range vh.pools {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		p := vh.pools[id]
+		sat, idle := 0, 0
+		for _, member := range p.members {
+			st := vh.scaler.observe(vh.mnodes[member])
+			if st.sat >= vh.scaler.out_periods {
+				sat++
+			}
+			if st.idle >= vh.scaler.in_periods {
+				idle++
+			}
+		}
+
+		switch {
+		case sat > 0 && len(p.members) < vh.scaler.max_replicas &&
+			(len(vh.balancedChains(p)) > 0 || len(vh.poolHops(p)) > len(p.members)):
+			vh.scaleOut(p)
+		case idle == len(p.members) && len(p.members) > 1:
+			vh.scaleIn(p)
+		}
+	}
+}
+
+func (vh *VoipHandler) scaleOut(p *pool) {
+	root := vh.mnodes[p.members[0]].node
+	shares := vh.scaler.replica_shares
+	host, err := vh.sched.Place(shares, root.host)
+	if err != nil {
+		log.Println("[WARN] unable to find host for", root.role, "replica:", err)
+		return
+	}
+
+	// replicas are of the same kind as the root of the pool
+	ctrl, err := vh.ctrl.NewController(root.role, "")
+	if err != nil {
+		log.Println("[WARN] unable to create controller for", root.role, "replica:", err)
+		return
+	}
+
+	// and get the same resources besides shares
+	res := root.res
+	res.Shares = shares
+	node, err := vh.cmgr.StartNF(root.role, host, res, map[string]string{})
+	if err != nil {
+		log.Println("[WARN] unable to start", root.role, "replica:", err)
+		return
+	}
+
+	node.role = root.role
+	node.res = res
+	vh.addMCont(node, ctrl)
+	vh.mnodes[node.id].pool = p.id
+	p.members = append(p.members, node.id)
+	log.Println("[INFO] scaled out pool", p.id, "to", len(p.members), "replicas")
+	vh.rebalance(p)
+	vh.saveState()
+}
+
+func (vh *VoipHandler) scaleIn(p *pool) {
+	id := p.members[len(p.members)-1]
+	p.members = p.members[:len(p.members)-1]
+	vh.rebalance(p)
+
+	mcont := vh.mnodes[id]
+	vh.cmgr.StopCont(mcont.node)
+	vh.sched.DelNode(mcont.node)
+	vh.delMCont(mcont)
+	log.Println("[INFO] scaled in pool", p.id, "to", len(p.members), "replicas")
+	vh.saveState()
+}
+
+// hop i of chain c is a member of a pool
+type poolHop struct {
+	c *chain
+	i int
+}
+
+// hops of the chains going through any member of the pool,
+// balanced chains go through all of them instead
+func (vh *VoipHandler) poolHops(p *pool) []*poolHop {
+	hops := make([]*poolHop, 0)
+	for _, c := range vh.sortedChains() {
+		if c.balanced {
+			continue
+		}
+		for i, hop := range c.hops {
+			if mcont, ok := vh.mnodes[hop.id]; ok && mcont.pool == p.id {
+				hops = append(hops, &poolHop{c: c, i: i})
+			}
+		}
+	}
+	return hops
+}
+
+// balanced chains with any member of the pool as a hop
+func (vh *VoipHandler) balancedChains(p *pool) []*chain {
+	chains := make([]*chain, 0)
+	for _, c := range vh.sortedChains() {
+		if !c.balanced {
+			continue
+		}
+		for _, hop := range c.hops {
+			if vh.poolOf(hop) == p {
+				chains = append(chains, c)
+				break
+			}
+		}
+	}
+	return chains
+}
+
+// nil if the node is not a member of a pool
+func (vh *VoipHandler) poolOf(node *Node) *pool {
+	if mcont, ok := vh.mnodes[node.id]; ok && mcont.pool != "" {
+		return vh.pools[mcont.pool]
+	}
+	return nil
+}
+
+// the current members of the pool replace its old members in the hops
+func (vh *VoipHandler) poolReplicas(hops []*Node, p *pool) []*Node {
+	replicas := make([]*Node, 0, len(hops)+len(p.members))
+	for _, hop := range hops {
+		if vh.poolOf(hop) != p {
+			replicas = append(replicas, hop)
+		}
+	}
+	for _, member := range p.members {
+		replicas = append(replicas, vh.mnodes[member].node)
+	}
+	return replicas
+}
+
+// hops in a pool bring in all the members of the pool
+func (vh *VoipHandler) withPools(hops []*Node) []*Node {
+	replicas := hops
+	for _, hop := range hops {
+		if p := vh.poolOf(hop); p != nil {
+			replicas = vh.poolReplicas(replicas, p)
+		}
+	}
+	return replicas
+}
+
+// balanced chains go through all the members of the pool, the
+// hops of other chains are spread across the members round robin
+func (vh *VoipHandler) rebalance(p *pool) {
+	if len(p.members) == 0 {
+		return
+	}
+
+	for _, c := range vh.balancedChains(p) {
+		if err := vh.reroute(c, c.withHops(vh.poolReplicas(c.hops, p))); err != nil {
+			log.Println("[WARN] unable to balance chain", c.id, "across pool", p.id, err)
+		}
+	}
+
+	for i, ph := range vh.poolHops(p) {
+		rnode := vh.mnodes[p.members[i%len(p.members)]].node
+		if rnode == ph.c.hops[ph.i] {
+			continue
+		}
+
+		hops := append([]*Node{}, ph.c.hops...)
+		hops[ph.i] = rnode
+		if err := vh.reroute(ph.c, ph.c.withHops(hops)); err != nil {
+			log.Println("[WARN] unable to move chain", ph.c.id, "to", rnode.id, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package voip
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Unknwon/goconfig"
+)
+
+func testScaler(t *testing.T, extra string) *Scaler {
+	config, err := goconfig.LoadFromData([]byte("[VOIP.SCALE]\nenable=true\n" + extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScaler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScalerSaturation(t *testing.T) {
+	s := testScaler(t, "")
+	node := NewNode("snort-1", "10.10.0.4", "00:16:3e:00:00:04", "h1")
+	node.res.Shares = MAX_SHARES
+	mcont := &MContainer{node: node}
+
+	// the queue fills up and then stays full, dropping packets
+	for i, pqueue := range []int64{200, 500, 500, 500} {
+		mcont.periods++
+		mcont.pqueue = pqueue
+		if st := s.observe(mcont); st.sat != i+1 {
+			t.Fatalf("expected %d saturated periods with queue %d, got %d", i+1, pqueue, st.sat)
+		}
+	}
+
+	// a draining or an empty queue is not saturated
+	for _, pqueue := range []int64{300, 0, 0} {
+		mcont.periods++
+		mcont.pqueue = pqueue
+		if st := s.observe(mcont); st.sat != 0 {
+			t.Errorf("expected no saturation with queue %d, got %d periods", pqueue, st.sat)
+		}
+	}
+
+	// nor is a full queue below max shares
+	node.res.Shares = MAX_SHARES / 2
+	mcont.periods++
+	mcont.pqueue = 500
+	if st := s.observe(mcont); st.sat != 0 {
+		t.Errorf("expected no saturation below max shares, got %d periods", st.sat)
+	}
+}
+
+const scaleConfig = `
+[VOIP.SCALE]
+enable=true
+max_replicas=2
+out_periods=2
+in_periods=2
+in_shares=256
+`
+
+// a control period of the container ends with the given shares and queue
+func endPeriod(vh *VoipHandler, id string, shares, pqueue int64) {
+	mcont := vh.mnodes[id]
+	mcont.node.res.Shares = shares
+	mcont.periods++
+	mcont.pqueue = pqueue
+}
+
+// the hops of the routes of the clients
+func routedHops(cmgr *fakeCManager, clients []string) string {
+	hops := make([]string, 0, len(clients))
+	for _, client := range clients {
+		route := cmgr.routes[client]
+		hops = append(hops, hopIds(route[1:len(route)-1]))
+	}
+	return strings.Join(hops, " ")
+}
+
+func TestAutoscale(t *testing.T) {
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, scaleConfig, cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	clients := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+		request(t, vh, ReqRouteCont, map[string]string{"client": client, "hops": nf1, "server": server})
+		clients = append(clients, client)
+	}
+	p := vh.pools[nf1]
+
+	// one saturated period is not enough
+	endPeriod(vh, nf1, MAX_SHARES, 500)
+	vh.autoscale()
+	if len(p.members) != 1 {
+		t.Fatalf("expected no replica yet, got %v", p.members)
+	}
+	endPeriod(vh, nf1, MAX_SHARES, 500)
+	vh.autoscale()
+	if len(p.members) != 2 {
+		t.Fatalf("expected a replica after %d saturated periods, got %v", vh.scaler.out_periods, p.members)
+	}
+	nf2 := p.members[1]
+	if vh.mnodes[nf2].pool != nf1 || vh.mnodes[nf2].node.res.Shares != DEF_REPLICA_SHARES {
+		t.Errorf("unexpected replica %+v", vh.mnodes[nf2].node)
+	}
+
+	// the clients are spread round robin across the replicas
+	if got := routedHops(cmgr, clients); got != strings.Join([]string{nf1, nf2, nf1}, " ") {
+		t.Errorf("expected clients spread across %s and %s, got %s", nf1, nf2, got)
+	}
+
+	// no more than max_replicas
+	for i := 0; i < 3; i++ {
+		endPeriod(vh, nf1, MAX_SHARES, 500)
+		endPeriod(vh, nf2, MAX_SHARES, 500)
+		vh.autoscale()
+	}
+	if len(p.members) != 2 || len(cmgr.conts) != 6 {
+		t.Fatalf("expected %d replicas at most, got %v", vh.scaler.max_replicas, p.members)
+	}
+
+	// an idle replica is kept while another one is busy
+	for i := 0; i < 2; i++ {
+		endPeriod(vh, nf1, MAX_SHARES, 500)
+		endPeriod(vh, nf2, 128, 0)
+		vh.autoscale()
+	}
+	if len(p.members) != 2 {
+		t.Fatalf("expected both replicas kept, got %v", p.members)
+	}
+
+	// and removed once all of them are idle
+	for i := 0; i < 2; i++ {
+		endPeriod(vh, nf1, 256, 0)
+		endPeriod(vh, nf2, 128, 0)
+		vh.autoscale()
+	}
+	if len(p.members) != 1 || p.members[0] != nf1 {
+		t.Fatalf("expected scaled in to %s, got %v", nf1, p.members)
+	}
+	if _, ok := cmgr.conts[nf2]; ok || vh.mnodes[nf2] != nil {
+		t.Errorf("expected %s stopped", nf2)
+	}
+	if got := routedHops(cmgr, clients); got != strings.Join([]string{nf1, nf1, nf1}, " ") {
+		t.Errorf("expected all clients through %s, got %s", nf1, got)
+	}
+}
+
+func TestStopPoolMember(t *testing.T) {
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, scaleConfig, cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	c1 := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	c2 := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	c3 := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	request(t, vh, ReqRouteCont, map[string]string{"client": c1, "hops": nf1, "server": server})
+	request(t, vh, ReqRouteCont, map[string]string{"client": c2, "hops": nf1, "server": server})
+	request(t, vh, ReqRouteCont, map[string]string{"client": c3, "router": nf1, "server": server, "balanced": "true"})
+
+	p := vh.pools[nf1]
+	vh.scaleOut(p)
+	nf2 := p.members[1]
+	if got := routedHops(cmgr, []string{c1, c2, c3}); got != strings.Join([]string{nf1, nf2, nf1 + "," + nf2}, " ") {
+		t.Fatalf("unexpected routes after scale out %s", got)
+	}
+
+	// the root of the pool goes, its clients move to the replica
+	mac := vh.mnodes[nf1].node.mac
+	request(t, vh, ReqStopCont, map[string]string{"cont": nf1})
+	if len(p.members) != 1 || p.members[0] != nf2 || vh.pools[nf1] != p {
+		t.Fatalf("expected %s left in the pool, got %v", nf2, p.members)
+	}
+	for client, route := range cmgr.routes {
+		for _, node := range route {
+			if node.id == nf1 {
+				t.Errorf("route of %s still through stopped %s", client, nf1)
+			}
+		}
+	}
+	for cmac, flows := range cmgr.flows {
+		if strings.Contains(strings.Join(flows, " "), mac) {
+			t.Errorf("flows of %s still to stopped %s: %v", cmac, nf1, flows)
+		}
+	}
+	if got := routedHops(cmgr, []string{c1, c2, c3}); got != strings.Join([]string{nf2, nf2, nf2}, " ") {
+		t.Errorf("expected all clients through %s, got %s", nf2, got)
+	}
+}
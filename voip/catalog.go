@@ -0,0 +1,271 @@
+package voip
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	NF_SECTION    = "NF."
+	MON_SIPP      = "sipp"
+	MON_NFQUEUE   = "nfqueue"
+	MON_PCAP      = "pcap"
+	LABEL_KIND    = "nfs.kind"
+	LABEL_MONITOR = "nfs.monitor"
+)
+
+var (
+	ErrUnknownNF = errors.New("Invalid network function kind")
+	ErrNoImage   = errors.New("network function needs an image")
+)
+
+// config keys of the tables in VOIP.CONTROL and NF sections,
+// drops are only of NFs and named after them by default
+var tableKeys = map[int]string{
+	RX_TABLE:    "rx_table",
+	TX_TABLE:    "tx_table",
+	CPU_TABLE:   "cpu_table",
+	QUEUE_TABLE: "queue_table",
+	DROP_TABLE:  "drop_table",
+}
+
+// NF is a kind of container in the catalogue. Env and Cmd may
+// refer to the params given when starting the NF as ${name}.
+type NF struct {
+	Kind   string
+	Name   string // prefix of the container names
+	Image  string
+	Env    map[string]string
+	Cmd    string
+	CapAdd []string
+	// params which are ids of containers, the NF gets their ip
+	Links []string
+	// routers are the hops of chains and are controlled,
+	// the other NFs are clients and servers of chains
+	Router bool
+	// how moncont collects the metrics of the NF: sipp, nfqueue for inline
+	// NFs or pcap for NFs which sniff the traffic the kernel forwards
+	Monitor string
+	// measurements which feed control, by RX_TABLE, TX_TABLE...
+	Tables map[int]string
+}
+
+// Catalog is the NFs by kind, there is always a server, a client and
+// the IDSs snort, suricata, bro and ndpi. moncont names the queue and
+// drop measurements of an NF after its kind, e.g. suricata_queue_length.
+type Catalog map[string]*NF
+
+// reads [NF.<kind>] sections on top of the built in NFs, tables
+// default to those of VOIP.CONTROL:
+//
+//	[NF.suricata]
+//	image=mangalaman93/suricata
+//	cap_add=NET_ADMIN
+//	router=true
+//	monitor=nfqueue
+//	env.ARGS=-q 0
+func NewCatalog(config *goconfig.ConfigFile) (Catalog, error) {
+	tables := make(map[int]string)
+	for table, key := range tableKeys {
+		if table == DROP_TABLE {
+			continue
+		}
+		name, err := config.GetValue("VOIP.CONTROL", key)
+		if err != nil {
+			return nil, err
+		}
+		tables[table] = name
+	}
+
+	c := Catalog{
+		ROLE_SERVER: {
+			Kind:    ROLE_SERVER,
+			Name:    "sipp-server",
+			Image:   IMG_SIPP,
+			Env:     map[string]string{"ARGS": "-buff_size " + SIPP_BUFF_SIZE + " -sn uas"},
+			Monitor: MON_SIPP,
+		},
+		ROLE_CLIENT: {
+			Kind:    ROLE_CLIENT,
+			Name:    "sipp-client",
+			Image:   IMG_SIPP,
+			Env:     map[string]string{"ARGS": "-buff_size " + SIPP_BUFF_SIZE + " -sn uac -r 0 ${server}:5060"},
+			Links:   []string{"server"},
+			Monitor: MON_SIPP,
+		},
+		ROLE_SNORT: {
+			Kind:    ROLE_SNORT,
+			Name:    "snort",
+			Image:   IMG_SNORT,
+			Env:     map[string]string{},
+			CapAdd:  []string{"NET_ADMIN"},
+			Router:  true,
+			Monitor: MON_NFQUEUE,
+		},
+		ROLE_SURICATA: {
+			Kind:    ROLE_SURICATA,
+			Name:    "suricata",
+			Image:   IMG_SURICATA,
+			Env:     map[string]string{},
+			CapAdd:  []string{"NET_ADMIN"},
+			Router:  true,
+			Monitor: MON_NFQUEUE,
+		},
+		ROLE_BRO: {
+			Kind:    ROLE_BRO,
+			Name:    "bro",
+			Image:   IMG_BRO,
+			Env:     map[string]string{},
+			CapAdd:  []string{"NET_ADMIN", "NET_RAW"},
+			Router:  true,
+			Monitor: MON_PCAP,
+		},
+		ROLE_NDPI: {
+			Kind:    ROLE_NDPI,
+			Name:    "ndpi",
+			Image:   IMG_NDPI,
+			Env:     map[string]string{},
+			CapAdd:  []string{"NET_ADMIN", "NET_RAW"},
+			Router:  true,
+			Monitor: MON_PCAP,
+		},
+	}
+	for _, nf := range c {
+		nf.Tables = nfTables(nf.Kind, tables)
+	}
+	// the queue of snort is the one of VOIP.CONTROL
+	c[ROLE_SNORT].Tables[QUEUE_TABLE] = tables[QUEUE_TABLE]
+
+	for _, section := range config.GetSectionList() {
+		if !strings.HasPrefix(section, NF_SECTION) {
+			continue
+		}
+
+		kind := strings.TrimPrefix(section, NF_SECTION)
+		nf, ok := c[kind]
+		if !ok {
+			nf = &NF{
+				Kind:   kind,
+				Name:   kind,
+				Env:    make(map[string]string),
+				Tables: nfTables(kind, tables),
+			}
+			c[kind] = nf
+		}
+
+		nf.Name = config.MustValue(section, "name", nf.Name)
+		nf.Image = config.MustValue(section, "image", nf.Image)
+		nf.Cmd = config.MustValue(section, "cmd", nf.Cmd)
+		nf.CapAdd = splitList(config.MustValue(section, "cap_add", strings.Join(nf.CapAdd, ",")))
+		nf.Links = splitList(config.MustValue(section, "links", strings.Join(nf.Links, ",")))
+		nf.Router = config.MustBool(section, "router", nf.Router)
+		nf.Monitor = config.MustValue(section, "monitor", nf.Monitor)
+		for table, key := range tableKeys {
+			nf.Tables[table] = config.MustValue(section, key, nf.Tables[table])
+		}
+		for _, key := range config.GetKeyList(section) {
+			if strings.HasPrefix(key, "env.") {
+				nf.Env[strings.TrimPrefix(key, "env.")] = config.MustValue(section, key)
+			}
+		}
+
+		if nf.Image == "" {
+			return nil, ErrNoImage
+		}
+	}
+
+	return c, nil
+}
+
+func (c Catalog) Get(kind string) (*NF, error) {
+	nf, ok := c[kind]
+	if !ok {
+		return nil, ErrUnknownNF
+	}
+	return nf, nil
+}
+
+func (c Catalog) router(kind string) bool {
+	nf, ok := c[kind]
+	return ok && nf.Router
+}
+
+// table of the measurement for NFs of the kind
+func (c Catalog) table(kind, measurement string) (int, bool) {
+	if nf, ok := c[kind]; ok {
+		for table, name := range nf.Tables {
+			if name == measurement {
+				return table, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// env and cmd of the NF with the params, ErrKeyNotFound if one is missing
+func (nf *NF) expand(params map[string]string) (map[string]string, []string, error) {
+	missing := false
+	mapping := func(name string) string {
+		value, ok := params[name]
+		missing = missing || !ok
+		return value
+	}
+
+	env := make(map[string]string)
+	for key, value := range nf.Env {
+		env[key] = os.Expand(value, mapping)
+	}
+	var cmd []string
+	if nf.Cmd != "" {
+		cmd = strings.Fields(os.Expand(nf.Cmd, mapping))
+	}
+	if missing {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	return env, cmd, nil
+}
+
+// moncont finds the NFs to monitor by these labels
+func (nf *NF) labels() map[string]string {
+	return map[string]string{
+		LABEL_KIND:    nf.Kind,
+		LABEL_MONITOR: nf.Monitor,
+	}
+}
+
+// KEY=value sorted by key
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for key, value := range env {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// tables of VOIP.CONTROL, with the queue and drops of the kind
+// of NF as moncont writes them. Only routers have these.
+func nfTables(kind string, tables map[int]string) map[int]string {
+	c := make(map[int]string, len(tableKeys))
+	for table, name := range tables {
+		c[table] = name
+	}
+	c[QUEUE_TABLE] = kind + "_queue_length"
+	c[DROP_TABLE] = kind + "_queue_drops"
+	return c
+}
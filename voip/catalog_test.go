@@ -0,0 +1,92 @@
+package voip
+
+import (
+	"testing"
+
+	"github.com/Unknwon/goconfig"
+)
+
+func TestCatalog(t *testing.T) {
+	config, err := goconfig.LoadFromData([]byte(testConfig + `
+[NF.suricata]
+image=mangalaman93/suricata
+cap_add=NET_ADMIN
+router=true
+queue_table=suricata_queue_length
+env.ARGS=-q ${queue}
+
+[NF.snort]
+image=mangalaman93/snort3
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCatalog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snort, _ := c.Get(ROLE_SNORT); snort.Image != "mangalaman93/snort3" || !snort.Router ||
+		len(snort.CapAdd) != 1 || snort.Tables[QUEUE_TABLE] != "snort_queue_length" {
+		t.Errorf("expected snort with new image only, got %+v", snort)
+	}
+	if _, err := c.Get("squid"); err != ErrUnknownNF {
+		t.Errorf("expected %v, got %v", ErrUnknownNF, err)
+	}
+	if table, ok := c.table("suricata", "suricata_queue_length"); !ok || table != QUEUE_TABLE {
+		t.Errorf("expected queue table of suricata, got %d %v", table, ok)
+	}
+	if _, ok := c.table("snort", "suricata_queue_length"); ok {
+		t.Error("expected no suricata table for snort")
+	}
+	if bro, _ := c.Get(ROLE_BRO); !bro.Router || bro.Monitor != MON_PCAP ||
+		bro.Tables[QUEUE_TABLE] != "bro_queue_length" || bro.Tables[DROP_TABLE] != "bro_queue_drops" {
+		t.Errorf("expected bro with its own tables, got %+v", bro)
+	}
+
+	suricata, _ := c.Get("suricata")
+	if _, _, err := suricata.expand(map[string]string{}); err != ErrKeyNotFound {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	env, cmd, err := suricata.expand(map[string]string{"queue": "1"})
+	if err != nil || env["ARGS"] != "-q 1" || cmd != nil {
+		t.Errorf("unexpected env %v cmd %v %v", env, cmd, err)
+	}
+
+	// an NF of the catalogue is a hop of chains if it is a router
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, `
+[NF.suricata]
+image=mangalaman93/suricata
+router=true
+[NF.ndpi]
+image=mangalaman93/ndpi
+cmd=ndpiReader -i eth0
+router=false
+links=peer
+`, cmgr)
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	if cmgr.params[client]["server"] != vh.anodes[server].ip {
+		t.Errorf("expected ip of server as param, got %v", cmgr.params[client])
+	}
+	nf := request(t, vh, ReqStartNF, map[string]string{"kind": "suricata", "shares": "256"})
+	if mcont, ok := vh.mnodes[nf]; !ok || mcont.node.role != "suricata" || vh.pools[nf] == nil {
+		t.Fatalf("expected controlled suricata %s, got %v", nf, vh.mnodes)
+	}
+	request(t, vh, ReqRouteCont, map[string]string{"client": client, "hops": nf, "server": server})
+
+	resp := vh.HandleRequest(&Request{Code: ReqStartNF, KeyVal: map[string]string{"kind": "ndpi", "shares": "64"}})
+	if resp.Err != ErrKeyNotFound.Error() {
+		t.Errorf("expected %v without link, got %q", ErrKeyNotFound, resp.Err)
+	}
+	ndpi := request(t, vh, ReqStartNF, map[string]string{"kind": "ndpi", "shares": "64", "peer": server})
+	if _, ok := vh.anodes[ndpi]; !ok {
+		t.Errorf("expected ndpi %s as end point", ndpi)
+	}
+	resp = vh.HandleRequest(&Request{Code: ReqRouteCont, KeyVal: map[string]string{
+		"client": client, "hops": ndpi, "server": server}})
+	if resp.Err != ErrNotHop.Error() {
+		t.Errorf("expected %v for ndpi hop, got %q", ErrNotHop, resp.Err)
+	}
+}
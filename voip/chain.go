@@ -0,0 +1,416 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/satori/go.uuid"
+)
+
+var (
+	ErrNotHop            = errors.New("container can't be a hop of a chain")
+	ErrHopIndex          = errors.New("hop index out of range")
+	ErrDuplicateHop      = errors.New("container is a hop of the chain already")
+	ErrBalancedSymmetric = errors.New("balanced chain can't be symmetric")
+)
+
+// client is routed through the hops (network functions) in order to
+// server, the replies of the server as well if the chain is symmetric.
+// The traffic of a balanced chain is spread across its hops instead,
+// weighted by their shares.
+type chain struct {
+	id        string
+	cnode     *Node
+	hops      []*Node
+	snode     *Node
+	symmetric bool
+	balanced  bool
+}
+
+// ChainInfo is a chain as seen by the voip handler
+type ChainInfo struct {
+	Id        string   `json:"id"`
+	Client    string   `json:"client"`
+	Hops      []string `json:"hops"`
+	Server    string   `json:"server"`
+	Symmetric bool     `json:"symmetric"`
+	Balanced  bool     `json:"balanced"`
+}
+
+// client first, then the hops and the server last
+func (c *chain) nodes() []*Node {
+	return chainNodes(c.cnode, c.hops, c.snode)
+}
+
+func (c *chain) has(node *Node) bool {
+	for _, n := range c.nodes() {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// copy of the chain with other hops
+func (c *chain) withHops(hops []*Node) *chain {
+	next := *c
+	next.hops = hops
+	return &next
+}
+
+func (c *chain) info() *ChainInfo {
+	info := &ChainInfo{
+		Id:        c.id,
+		Client:    c.cnode.id,
+		Hops:      make([]string, 0, len(c.hops)),
+		Server:    c.snode.id,
+		Symmetric: c.symmetric,
+		Balanced:  c.balanced,
+	}
+	for _, hop := range c.hops {
+		info.Hops = append(info.Hops, hop.id)
+	}
+	return info
+}
+
+func chainNodes(cnode *Node, hops []*Node, snode *Node) []*Node {
+	nodes := make([]*Node, 0, len(hops)+2)
+	nodes = append(nodes, cnode)
+	nodes = append(nodes, hops...)
+	return append(nodes, snode)
+}
+
+func chainString(chain []*Node) string {
+	ips := make([]string, 0, len(chain))
+	for _, node := range chain {
+		ips = append(ips, node.ip)
+	}
+	return strings.Join(ips, " -> ")
+}
+
+// client and server are required, then either a router or
+// hops, a comma separated list of network functions in order.
+// symmetric is optional and steers the replies through the hops.
+// balanced is optional and spreads the traffic across the hops
+// instead, a hop in a pool brings in all the replicas of the pool.
+// A client has one chain, routing it again replaces the hops.
+func (vh *VoipHandler) route(req *Request) *Response {
+	kv := req.KeyVal
+	client, ok1 := kv["client"]
+	server, ok2 := kv["server"]
+	hopids, ok3 := kv["hops"]
+	if router, ok := kv["router"]; ok {
+		hopids, ok3 = router, true
+	}
+	if !ok1 || !ok2 || !ok3 || hopids == "" {
+		return errResponse(ErrKeyNotFound)
+	}
+
+	cnode, ok1 := vh.anodes[client]
+	snode, ok2 := vh.anodes[server]
+	if !ok1 || !ok2 {
+		return errResponse(ErrIdNotExists)
+	}
+	symmetric, err := boolKey(kv, "symmetric")
+	if err != nil {
+		return errResponse(err)
+	}
+	balanced, err := boolKey(kv, "balanced")
+	if err != nil {
+		return errResponse(err)
+	}
+	if symmetric && balanced {
+		return errResponse(ErrBalancedSymmetric)
+	}
+	hops := make([]*Node, 0)
+	for _, id := range strings.Split(hopids, ",") {
+		hop, err := vh.hop(strings.TrimSpace(id))
+		if err != nil {
+			return errResponse(err)
+		}
+		if hasHop(hops, hop.id) {
+			return errResponse(ErrDuplicateHop)
+		}
+		hops = append(hops, hop)
+	}
+	if balanced {
+		hops = vh.withPools(hops)
+	}
+
+	next := &chain{
+		id:        fmt.Sprintf("chain-%s", uuid.NewV1()),
+		cnode:     cnode,
+		hops:      hops,
+		snode:     snode,
+		symmetric: symmetric,
+		balanced:  balanced,
+	}
+	if c := vh.clientChain(cnode); c != nil {
+		next.id = c.id
+		if err := vh.reroute(c, next); err != nil {
+			return errResponse(err)
+		}
+		return &Response{Result: c.id}
+	}
+
+	if err := vh.install(next); err != nil {
+		return errResponse(err)
+	}
+	vh.chains[next.id] = next
+	return &Response{Result: next.id}
+}
+
+// false if the key is missing or empty
+func boolKey(kv map[string]string, key string) (bool, error) {
+	if sval, ok := kv[key]; ok && sval != "" {
+		return strconv.ParseBool(sval)
+	}
+	return false, nil
+}
+
+// index is optional, the hop is appended by default.
+// Hops of balanced chains are replicas, their order doesn't matter.
+func (vh *VoipHandler) insertHop(req *Request) *Response {
+	kv := req.KeyVal
+	chainid, ok1 := kv["chain"]
+	hopid, ok2 := kv["hop"]
+	if !ok1 || !ok2 {
+		return errResponse(ErrKeyNotFound)
+	}
+
+	c, ok := vh.chains[chainid]
+	if !ok {
+		return errResponse(ErrIdNotExists)
+	}
+	hop, err := vh.hop(hopid)
+	if err != nil {
+		return errResponse(err)
+	}
+	if hasHop(c.hops, hop.id) {
+		return errResponse(ErrDuplicateHop)
+	}
+	index := len(c.hops)
+	if sindex, ok := kv["index"]; ok && sindex != "" {
+		i, err := strconv.Atoi(sindex)
+		if err != nil {
+			return errResponse(err)
+		}
+		if i < 0 || i > len(c.hops) {
+			return errResponse(ErrHopIndex)
+		}
+		index = i
+	}
+
+	hops := make([]*Node, 0, len(c.hops)+1)
+	hops = append(hops, c.hops[:index]...)
+	hops = append(hops, hop)
+	hops = append(hops, c.hops[index:]...)
+	if err := vh.reroute(c, c.withHops(hops)); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+func (vh *VoipHandler) removeHop(req *Request) *Response {
+	kv := req.KeyVal
+	chainid, ok1 := kv["chain"]
+	hopid, ok2 := kv["hop"]
+	if !ok1 || !ok2 {
+		return errResponse(ErrKeyNotFound)
+	}
+
+	c, ok := vh.chains[chainid]
+	if !ok {
+		return errResponse(ErrIdNotExists)
+	}
+	hops := withoutHop(c.hops, hopid)
+	if len(hops) == len(c.hops) {
+		return errResponse(ErrIdNotExists)
+	}
+
+	if err := vh.reroute(c, c.withHops(hops)); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+func (vh *VoipHandler) delChain(req *Request) *Response {
+	chainid, ok := req.KeyVal["chain"]
+	if !ok {
+		return errResponse(ErrKeyNotFound)
+	}
+
+	c, ok := vh.chains[chainid]
+	if !ok {
+		return errResponse(ErrIdNotExists)
+	}
+	vh.removeChain(c)
+	return &Response{}
+}
+
+// chain, if given, selects one chain and cont, if
+// given, the chains going through the container
+func (vh *VoipHandler) listChains(req *Request) *Response {
+	if chainid := req.KeyVal["chain"]; chainid != "" {
+		c, ok := vh.chains[chainid]
+		if !ok {
+			return errResponse(ErrIdNotExists)
+		}
+		return &Response{Chains: []*ChainInfo{c.info()}}
+	}
+
+	contid := req.KeyVal["cont"]
+	chains := make([]*ChainInfo, 0, len(vh.chains))
+	for _, c := range vh.sortedChains() {
+		if contid == "" || c.has(vh.node(contid)) {
+			chains = append(chains, c.info())
+		}
+	}
+	return &Response{Chains: chains}
+}
+
+// replaces chain c with next of the same client, the
+// old route of the chain is restored if that fails
+func (vh *VoipHandler) reroute(c *chain, next *chain) error {
+	if err := vh.cmgr.DeRoute(c.nodes()); err != nil {
+		log.Println("[WARN] unable to remove route of chain", c.id, err)
+	}
+
+	if err := vh.install(next); err != nil {
+		if rerr := vh.install(c); rerr != nil {
+			log.Println("[WARN] unable to restore route of chain", c.id, rerr)
+		}
+		return err
+	}
+
+	*c = *next
+	return nil
+}
+
+// routes the chain, or balances it across its hops
+func (vh *VoipHandler) install(c *chain) error {
+	if !c.balanced {
+		return vh.cmgr.Route(c.nodes(), c.symmetric)
+	}
+
+	return vh.cmgr.Balance(c.cnode, c.hops, vh.weights(c), c.snode)
+}
+
+// hops of a balanced chain are weighted by their shares
+func (vh *VoipHandler) weights(c *chain) []int64 {
+	weights := make([]int64, 0, len(c.hops))
+	for _, hop := range c.hops {
+		weights = append(weights, vh.sched.Shares(hop.id))
+	}
+	return weights
+}
+
+// balances the chains through the nodes again, after their shares changed
+func (vh *VoipHandler) reweigh(nodes map[*Node]bool) {
+	for _, c := range vh.sortedChains() {
+		if !c.balanced {
+			continue
+		}
+		for _, hop := range c.hops {
+			if nodes[hop] {
+				if err := vh.install(c); err != nil {
+					log.Println("[WARN] unable to update weights of chain", c.id, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+func (vh *VoipHandler) removeChain(c *chain) {
+	if err := vh.cmgr.DeRoute(c.nodes()); err != nil {
+		log.Println("[WARN] unable to remove route of chain", c.id, err)
+	}
+	delete(vh.chains, c.id)
+}
+
+// called after a container is stopped, chains of a client or server are
+// removed and a network function is taken out of the chains it is in
+func (vh *VoipHandler) dropNode(node *Node) {
+	for _, c := range vh.sortedChains() {
+		switch {
+		case c.cnode == node || c.snode == node:
+			vh.removeChain(c)
+		case c.has(node):
+			if err := vh.reroute(c, c.withHops(withoutHop(c.hops, node.id))); err != nil {
+				log.Println("[WARN] removing chain", c.id, "without hop", node.id, err)
+				vh.removeChain(c)
+			}
+		}
+	}
+}
+
+// any started container other than clients and servers can be a hop
+func (vh *VoipHandler) hop(id string) (*Node, error) {
+	node := vh.node(id)
+	switch {
+	case node == nil:
+		return nil, ErrIdNotExists
+	case !vh.catalog.router(node.role):
+		return nil, ErrNotHop
+	default:
+		return node, nil
+	}
+}
+
+// nil if there is no such container
+func (vh *VoipHandler) node(id string) *Node {
+	if node, ok := vh.anodes[id]; ok {
+		return node
+	} else if mcont, ok := vh.mnodes[id]; ok {
+		return mcont.node
+	}
+	return nil
+}
+
+func (vh *VoipHandler) clientChain(cnode *Node) *chain {
+	for _, c := range vh.chains {
+		if c.cnode == cnode {
+			return c
+		}
+	}
+	return nil
+}
+
+func (vh *VoipHandler) sortedChains() []*chain {
+	chains := make([]*chain, 0, len(vh.chains))
+	for _, c := range vh.chains {
+		chains = append(chains, c)
+	}
+	sort.Sort(byChainId(chains))
+	return chains
+}
+
+func hasHop(hops []*Node, id string) bool {
+	for _, hop := range hops {
+		if hop.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutHop(hops []*Node, id string) []*Node {
+	kept := make([]*Node, 0, len(hops))
+	for _, hop := range hops {
+		if hop.id != id {
+			kept = append(kept, hop)
+		}
+	}
+	return kept
+}
+
+type byChainId []*chain
+
+func (b byChainId) Len() int           { return len(b) }
+func (b byChainId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byChainId) Less(i, j int) bool { return b[i].id < b[j].id }
@@ -0,0 +1,198 @@
+package voip
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func hopIds(nodes []*Node) string {
+	ids := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		ids = append(ids, node.id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestChain(t *testing.T) {
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, "", cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	nf2 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	nf3 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+
+	id := request(t, vh, ReqRouteCont, map[string]string{
+		"client": client, "hops": nf1 + "," + nf2, "server": server})
+	if got := hopIds(cmgr.routes[client]); got != strings.Join([]string{client, nf1, nf2, server}, ",") {
+		t.Fatalf("unexpected route %s", got)
+	}
+
+	request(t, vh, ReqInsertHop, map[string]string{"chain": id, "hop": nf3, "index": "1"})
+	if got := hopIds(vh.chains[id].hops); got != nf1+","+nf3+","+nf2 {
+		t.Errorf("expected hop inserted in the middle, got %s", got)
+	}
+	if got := hopIds(cmgr.routes[client]); got != strings.Join([]string{client, nf1, nf3, nf2, server}, ",") {
+		t.Errorf("chain not routed again, got %s", got)
+	}
+
+	request(t, vh, ReqRemoveHop, map[string]string{"chain": id, "hop": nf1})
+	if got := hopIds(vh.chains[id].hops); got != nf3+","+nf2 {
+		t.Errorf("expected %s removed, got %s", nf1, got)
+	}
+
+	// clients and servers are not network functions
+	resp := vh.HandleRequest(&Request{Code: ReqInsertHop, KeyVal: map[string]string{"chain": id, "hop": server}})
+	if resp.Err != ErrNotHop.Error() {
+		t.Errorf("expected %v, got %q", ErrNotHop, resp.Err)
+	}
+	resp = vh.HandleRequest(&Request{Code: ReqInsertHop, KeyVal: map[string]string{"chain": id, "hop": nf1, "index": "5"}})
+	if resp.Err != ErrHopIndex.Error() {
+		t.Errorf("expected %v, got %q", ErrHopIndex, resp.Err)
+	}
+
+	// a hop is in a chain only once
+	resp = vh.HandleRequest(&Request{Code: ReqInsertHop, KeyVal: map[string]string{"chain": id, "hop": nf2}})
+	if resp.Err != ErrDuplicateHop.Error() || resp.Status != http.StatusBadRequest {
+		t.Errorf("expected %v, got %q %d", ErrDuplicateHop, resp.Err, resp.Status)
+	}
+	resp = vh.HandleRequest(&Request{Code: ReqRouteCont, KeyVal: map[string]string{
+		"client": client, "hops": nf1 + "," + nf1, "server": server}})
+	if resp.Err != ErrDuplicateHop.Error() || resp.Status != http.StatusBadRequest {
+		t.Errorf("expected %v, got %q %d", ErrDuplicateHop, resp.Err, resp.Status)
+	}
+
+	// a stopped network function leaves the chain
+	request(t, vh, ReqStopCont, map[string]string{"cont": nf3})
+	if got := hopIds(cmgr.routes[client]); got != strings.Join([]string{client, nf2, server}, ",") {
+		t.Errorf("expected %s out of the chain, got %s", nf3, got)
+	}
+
+	resp = vh.HandleRequest(&Request{Code: ReqListChains, KeyVal: map[string]string{"cont": nf2}})
+	if len(resp.Chains) != 1 || resp.Chains[0].Id != id || resp.Chains[0].Client != client {
+		t.Errorf("expected chain %s through %s, got %+v", id, nf2, resp.Chains)
+	}
+
+	// and a stopped client takes its chain along
+	request(t, vh, ReqStopCont, map[string]string{"cont": client})
+	if len(vh.chains) != 0 || cmgr.routes[client] != nil {
+		t.Errorf("expected no chains left, got %v %v", vh.chains, cmgr.routes)
+	}
+}
+
+func TestChainFlows(t *testing.T) {
+	c := NewNode("c", "10.0.0.1", "00:16:3e:00:00:01", "h1")
+	n1 := NewNode("n1", "10.0.0.2", "00:16:3e:00:00:02", "h1")
+	n2 := NewNode("n2", "10.0.0.3", "00:16:3e:00:00:03", "h2")
+	s := NewNode("s", "10.0.0.4", "00:16:3e:00:00:04", "h2")
+	chain := []*Node{c, n1, n2, s}
+
+	if flows := chainFlows(chain, false); len(flows) != 2 {
+		t.Fatalf("expected 2 flows, got %d", len(flows))
+	}
+
+	expected := []struct {
+		from, to, dst *Node
+		reverse       bool
+	}{
+		{c, n1, s, false},
+		{n1, n2, s, false},
+		{s, n2, c, true},
+		{n2, n1, c, true},
+	}
+	flows := chainFlows(chain, true)
+	if len(flows) != len(expected) {
+		t.Fatalf("expected %d flows, got %d", len(expected), len(flows))
+	}
+	for i, e := range expected {
+		f := flows[i]
+		if f.from != e.from || f.to != e.to || f.dst != e.dst.mac || f.reverse != e.reverse {
+			t.Errorf("flow %d: expected %s -> %s, got %s -> %s", i, e.from.id, e.to.id, f.from.id, f.to.id)
+		}
+		if f.cookie != chainCookie(c.mac) || f.cip != c.ip {
+			t.Errorf("flow %d not tagged with client %s", i, c.id)
+		}
+	}
+}
+
+func TestSymmetricChain(t *testing.T) {
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, "", cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	nf2 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+
+	id := request(t, vh, ReqRouteCont, map[string]string{
+		"client": client, "router": nf1, "server": server, "symmetric": "true"})
+	if !cmgr.symmetric[client] || !vh.chains[id].info().Symmetric {
+		t.Fatal("expected symmetric chain", id)
+	}
+
+	// changes of hops keep both directions
+	request(t, vh, ReqInsertHop, map[string]string{"chain": id, "hop": nf2})
+	if !cmgr.symmetric[client] || len(cmgr.routes[client]) != 4 {
+		t.Errorf("expected symmetric chain through 2 hops, got %v", cmgr.routes[client])
+	}
+
+	resp := vh.HandleRequest(&Request{Code: ReqRouteCont, KeyVal: map[string]string{
+		"client": client, "router": nf1, "server": server, "symmetric": "maybe"}})
+	if resp.Err == "" {
+		t.Error("expected error for invalid symmetric option")
+	}
+
+	request(t, vh, ReqDelChain, map[string]string{"chain": id})
+	if _, ok := cmgr.symmetric[client]; ok || cmgr.routes[client] != nil {
+		t.Error("expected both directions to be removed")
+	}
+}
+
+func TestBalancedChain(t *testing.T) {
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, "", cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	nf2 := request(t, vh, ReqStartSnort, map[string]string{"shares": "512"})
+
+	// nf2 is a replica of nf1
+	p := vh.pools[nf1]
+	p.members = append(p.members, nf2)
+	vh.mnodes[nf2].pool = nf1
+	delete(vh.pools, nf2)
+
+	resp := vh.HandleRequest(&Request{Code: ReqRouteCont, KeyVal: map[string]string{
+		"client": client, "router": nf1, "server": server, "symmetric": "true", "balanced": "true"}})
+	if resp.Err != ErrBalancedSymmetric.Error() {
+		t.Errorf("expected %v, got %q", ErrBalancedSymmetric, resp.Err)
+	}
+
+	id := request(t, vh, ReqRouteCont, map[string]string{
+		"client": client, "router": nf1, "server": server, "balanced": "true"})
+	if got := hopIds(vh.chains[id].hops); got != nf1+","+nf2 || !vh.chains[id].info().Balanced {
+		t.Fatalf("expected chain balanced across the pool, got %s", got)
+	}
+	if w := cmgr.weights[client]; len(w) != 2 || w[0] != 256 || w[1] != 512 {
+		t.Errorf("expected weights from shares, got %v", w)
+	}
+
+	// weights follow the shares of the replicas
+	vh.sched.SetShares(vh.mnodes[nf2].node, 1024)
+	vh.reweigh(map[*Node]bool{vh.mnodes[nf2].node: true})
+	if w := cmgr.weights[client]; len(w) != 2 || w[1] != 1024 {
+		t.Errorf("expected weights updated, got %v", w)
+	}
+
+	// and the chain follows the pool as it scales in
+	vh.scaleIn(p)
+	if got := hopIds(cmgr.routes[client]); got != strings.Join([]string{client, nf1, server}, ",") {
+		t.Errorf("expected %s out of the balanced chain, got %s", nf2, got)
+	}
+	if w := cmgr.weights[client]; len(w) != 1 || w[0] != 256 {
+		t.Errorf("unexpected weights after scale in %v", w)
+	}
+}
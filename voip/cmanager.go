@@ -7,17 +7,52 @@ import (
 type CManager interface {
 	Setup() error
 	Destroy()
-	StartServer(host string, shares int64) (*Node, error)
-	StartSnort(host string, shares int64) (*Node, error)
-	StartClient(host string, shares int64, serverip string) (*Node, error)
+	// starts an NF of the kind in the catalogue, params are
+	// substituted in its env and cmd
+	StartNF(kind, host string, res Resources, params map[string]string) (*Node, error)
 	StopCont(node *Node) error
-	Route(cnode, rnode, snode *Node) error
-	SetShares(node *Node, shares int64) error
+	// takes over a container started by an earlier run, returns
+	// an error if the container is not running anymore
+	Adopt(node *Node) error
+	// the NFs running on the hosts found by their nfs.kind label, also
+	// those not started by this run. Nodes have at least the id and host,
+	// nil if the manager can't find them.
+	List() ([]*Node, error)
+	// chain is the client, the network functions in order and the server,
+	// routing a chain again replaces the earlier route of the client.
+	// Symmetric chains also steer the replies of the server in reverse.
+	Route(chain []*Node, symmetric bool) error
+	// traffic of the client to the server is spread across the replicas
+	// by weight, each flow stays on one replica. Balancing again updates
+	// the replicas and weights, DeRoute of the chain of client, replicas
+	// and server removes it.
+	Balance(cnode *Node, replicas []*Node, weights []int64, snode *Node) error
+	// removes the routes of the chain in both directions
+	DeRoute(chain []*Node) error
+	// route flows (and groups) found on the bridges by mac of their
+	// client, flows forwarding into tunnels by the mac they forward to.
+	// Nil if the manager has no flows to compare against.
+	Routes() (map[string][]string, error)
+	// the flows the chain needs, in the form and by the mac Routes finds
+	// them. Weights are of the replicas of a balanced chain, nil otherwise.
+	ChainRoutes(chain []*Node, symmetric bool, weights []int64) (map[string][]string, error)
+	// removes all the routes of the client mac and the flows forwarding
+	// to the mac from the bridges, also of clients that don't exist anymore
+	PurgeRoutes(mac string) error
+	// polices the traffic the container sends in the network,
+	// setting a Limit without kbps and pps removes it
+	SetLimit(node *Node, limit Limit) error
+	// sets all the resources of the vector, zero values are left as they
+	// are. Returns ErrResNotSupported for resources the manager can't set.
+	SetResources(node *Node, res Resources) error
 }
 
 const (
 	IMG_SIPP       = "mangalaman93/sipp"
 	IMG_SNORT      = "mangalaman93/snort"
+	IMG_SURICATA   = "mangalaman93/suricata"
+	IMG_BRO        = "mangalaman93/bro"
+	IMG_NDPI       = "mangalaman93/ndpi"
 	IMG_CADVISOR   = "mangalaman93/cadvisor"
 	IMG_MONCONT    = "mangalaman93/moncont"
 	SIPP_BUFF_SIZE = "1048576"
@@ -26,6 +61,12 @@ const (
 )
 
 var (
-	ErrHostNotFound = errors.New("Host not found")
-	ErrNoHosts      = errors.New("error while finding host list")
+	ErrHostNotFound      = errors.New("Host not found")
+	ErrNoHosts           = errors.New("error while finding host list")
+	ErrNotRunning        = errors.New("container is not running")
+	ErrShortChain        = errors.New("chain needs a client and a server")
+	ErrCmdNotSupported   = errors.New("container manager can't set the command of an NF")
+	ErrResNotSupported   = errors.New("container manager can't set the resource")
+	ErrRouteNotSupported = errors.New("container manager can't route traffic through NFs")
+	ErrLimitNotSupported = errors.New("container manager can't police traffic of containers")
 )
@@ -0,0 +1,357 @@
+package voip
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	CTRL_REF    = "ref"
+	CTRL_PID    = "pid"
+	CTRL_QUEUE  = "queue"
+	CTRL_VECTOR = "vector"
+)
+
+var (
+	ErrUnknownController = errors.New("Invalid control algorithm")
+)
+
+// Sample has rx, tx, cpu and queue data of a container synchronized within a
+// step. Rates are per second except CpuRate which is in percent of a core.
+// Duration (in s) is non zero only when a control period is over.
+type Sample struct {
+	Rx       int64
+	Tx       int64
+	Queue    int64
+	RxRate   float64
+	TxRate   float64
+	CpuRate  float64
+	Duration float64
+}
+
+// Controller decides cpu shares of a container given its samples.
+// It returns the new shares and true if shares should be changed.
+type Controller interface {
+	Next(s *Sample, shares int64) (int64, bool)
+}
+
+// ResourceController also decides the other resources of a container,
+// it returns the new resources and true if they should be changed
+type ResourceController interface {
+	Controller
+	NextResources(s *Sample, res Resources) (Resources, bool)
+}
+
+// parameters of all the control algorithms from VOIP.CONTROL section
+type ControlConfig struct {
+	controller string
+	nfs        map[string]string
+
+	// ref algorithm
+	reference int64
+	alpha     float64
+
+	// pid algorithm, reference is shared with ref
+	kp float64
+	ki float64
+	kd float64
+
+	// queue threshold algorithm
+	qhigh int64
+	qlow  int64
+	qstep int64
+
+	// vector algorithm, shares are of another algorithm and
+	// memory follows the queue thresholds
+	vector string
+	mmin   int64
+	mmax   int64
+	mstep  int64
+}
+
+func NewControlConfig(config *goconfig.ConfigFile) (*ControlConfig, error) {
+	reference, err := config.Int64("VOIP.CONTROL", "reference")
+	if err != nil {
+		return nil, err
+	}
+	alpha, err := config.Float64("VOIP.CONTROL", "alpha")
+	if err != nil {
+		return nil, err
+	}
+
+	// controller.<nf> selects algorithm for one type of NF
+	nfs := make(map[string]string)
+	for _, key := range config.GetKeyList("VOIP.CONTROL") {
+		if strings.HasPrefix(key, "controller.") {
+			nfs[strings.TrimPrefix(key, "controller.")] = config.MustValue("VOIP.CONTROL", key)
+		}
+	}
+
+	return &ControlConfig{
+		controller: config.MustValue("VOIP.CONTROL", "controller", CTRL_REF),
+		nfs:        nfs,
+		reference:  reference,
+		alpha:      alpha,
+		kp:         config.MustFloat64("VOIP.CONTROL", "pid_kp", 0.1),
+		ki:         config.MustFloat64("VOIP.CONTROL", "pid_ki", 0.01),
+		kd:         config.MustFloat64("VOIP.CONTROL", "pid_kd", 0),
+		qhigh:      config.MustInt64("VOIP.CONTROL", "queue_high", 100),
+		qlow:       config.MustInt64("VOIP.CONTROL", "queue_low", 10),
+		qstep:      config.MustInt64("VOIP.CONTROL", "queue_step", 64),
+		vector:     config.MustValue("VOIP.CONTROL", "vector_shares", CTRL_REF),
+		mmin:       config.MustInt64("VOIP.CONTROL", "memory_min", 64*1024*1024),
+		mmax:       config.MustInt64("VOIP.CONTROL", "memory_max", 512*1024*1024),
+		mstep:      config.MustInt64("VOIP.CONTROL", "memory_step", 32*1024*1024),
+	}, nil
+}
+
+// returns a new controller for given type of NF, name overrides config if given
+func (c *ControlConfig) NewController(nf, name string) (Controller, error) {
+	if name == "" {
+		name = c.controller
+		if n, ok := c.nfs[nf]; ok {
+			name = n
+		}
+	}
+
+	switch name {
+	case CTRL_REF:
+		return NewRefController(c.reference, c.alpha), nil
+	case CTRL_PID:
+		return NewPIDController(c.reference, c.kp, c.ki, c.kd), nil
+	case CTRL_QUEUE:
+		return NewQueueController(c.qhigh, c.qlow, c.qstep), nil
+	case CTRL_VECTOR:
+		if c.vector == CTRL_VECTOR {
+			return nil, ErrUnknownController
+		}
+		ctrl, err := c.NewController(nf, c.vector)
+		if err != nil {
+			return nil, err
+		}
+		return NewVectorController(ctrl, c.qhigh, c.qlow, c.mmin, c.mmax, c.mstep), nil
+	default:
+		return nil, ErrUnknownController
+	}
+}
+
+// reference throughput of the controller, 0 if it doesn't track one
+func Reference(ctrl Controller) int64 {
+	switch c := ctrl.(type) {
+	case *RefController:
+		return c.ref
+	case *PIDController:
+		return c.ref
+	case *VectorController:
+		return Reference(c.Controller)
+	default:
+		return 0
+	}
+}
+
+// name of the control algorithm, as used in config
+func ControllerName(ctrl Controller) string {
+	switch ctrl.(type) {
+	case *RefController:
+		return CTRL_REF
+	case *PIDController:
+		return CTRL_PID
+	case *QueueController:
+		return CTRL_QUEUE
+	case *VectorController:
+		return CTRL_VECTOR
+	default:
+		return ""
+	}
+}
+
+// RefController tracks a reference throughput by estimating how
+// throughput changes with shares over each control period
+type RefController struct {
+	ref   int64
+	alpha float64
+
+	prxr    float64
+	ptxr    float64
+	pqueuel int64
+	ibytes  int64
+	tibytes int64
+	csum    float64
+}
+
+func NewRefController(ref int64, alpha float64) *RefController {
+	return &RefController{
+		ref:   ref,
+		alpha: alpha,
+	}
+}
+
+func (r *RefController) Next(s *Sample, shares int64) (int64, bool) {
+	flag := false
+	tx := s.Tx
+	if r.ibytes == 0 {
+		r.ibytes = tx
+		r.tibytes = tx
+	}
+
+	switch {
+	case r.pqueuel > 0 && s.Queue <= 0:
+		r.csum += float64(tx-r.tibytes) * (r.prxr / (r.prxr + r.ptxr))
+		r.tibytes = tx
+	case r.pqueuel <= 0 && s.Queue > 0:
+		r.tibytes = tx
+	case r.pqueuel > 0 && s.Queue > 0:
+	case r.pqueuel <= 0 && s.Queue <= 0:
+	}
+
+	// 1 interval is over, we look at only inflow for consistency
+	if s.Duration > 0 {
+		r.csum += float64(tx-r.tibytes) * (r.prxr / (r.prxr - r.ptxr))
+		dprime := float64(r.csum) / float64(shares) / s.Duration
+		if math.Abs(dprime) > 0 && math.Abs(dprime) < 1000000 {
+			delta := float64(tx-r.ibytes) / s.Duration
+			log.Println("m.sum:", r.csum, "dprime:", dprime, "delta", delta)
+			shares += int64(r.alpha * (float64(r.ref) - delta) / dprime)
+			flag = true
+		}
+
+		r.csum = 0
+		r.ibytes = tx
+		r.tibytes = tx
+	}
+
+	r.prxr = s.RxRate
+	r.ptxr = s.TxRate
+	r.pqueuel = s.Queue
+	return shares, flag
+}
+
+// PIDController tracks reference throughput using a PID loop (velocity
+// form) on the throughput error of each control period
+type PIDController struct {
+	ref int64
+	kp  float64
+	ki  float64
+	kd  float64
+
+	ibytes int64
+	perr   float64
+	pperr  float64
+}
+
+func NewPIDController(ref int64, kp, ki, kd float64) *PIDController {
+	return &PIDController{
+		ref: ref,
+		kp:  kp,
+		ki:  ki,
+		kd:  kd,
+	}
+}
+
+func (p *PIDController) Next(s *Sample, shares int64) (int64, bool) {
+	if p.ibytes == 0 {
+		p.ibytes = s.Tx
+		return shares, false
+	}
+	if s.Duration <= 0 {
+		return shares, false
+	}
+
+	delta := float64(s.Tx-p.ibytes) / s.Duration
+	err := float64(p.ref) - delta
+	du := p.kp*(err-p.perr) + p.ki*err*s.Duration + p.kd*(err-2*p.perr+p.pperr)/s.Duration
+	p.ibytes = s.Tx
+	p.pperr = p.perr
+	p.perr = err
+
+	nshares := shares + int64(du)
+	return nshares, nshares != shares
+}
+
+// QueueController adds shares when queue at the end of a period is above
+// high watermark and removes them when it is below low watermark
+type QueueController struct {
+	high int64
+	low  int64
+	step int64
+}
+
+func NewQueueController(high, low, step int64) *QueueController {
+	return &QueueController{
+		high: high,
+		low:  low,
+		step: step,
+	}
+}
+
+func (q *QueueController) Next(s *Sample, shares int64) (int64, bool) {
+	if s.Duration <= 0 {
+		return shares, false
+	}
+
+	switch {
+	case s.Queue > q.high && shares < MAX_SHARES:
+		return shares + q.step, true
+	case s.Queue < q.low && shares > MIN_SHARES:
+		return shares - q.step, true
+	default:
+		return shares, false
+	}
+}
+
+// VectorController leaves shares to another controller and sets a memory
+// limit by the queue at the end of a period, the way QueueController does
+// with shares. The packets of a long queue need memory besides cpu.
+type VectorController struct {
+	Controller
+	high int64
+	low  int64
+	min  int64
+	max  int64
+	step int64
+}
+
+func NewVectorController(ctrl Controller, high, low, min, max, step int64) *VectorController {
+	return &VectorController{
+		Controller: ctrl,
+		high:       high,
+		low:        low,
+		min:        min,
+		max:        max,
+		step:       step,
+	}
+}
+
+func (v *VectorController) NextResources(s *Sample, res Resources) (Resources, bool) {
+	var flag bool
+	res.Shares, flag = v.Next(s, res.Shares)
+	if s.Duration <= 0 {
+		return res, flag
+	}
+
+	// containers without a limit start from the minimum
+	memory := res.Memory
+	switch {
+	case memory == 0:
+		memory = v.min
+	case s.Queue > v.high:
+		memory += v.step
+	case s.Queue < v.low:
+		memory -= v.step
+	}
+	if memory < v.min {
+		memory = v.min
+	} else if memory > v.max {
+		memory = v.max
+	}
+
+	if memory != res.Memory {
+		res.Memory = memory
+		flag = true
+	}
+	return res, flag
+}
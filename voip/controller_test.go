@@ -0,0 +1,104 @@
+package voip
+
+import (
+	"testing"
+)
+
+func TestQueueController(t *testing.T) {
+	c := NewQueueController(100, 10, 64)
+
+	if _, ok := c.Next(&Sample{Queue: 500}, 512); ok {
+		t.Error("expected no decision within a period")
+	}
+	if shares, ok := c.Next(&Sample{Queue: 500, Duration: 1}, 512); !ok || shares != 576 {
+		t.Errorf("expected 576 shares, got %d", shares)
+	}
+	if shares, ok := c.Next(&Sample{Queue: 0, Duration: 1}, 512); !ok || shares != 448 {
+		t.Errorf("expected 448 shares, got %d", shares)
+	}
+	if _, ok := c.Next(&Sample{Queue: 50, Duration: 1}, 512); ok {
+		t.Error("expected no decision between watermarks")
+	}
+}
+
+func TestPIDController(t *testing.T) {
+	c := NewPIDController(1000, 0.1, 0.01, 0)
+
+	c.Next(&Sample{Tx: 1}, 512)
+	shares, ok := c.Next(&Sample{Tx: 501, Duration: 1}, 512)
+	if !ok || shares <= 512 {
+		t.Errorf("expected more than 512 shares below reference, got %d", shares)
+	}
+
+	shares, ok = c.Next(&Sample{Tx: 3001, Duration: 1}, shares)
+	if !ok || shares >= 512+50 {
+		t.Errorf("expected shares to go down above reference, got %d", shares)
+	}
+}
+
+func TestControlConfig(t *testing.T) {
+	c := &ControlConfig{
+		controller: CTRL_REF,
+		nfs:        map[string]string{"snort": CTRL_QUEUE},
+	}
+
+	if ctrl, _ := c.NewController("snort", ""); ctrl == nil {
+		t.Error("expected a controller")
+	} else if _, ok := ctrl.(*QueueController); !ok {
+		t.Errorf("expected queue controller for snort, got %T", ctrl)
+	}
+	if ctrl, _ := c.NewController("suricata", ""); ctrl == nil {
+		t.Error("expected a controller")
+	} else if _, ok := ctrl.(*RefController); !ok {
+		t.Errorf("expected ref controller by default, got %T", ctrl)
+	}
+	if ctrl, _ := c.NewController("snort", CTRL_PID); ctrl == nil {
+		t.Error("expected a controller")
+	} else if _, ok := ctrl.(*PIDController); !ok {
+		t.Errorf("expected pid controller from request, got %T", ctrl)
+	}
+	if _, err := c.NewController("snort", "unknown"); err != ErrUnknownController {
+		t.Errorf("expected ErrUnknownController, got %v", err)
+	}
+}
+
+func TestVectorController(t *testing.T) {
+	c := NewVectorController(NewQueueController(100, 10, 64), 100, 10, 64, 128, 32)
+
+	if _, ok := c.NextResources(&Sample{Queue: 500}, Resources{Shares: 512}); ok {
+		t.Error("expected no decision within a period")
+	}
+	res, ok := c.NextResources(&Sample{Queue: 50, Duration: 1}, Resources{Shares: 512})
+	if !ok || res.Shares != 512 || res.Memory != 64 {
+		t.Errorf("expected minimum memory without a limit, got %v", res)
+	}
+	res, ok = c.NextResources(&Sample{Queue: 500, Duration: 1}, res)
+	if !ok || res.Shares != 576 || res.Memory != 96 {
+		t.Errorf("expected more shares and memory for a long queue, got %v", res)
+	}
+	res, _ = c.NextResources(&Sample{Queue: 500, Duration: 1}, res)
+	if res, _ = c.NextResources(&Sample{Queue: 500, Duration: 1}, res); res.Memory != 128 {
+		t.Errorf("expected memory up to the maximum, got %v", res)
+	}
+	if res, _ = c.NextResources(&Sample{Queue: 0, Duration: 1}, res); res.Memory != 96 {
+		t.Errorf("expected less memory for a short queue, got %v", res)
+	}
+}
+
+func TestClampShares(t *testing.T) {
+	node := NewNode("snort-1", "10.10.0.4", "00:16:3e:00:00:04", "h1")
+	m := &MContainer{node: node, ctrl: NewQueueController(100, 10, 64)}
+
+	if res, ok := m.next(&Sample{Queue: 0, Duration: 1}, Resources{Shares: 96}); !ok || res.Shares != MIN_SHARES {
+		t.Errorf("expected %d shares at least, got %d", MIN_SHARES, res.Shares)
+	}
+	if res, ok := m.next(&Sample{Queue: 500, Duration: 1}, Resources{Shares: 1000}); !ok || res.Shares != MAX_SHARES {
+		t.Errorf("expected %d shares at most, got %d", MAX_SHARES, res.Shares)
+	}
+
+	// controllers of the whole vector are clamped the same way
+	m.ctrl = NewVectorController(NewQueueController(100, 10, 64), 100, 10, 64, 128, 32)
+	if res, ok := m.next(&Sample{Queue: 0, Duration: 1}, Resources{Shares: 96}); !ok || res.Shares != MIN_SHARES {
+		t.Errorf("expected %d shares at least, got %d", MIN_SHARES, res.Shares)
+	}
+}
@@ -3,6 +3,8 @@ package voip
 import (
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/Unknwon/goconfig"
 	docker "github.com/mangalaman93/dockerclient"
@@ -11,13 +13,19 @@ import (
 
 const (
 	STOP_TIMEOUT = 5
+	// cgroup v1 hierarchy of docker, containers are in it by full id,
+	// there is no net_prio with cgroup v2
+	NET_PRIO_CGROUP = "/sys/fs/cgroup/net_prio/docker"
 )
 
 type DockerCManager struct {
+	*netManager
 	dockercls map[string]*docker.DockerClient
 	hmap      map[string]string
+	catalog   Catalog
 	cadvisor  []string
 	moncont   []string
+	netprio   map[string]bool // hosts with the net_prio cgroup
 }
 
 func NewDockerCManager(config *goconfig.ConfigFile) (*DockerCManager, error) {
@@ -52,6 +60,10 @@ func NewDockerCManager(config *goconfig.ConfigFile) (*DockerCManager, error) {
 		return nil, err
 	}
 
+	catalog, err := NewCatalog(config)
+	if err != nil {
+		return nil, err
+	}
 	hmap := make(map[string]string)
 	for _, host := range hosts {
 		address, err := config.GetValue("VOIP.TOPO", host)
@@ -60,10 +72,17 @@ func NewDockerCManager(config *goconfig.ConfigFile) (*DockerCManager, error) {
 		}
 		hmap[host] = address
 	}
+	netm, err := newNetManager(config, hmap)
+	if err != nil {
+		return nil, err
+	}
 
 	return &DockerCManager{
-		dockercls: make(map[string]*docker.DockerClient),
-		hmap:      hmap,
+		netManager: netm,
+		dockercls:  make(map[string]*docker.DockerClient),
+		hmap:       hmap,
+		netprio:    make(map[string]bool),
+		catalog:    catalog,
 		cadvisor: []string{"-storage_driver=influxdb",
 			"-storage_driver_user=" + iuser,
 			"-storage_driver_password=" + ipass,
@@ -76,13 +95,13 @@ func NewDockerCManager(config *goconfig.ConfigFile) (*DockerCManager, error) {
 
 func (d *DockerCManager) Setup() error {
 	undo := true
-	err := ovsdInit()
+	err := d.setup()
 	if err != nil {
 		return err
 	}
 	defer func() {
 		if undo {
-			ovsdDestroy()
+			d.destroyBridges()
 		}
 	}()
 
@@ -94,6 +113,15 @@ func (d *DockerCManager) Setup() error {
 
 		d.dockercls[host] = client
 		log.Println("[INFO] added host", host)
+		if _, err := runshAt(d.addr(host), "test -d "+NET_PRIO_CGROUP); err == nil {
+			d.netprio[host] = true
+		} else {
+			log.Println("[INFO] no net_prio cgroup on host", host, "net priority not supported")
+		}
+
+		// left behind if the previous run didn't exit cleanly
+		client.RemoveContainer("cadvisor-"+host, true, true)
+		client.RemoveContainer("moncont-"+host, true, true)
 
 		id, err := client.CreateContainer(&docker.ContainerConfig{
 			Image: IMG_CADVISOR,
@@ -175,41 +203,43 @@ func (d *DockerCManager) Destroy() {
 		}
 	}
 
-	ovsdDestroy()
+	d.destroyBridges()
 }
 
-func (d *DockerCManager) StartServer(host string, shares int64) (*Node, error) {
-	return d.runc(host, "sipp-server", &docker.ContainerConfig{
-		Env:             []string{"ARGS=-buff_size " + SIPP_BUFF_SIZE + " -sn uas"},
-		Image:           IMG_SIPP,
-		NetworkDisabled: true,
-	}, &docker.HostConfig{
-		CpuShares: shares,
-		CpuQuota:  int64(shares * CPU_PERIOD / 1024),
-	})
-}
+// the labels tell moncont how to monitor the container
+func (d *DockerCManager) StartNF(kind, host string, res Resources, params map[string]string) (*Node, error) {
+	if res.NetPrio != 0 && !d.netprio[host] {
+		return nil, ErrResNotSupported
+	}
+	nf, err := d.catalog.Get(kind)
+	if err != nil {
+		return nil, err
+	}
+	env, cmd, err := nf.expand(params)
+	if err != nil {
+		return nil, err
+	}
 
-func (d *DockerCManager) StartSnort(host string, shares int64) (*Node, error) {
-	return d.runc(host, "snort", &docker.ContainerConfig{
-		Image:           IMG_SNORT,
+	hconf := resourceConfig(res)
+	hconf.CapAdd = nf.CapAdd
+	node, err := d.runc(host, nf.Name, &docker.ContainerConfig{
+		Env:             envList(env),
+		Cmd:             cmd,
+		Image:           nf.Image,
+		Labels:          nf.labels(),
 		NetworkDisabled: true,
-	}, &docker.HostConfig{
-		CapAdd:    []string{"NET_ADMIN"},
-		CpuShares: shares,
-		CpuQuota:  int64(shares * CPU_PERIOD / 1024),
-	})
-}
+	}, hconf)
+	if err != nil {
+		return nil, err
+	}
 
-func (d *DockerCManager) StartClient(host string, shares int64, serverip string) (*Node, error) {
-	args := "-buff_size " + SIPP_BUFF_SIZE + " -sn uac -r 0 " + serverip + ":5060"
-	return d.runc(host, "sipp-client", &docker.ContainerConfig{
-		Env:             []string{"ARGS=" + args},
-		Image:           IMG_SIPP,
-		NetworkDisabled: true,
-	}, &docker.HostConfig{
-		CpuShares: shares,
-		CpuQuota:  int64(shares * CPU_PERIOD / 1024),
-	})
+	if res.NetPrio != 0 {
+		if err := d.setNetPrio(node, res.NetPrio); err != nil {
+			d.StopCont(node)
+			return nil, err
+		}
+	}
+	return node, nil
 }
 
 func (d *DockerCManager) StopCont(node *Node) error {
@@ -219,50 +249,115 @@ func (d *DockerCManager) StopCont(node *Node) error {
 		return ErrHostNotFound
 	}
 
-	ovsdDeRoute(node.mac)
-	log.Println("[INFO] derouted for container", node.id)
-
+	// the address, mac and port go even if the container doesn't stop,
+	// it is of no use without them and they would be leaked otherwise
+	d.isolate(node)
 	err := client.StopContainer(node.id, STOP_TIMEOUT)
+	d.detach(node)
 	if err != nil {
 		log.Println("[WARN] unable to stop container", node.id)
-	} else {
-		log.Println("[INFO] container with id", node.id, "stopped")
-		ovsdUSetupNetwork(node.id)
-		err = client.RemoveContainer(node.id, true, true)
+		return err
 	}
 
-	return err
+	log.Println("[INFO] container with id", node.id, "stopped")
+	return client.RemoveContainer(node.id, true, true)
 }
 
-func (d *DockerCManager) Route(cnode, rnode, snode *Node) error {
-	err := ovsdRoute(cnode.mac, rnode.mac, snode.mac)
+func (d *DockerCManager) Adopt(node *Node) error {
+	client, ok := d.dockercls[node.host]
+	if !ok {
+		return ErrHostNotFound
+	}
+
+	info, err := client.InspectContainer(node.id)
 	if err != nil {
 		return err
 	}
+	if info.State == nil || !info.State.Running {
+		return ErrNotRunning
+	}
 
-	log.Println("[INFO] setup route", cnode.ip, "->", rnode.ip, "->", snode.ip)
+	if err := d.reserve(node); err != nil {
+		return err
+	}
+	log.Println("[INFO] adopted container", node.id, "ip:", node.ip, "mac:", node.mac)
 	return nil
 }
 
-func (d *DockerCManager) SetShares(node *Node, shares int64) error {
+func (d *DockerCManager) List() ([]*Node, error) {
+	nodes := make([]*Node, 0)
+	for host, client := range d.dockercls {
+		conts, err := client.ListContainers(false, false, `{"label":["`+LABEL_KIND+`"]}`)
+		if err != nil {
+			return nil, err
+		}
+		for _, cont := range conts {
+			if len(cont.Names) != 0 {
+				nodes = append(nodes, &Node{id: strings.TrimPrefix(cont.Names[0], "/"), host: host})
+			}
+		}
+	}
+	return nodes, nil
+}
+
+func (d *DockerCManager) SetResources(node *Node, res Resources) error {
 	client, ok := d.dockercls[node.host]
 	if !ok {
 		log.Println("[WARN] docker client for host", node.host, "not found")
 		return ErrHostNotFound
 	}
+	netprio := res.NetPrio != 0 && res.NetPrio != node.res.NetPrio
+	if netprio && !d.netprio[node.host] {
+		return ErrResNotSupported
+	}
 
-	if err := client.SetContainer(node.id, &docker.HostConfig{
-		CpuShares: shares,
-		CpuQuota:  int64(shares * CPU_PERIOD / 1024),
-	}); err != nil {
-		log.Println("[WARN] unable to set new shares")
+	if err := client.SetContainer(node.id, resourceConfig(res)); err != nil {
+		log.Println("[WARN] unable to set new resources")
 		return err
 	}
+	if netprio {
+		if err := d.setNetPrio(node, res.NetPrio); err != nil {
+			return err
+		}
+	}
+
+	log.Println("[INFO] set resources for container", node.id, "to", res)
+	return nil
+}
+
+// docker has no option for the priority of the traffic,
+// we write the net_prio cgroup of the container instead
+func (d *DockerCManager) setNetPrio(node *Node, prio int64) error {
+	client, ok := d.dockercls[node.host]
+	if !ok {
+		return ErrHostNotFound
+	}
 
-	log.Println("[INFO] set cpu limit for container", node.id, "to", shares)
+	info, err := client.InspectContainer(node.id)
+	if err != nil {
+		return err
+	}
+	file := fmt.Sprintf("%s/%s/net_prio.ifpriomap", NET_PRIO_CGROUP, info.Id)
+	if _, err := runshAt(d.addr(node.host), fmt.Sprintf("echo 'eth0 %d' | sudo tee %s", prio, file)); err != nil {
+		log.Println("[WARN] unable to set net priority of container", node.id, err)
+		return err
+	}
 	return nil
 }
 
+// zero values are not changed by docker, memory is without swap
+func resourceConfig(res Resources) *docker.HostConfig {
+	return &docker.HostConfig{
+		CpuShares:   res.Shares,
+		CpuPeriod:   CPU_PERIOD,
+		CpuQuota:    res.quota(),
+		CpusetCpus:  res.Cpuset,
+		Memory:      res.Memory,
+		MemorySwap:  res.Memory,
+		BlkioWeight: res.BlkioWeight,
+	}
+}
+
 func (d *DockerCManager) runc(host, prefix string, cconf *docker.ContainerConfig, hconf *docker.HostConfig) (*Node, error) {
 	undo := true
 	client, ok := d.dockercls[host]
@@ -293,17 +388,15 @@ func (d *DockerCManager) runc(host, prefix string, cconf *docker.ContainerConfig
 	}()
 	log.Println("[INFO] started container with id", cid)
 
-	ip, mac, err := ovsdSetupNetwork(cid)
+	info, err := client.InspectContainer(cid)
+	if err != nil {
+		return nil, err
+	}
+	node, err := d.attach(host, cid, netns(strconv.Itoa(info.State.Pid)))
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if undo {
-			ovsdUSetupNetwork(cid)
-		}
-	}()
-	log.Println("[INFO] setup network for container", cid, "ip:", ip, "mac:", mac)
 
 	undo = false
-	return NewNode(cid, ip, mac, host), nil
+	return node, nil
 }
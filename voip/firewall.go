@@ -0,0 +1,131 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	DEF_FIREWALL_CMD    = "iptables"
+	DEF_FIREWALL_TARGET = "RETURN"
+	FIREWALL_PREFIX     = "NFS-"
+)
+
+var (
+	ErrFirewallNotFound = errors.New("firewall command not found")
+)
+
+// firewall keeps the rules of each container in a chain of its own and
+// jumps to the chain for the traffic of the container. It only adds and
+// removes its own chains and jumps, so rules of docker, the NFQUEUE of
+// snort and other tools stay as they are. The command can be iptables-nft
+// for nftables. Bridged traffic only goes through netfilter with the linux
+// backend, with ovs the chain sees the traffic to and from the host.
+// The chain accepts what the controller itself sends to the container and
+// ends in RETURN, so other traffic goes on through the rules of the
+// built-in chain after the jump.
+type firewall struct {
+	cmd    string
+	target string
+}
+
+// reads optional [VOIP.FIREWALL] section, nil unless enabled
+func newFirewall(config *goconfig.ConfigFile) *firewall {
+	if !config.MustBool("VOIP.FIREWALL", "enabled", false) {
+		return nil
+	}
+
+	return &firewall{
+		cmd:    config.MustValue("VOIP.FIREWALL", "command", DEF_FIREWALL_CMD),
+		target: config.MustValue("VOIP.FIREWALL", "target", DEF_FIREWALL_TARGET),
+	}
+}
+
+func (f *firewall) init(addr string) error {
+	out, err := runshAt(addr, "which "+f.cmd)
+	if err != nil || string(out) == "" {
+		return ErrFirewallNotFound
+	}
+	return nil
+}
+
+// creates (or resets) the chain of the container, adopted
+// containers may have their chain and jumps already
+func (f *firewall) add(addr string, node *Node) error {
+	chain := firewallChain(node.id)
+	cmds := []string{
+		fmt.Sprintf("(sudo %s -N %s 2>/dev/null || sudo %s -F %s)", f.cmd, chain, f.cmd, chain),
+	}
+	for _, rule := range firewallRules(node) {
+		cmds = append(cmds, fmt.Sprintf("sudo %s -A %s %s", f.cmd, chain, rule))
+	}
+	cmds = append(cmds, fmt.Sprintf("sudo %s -A %s -j %s", f.cmd, chain, f.target))
+	for _, jump := range firewallJumps(node) {
+		cmds = append(cmds, fmt.Sprintf("(sudo %s -C %s 2>/dev/null || sudo %s -I %s)",
+			f.cmd, jump, f.cmd, jump))
+	}
+
+	if _, err := runshAt(addr, strings.Join(cmds, " && ")); err != nil {
+		log.Println("[WARN] unable to setup firewall chain for", node.id, err)
+		f.remove(addr, node)
+		return err
+	}
+
+	log.Println("[INFO] setup firewall chain", chain, "for", node.id)
+	return nil
+}
+
+// a chain can only be deleted once nothing jumps to it
+func (f *firewall) remove(addr string, node *Node) error {
+	chain := firewallChain(node.id)
+	cmds := make([]string, 0)
+	for _, jump := range firewallJumps(node) {
+		cmds = append(cmds, fmt.Sprintf("while sudo %s -D %s 2>/dev/null; do :; done", f.cmd, jump))
+	}
+	// the address of a container left by an earlier run may be unknown
+	if node.ip == "" {
+		cmds = []string{fmt.Sprintf("sudo %s -S | grep -- '-j %s$' | cut -c4- | while read jump; do sudo %s -D $jump; done",
+			f.cmd, chain, f.cmd)}
+	}
+	cmds = append(cmds, fmt.Sprintf("if sudo %s -n -L %s >/dev/null 2>&1; then sudo %s -F %s && sudo %s -X %s; fi",
+		f.cmd, chain, f.cmd, chain, f.cmd, chain))
+
+	if _, err := runshAt(addr, strings.Join(cmds, "; ")); err != nil {
+		log.Println("[WARN] unable to remove firewall chain for", node.id, err)
+		return err
+	}
+
+	log.Println("[INFO] removed firewall chain", chain, "of", node.id)
+	return nil
+}
+
+// rate changes sent to clients by setClientRate, the role of the
+// container is not known yet when it is attached
+func firewallRules(node *Node) []string {
+	return []string{
+		fmt.Sprintf("-p udp -d %s --dport %d -j ACCEPT", node.ip, CLIENT_CTRL_PORT),
+	}
+}
+
+// traffic through the host and between the host and the container
+func firewallJumps(node *Node) []string {
+	chain := firewallChain(node.id)
+	return []string{
+		"FORWARD -s " + node.ip + " -j " + chain,
+		"FORWARD -d " + node.ip + " -j " + chain,
+		"INPUT -s " + node.ip + " -j " + chain,
+		"OUTPUT -d " + node.ip + " -j " + chain,
+	}
+}
+
+// chain names are limited to 28 characters
+func firewallChain(id string) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return fmt.Sprintf("%s%08x", FIREWALL_PREFIX, h.Sum32())
+}
@@ -0,0 +1,38 @@
+package voip
+
+import (
+	"testing"
+
+	"github.com/Unknwon/goconfig"
+)
+
+func TestFirewall(t *testing.T) {
+	config, err := goconfig.LoadFromData([]byte("[VOIP.FIREWALL]\ncommand=iptables-nft\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw := newFirewall(config); fw != nil {
+		t.Errorf("expected no firewall, got %+v", fw)
+	}
+
+	config, err = goconfig.LoadFromData([]byte("[VOIP.FIREWALL]\nenabled=true\ncommand=iptables-nft\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw := newFirewall(config); fw == nil || fw.cmd != "iptables-nft" || fw.target != "RETURN" {
+		t.Errorf("unexpected firewall %+v", fw)
+	}
+
+	node := NewNode("sipp-client-6f1c2d3e-0a4b-11e6-8d2f-0242ac110002", "10.10.0.2", "00:16:3e:00:00:02", "h1")
+	chain := firewallChain(node.id)
+	if len(chain) > 28 || chain != firewallChain(node.id) || chain == firewallChain("snort-1") {
+		t.Errorf("unexpected chain name %s", chain)
+	}
+	if rules := firewallRules(node); len(rules) != 1 || rules[0] != "-p udp -d 10.10.0.2 --dport 8888 -j ACCEPT" {
+		t.Errorf("expected rate changes accepted, got %v", rules)
+	}
+	jumps := firewallJumps(node)
+	if len(jumps) != 4 || jumps[0] != "FORWARD -s 10.10.0.2 -j "+chain {
+		t.Errorf("unexpected jumps %v", jumps)
+	}
+}
@@ -0,0 +1,273 @@
+package voip
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const API_PREFIX = "/voip/"
+
+var (
+	ErrNotFound         = errors.New("resource not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrInvalidValue     = errors.New("values must be strings, numbers, bools or lists of them")
+	ErrNotObject        = errors.New("body must be a json object")
+)
+
+// HttpApi exposes the requests of the unix socket as a REST API:
+//
+//	POST   /voip/servers            {"host": "", "shares": 1024}
+//	POST   /voip/snorts             {"host": "", "shares": 1024, "controller": "pid"}
+//	POST   /voip/clients            {"host": "", "shares": 1024, "server": "<id>"}
+//	POST   /voip/nfs                {"kind": "suricata", "host": "", "shares": 1024, ...params}
+//	POST   /voip/routes             {"client": "<id>", "router": "<id>", "server": "<id>"}
+//	POST   /voip/chains             {"client": "<id>", "hops": ["<id>", ...], "server": "<id>", "symmetric": true}
+//	POST   /voip/chains             {"client": "<id>", "hops": ["<id>", ...], "server": "<id>", "balanced": true}
+//	POST   /voip/chains/{id}/hops   {"hop": "<id>", "index": 0}
+//	DELETE /voip/chains/{id}/hops/{hop}
+//	DELETE /voip/chains/{id}
+//	GET    /voip/chains?cont=<id>
+//	GET    /voip/chains/{id}
+//	PUT    /voip/clients/{id}/rate  {"rate": 100}
+//	PUT    /voip/clients/{id}/limit {"kbps": 1000, "pps": 100}
+//	PUT    /voip/containers/{id}/resources {"shares": 512, "cpuset": "0-1", "memory": 268435456, ...}
+//	DELETE /voip/containers/{id}
+//	GET    /voip/containers?role=snort
+//	GET    /voip/containers/{id}
+//	GET    /voip/drift
+//	POST   /voip/drift              (reconciles first)
+//
+// Errors are returned as {"error": "<message>"} with a matching status code
+type HttpApi struct {
+	vh *VoipHandler
+}
+
+type apiResult struct {
+	Id     string       `json:"id,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Nodes  []*NodeInfo  `json:"nodes,omitempty"`
+	Node   *NodeInfo    `json:"node,omitempty"`
+	Chains []*ChainInfo `json:"chains,omitempty"`
+	Chain  *ChainInfo   `json:"chain,omitempty"`
+	Drifts []*Drift     `json:"drifts,omitempty"`
+}
+
+func NewHttpApi(vh *VoipHandler) *HttpApi {
+	return &HttpApi{vh: vh}
+}
+
+func (h *HttpApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, API_PREFIX) {
+		writeJSON(w, http.StatusNotFound, &apiResult{Error: ErrNotFound.Error()})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path[len(API_PREFIX):], "/"), "/")
+	req := &Request{Code: -1}
+	status := http.StatusNoContent
+	switch {
+	case len(parts) == 1 && parts[0] == "servers":
+		req.Code, status = ReqStartServer, http.StatusCreated
+	case len(parts) == 1 && parts[0] == "snorts":
+		req.Code, status = ReqStartSnort, http.StatusCreated
+	case len(parts) == 1 && parts[0] == "clients":
+		req.Code, status = ReqStartClient, http.StatusCreated
+	case len(parts) == 1 && parts[0] == "nfs":
+		req.Code, status = ReqStartNF, http.StatusCreated
+	case len(parts) == 1 && parts[0] == "routes":
+		req.Code = ReqRouteCont
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "rate":
+		req.Code = ReqSetRate
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "limit":
+		req.Code = ReqSetLimit
+	case len(parts) == 1 && parts[0] == "containers":
+		req.Code, status = ReqListNodes, http.StatusOK
+	case len(parts) == 2 && parts[0] == "containers" && r.Method == "GET":
+		req.Code, status = ReqGetNode, http.StatusOK
+	case len(parts) == 2 && parts[0] == "containers":
+		req.Code = ReqStopCont
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "resources":
+		req.Code = ReqSetResources
+	case len(parts) == 1 && parts[0] == "chains" && r.Method == "GET":
+		req.Code, status = ReqListChains, http.StatusOK
+	case len(parts) == 1 && parts[0] == "chains":
+		req.Code, status = ReqRouteCont, http.StatusCreated
+	case len(parts) == 2 && parts[0] == "chains" && r.Method == "GET":
+		req.Code, status = ReqListChains, http.StatusOK
+	case len(parts) == 2 && parts[0] == "chains":
+		req.Code = ReqDelChain
+	case len(parts) == 3 && parts[0] == "chains" && parts[2] == "hops":
+		req.Code = ReqInsertHop
+	case len(parts) == 4 && parts[0] == "chains" && parts[2] == "hops":
+		req.Code = ReqRemoveHop
+	case len(parts) == 1 && parts[0] == "drift":
+		req.Code, status = ReqGetDrift, http.StatusOK
+	default:
+		writeJSON(w, http.StatusNotFound, &apiResult{Error: ErrNotFound.Error()})
+		return
+	}
+
+	method := "POST"
+	switch req.Code {
+	case ReqSetRate, ReqSetLimit, ReqSetResources:
+		method = "PUT"
+	case ReqStopCont, ReqDelChain, ReqRemoveHop:
+		method = "DELETE"
+	case ReqListNodes, ReqGetNode, ReqListChains:
+		method = "GET"
+	case ReqGetDrift:
+		// POST reconciles first
+		method = "GET"
+		if r.Method == "POST" {
+			method = "POST"
+		}
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, &apiResult{Error: ErrMethodNotAllowed.Error()})
+		return
+	}
+
+	var err error
+	req.KeyVal, err = readKeyVal(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &apiResult{Error: err.Error()})
+		return
+	}
+	switch req.Code {
+	case ReqSetRate, ReqSetLimit:
+		req.KeyVal["client"] = parts[1]
+	case ReqStopCont, ReqGetNode, ReqSetResources:
+		req.KeyVal["cont"] = parts[1]
+	case ReqListNodes:
+		req.KeyVal["role"] = r.URL.Query().Get("role")
+	case ReqListChains:
+		req.KeyVal["cont"] = r.URL.Query().Get("cont")
+		if len(parts) == 2 {
+			req.KeyVal["chain"] = parts[1]
+		}
+	case ReqDelChain, ReqInsertHop:
+		req.KeyVal["chain"] = parts[1]
+	case ReqRemoveHop:
+		req.KeyVal["chain"] = parts[1]
+		req.KeyVal["hop"] = parts[3]
+	case ReqGetDrift:
+		req.KeyVal["reconcile"] = strconv.FormatBool(r.Method == "POST")
+	}
+
+	resp := h.vh.HandleRequest(req)
+	if resp.Err != "" {
+		log.Println("[WARN] error in api request", r.Method, r.URL.Path, resp.Err)
+		if resp.Status == 0 {
+			resp.Status = http.StatusInternalServerError
+		}
+		writeJSON(w, resp.Status, &apiResult{Error: resp.Err})
+		return
+	}
+
+	switch req.Code {
+	case ReqListNodes:
+		writeJSON(w, status, &apiResult{Nodes: resp.Nodes})
+	case ReqGetNode:
+		writeJSON(w, status, &apiResult{Node: resp.Nodes[0]})
+	case ReqListChains:
+		if len(parts) == 2 {
+			writeJSON(w, status, &apiResult{Chain: resp.Chains[0]})
+		} else {
+			writeJSON(w, status, &apiResult{Chains: resp.Chains})
+		}
+	case ReqGetDrift:
+		writeJSON(w, status, &apiResult{Drifts: resp.Drifts})
+	default:
+		writeJSON(w, status, &apiResult{Id: resp.Result})
+	}
+}
+
+// the body is a json object, numbers and bools are converted to strings and
+// lists are comma separated, so that the same request handlers can be used
+// as for the unix socket. Null and objects have no such string.
+func readKeyVal(r *http.Request) (map[string]string, error) {
+	kv := make(map[string]string)
+	if r.Body == nil || r.ContentLength == 0 {
+		return kv, nil
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	} else if body == nil {
+		return nil, ErrNotObject
+	}
+
+	for key, value := range body {
+		if v, ok := value.([]interface{}); ok {
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				s, err := scalarString(item)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, s)
+			}
+			kv[key] = strings.Join(items, ",")
+			continue
+		}
+
+		s, err := scalarString(value)
+		if err != nil {
+			return nil, err
+		}
+		kv[key] = s
+	}
+
+	return kv, nil
+}
+
+func scalarString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", ErrInvalidValue
+	}
+}
+
+// maps errors returned by the request handlers to http status codes,
+// numbers that don't parse are bad requests too
+func errStatus(err error) int {
+	if _, ok := err.(*strconv.NumError); ok {
+		return http.StatusBadRequest
+	}
+
+	switch err {
+	case ErrKeyNotFound, ErrUnknownController, ErrNotHop, ErrHopIndex, ErrDuplicateHop, ErrShortChain,
+		ErrBalancedSymmetric, ErrNotClient, ErrInvalidLimit, ErrUnknownNF,
+		ErrInvalidResources, ErrResNotSupported, ErrRouteNotSupported, ErrLimitNotSupported:
+		return http.StatusBadRequest
+	case ErrIdNotExists, ErrHostNotFound:
+		return http.StatusNotFound
+	case ErrNoCapacity:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, res *apiResult) {
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
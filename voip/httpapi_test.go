@@ -0,0 +1,329 @@
+package voip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const testConfig = `
+[VOIP.CONTROL]
+step_length=1000
+period_length=10000
+reference=5000
+alpha=1
+cpu_table=cpu_usage_total
+rx_table=rx_packets
+tx_table=tx_packets
+queue_table=snort_queue_length
+
+[VOIP.TOPO]
+h1=10.0.0.1:2575
+`
+
+// fakeCManager starts containers in memory only
+type fakeCManager struct {
+	count     int
+	conts     map[string]*Node
+	routes    map[string][]*Node
+	symmetric map[string]bool
+	weights   map[string][]int64
+	flows     map[string][]string // client mac -> route flows
+	ports     map[string]int      // ofports of containers, 0 unless restarted
+	limits    map[string]Limit
+	params    map[string]map[string]string
+	res       map[string]Resources
+	lost      map[string]bool // running but can't be inspected
+	tunnel    string          // port towards servers on another host
+}
+
+func newFakeCManager() *fakeCManager {
+	return &fakeCManager{
+		conts:     make(map[string]*Node),
+		routes:    make(map[string][]*Node),
+		symmetric: make(map[string]bool),
+		weights:   make(map[string][]int64),
+		flows:     make(map[string][]string),
+		ports:     make(map[string]int),
+		limits:    make(map[string]Limit),
+		params:    make(map[string]map[string]string),
+		res:       make(map[string]Resources),
+		lost:      make(map[string]bool),
+	}
+}
+
+func (f *fakeCManager) Setup() error { return nil }
+func (f *fakeCManager) Destroy()     {}
+
+func (f *fakeCManager) StartNF(kind, host string, res Resources, params map[string]string) (*Node, error) {
+	node, err := f.start(host)
+	if err != nil {
+		return nil, err
+	}
+	f.params[node.id] = params
+	f.res[node.id] = res
+	return node, nil
+}
+
+func (f *fakeCManager) StopCont(node *Node) error {
+	delete(f.conts, node.id)
+	return nil
+}
+
+func (f *fakeCManager) Adopt(node *Node) error {
+	if f.lost[node.id] {
+		return ErrHostNotFound
+	} else if _, ok := f.conts[node.id]; !ok {
+		return ErrNotRunning
+	}
+	return nil
+}
+
+func (f *fakeCManager) List() ([]*Node, error) {
+	nodes := make([]*Node, 0, len(f.conts))
+	for _, node := range f.conts {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (f *fakeCManager) Route(chain []*Node, symmetric bool) error {
+	for _, node := range chain {
+		if _, ok := f.conts[node.id]; !ok {
+			return ErrIdNotExists
+		}
+	}
+	f.routes[chain[0].id] = chain
+	f.symmetric[chain[0].id] = symmetric
+	routes, _ := f.ChainRoutes(chain, symmetric, nil)
+	for mac, flows := range routes {
+		f.flows[mac] = flows
+	}
+	return nil
+}
+
+func (f *fakeCManager) Balance(cnode *Node, replicas []*Node, weights []int64, snode *Node) error {
+	if err := f.Route(chainNodes(cnode, replicas, snode), false); err != nil {
+		return err
+	}
+	f.weights[cnode.id] = weights
+	routes, _ := f.ChainRoutes(chainNodes(cnode, replicas, snode), false, weights)
+	for mac, flows := range routes {
+		f.flows[mac] = flows
+	}
+	return nil
+}
+
+func (f *fakeCManager) DeRoute(chain []*Node) error {
+	delete(f.routes, chain[0].id)
+	delete(f.symmetric, chain[0].id)
+	delete(f.weights, chain[0].id)
+	delete(f.flows, chain[0].mac)
+	return nil
+}
+
+func (f *fakeCManager) Routes() (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for mac, flows := range f.flows {
+		if len(flows) != 0 {
+			routes[mac] = flows
+		}
+	}
+	return routes, nil
+}
+
+// flows resubmit from the port of the sender, as the shell backend does
+func (f *fakeCManager) ChainRoutes(chain []*Node, symmetric bool, weights []int64) (map[string][]string, error) {
+	flows := make([]string, 0)
+	if len(weights) != 0 {
+		group := balanceGroup(chain[0], chain[1:len(chain)-1], weights, chain[len(chain)-1])
+		for i := range group.to {
+			flows = append(flows, groupBucket(group, i, hopAction(strconv.Itoa(f.ports[chain[0].id]), "")))
+		}
+		return f.withForward(chain, flows), nil
+	}
+
+	for _, hop := range chainFlows(chain, symmetric) {
+		flows = append(flows, ofctlFlow(hopMatch(hop),
+			[]string{"mod_dl_dst:" + hop.to.mac, hopAction(strconv.Itoa(f.ports[hop.from.id]), "")}))
+	}
+	return f.withForward(chain, flows), nil
+}
+
+func (f *fakeCManager) withForward(chain []*Node, flows []string) map[string][]string {
+	routes := map[string][]string{chain[0].mac: flows}
+	if snode := chain[len(chain)-1]; f.tunnel != "" {
+		routes[snode.mac] = []string{forwardFlow(snode.mac, f.tunnel)}
+	}
+	return routes
+}
+
+func (f *fakeCManager) PurgeRoutes(mac string) error {
+	delete(f.flows, mac)
+	return nil
+}
+
+func (f *fakeCManager) SetLimit(node *Node, limit Limit) error {
+	if _, ok := f.conts[node.id]; !ok {
+		return ErrIdNotExists
+	}
+	if limit.none() {
+		delete(f.limits, node.id)
+	} else {
+		f.limits[node.id] = limit
+	}
+	return nil
+}
+
+func (f *fakeCManager) SetResources(node *Node, res Resources) error {
+	if _, ok := f.conts[node.id]; !ok {
+		return ErrIdNotExists
+	}
+	f.res[node.id] = res
+	return nil
+}
+
+func (f *fakeCManager) start(host string) (*Node, error) {
+	if host != "h1" {
+		return nil, ErrHostNotFound
+	}
+
+	f.count++
+	node := NewNode(fmt.Sprintf("c%d", f.count), fmt.Sprintf("10.10.0.%d", f.count),
+		fmt.Sprintf("%s:00:00:%02x", MAC_PREFIX, f.count), host)
+	f.conts[node.id] = node
+	return node, nil
+}
+
+func testHandler(t *testing.T) (*VoipHandler, *fakeCManager) {
+	cmgr := newFakeCManager()
+	return testHandlerWith(t, "", cmgr), cmgr
+}
+
+// extra is appended to the test config
+func testHandlerWith(t *testing.T, extra string, cmgr CManager) *VoipHandler {
+	config, err := goconfig.LoadFromData([]byte(testConfig + extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vh, err := NewVoipHandlerWith(config, cmgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vh
+}
+
+func apiCall(t *testing.T, api *HttpApi, method, path, body string) (int, *apiResult) {
+	r, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+
+	res := &apiResult{}
+	if w.Body.Len() != 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatalf("invalid json response %q: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, res
+}
+
+func TestHttpApi(t *testing.T) {
+	vh, cmgr := testHandler(t)
+	api := NewHttpApi(vh)
+
+	code, server := apiCall(t, api, "POST", "/voip/servers", `{"host": "h1", "shares": 512}`)
+	if code != http.StatusCreated || server.Id == "" {
+		t.Fatalf("unable to start server: %d %+v", code, server)
+	}
+	_, snort := apiCall(t, api, "POST", "/voip/snorts", `{"shares": 512}`)
+	_, client := apiCall(t, api, "POST", "/voip/clients",
+		fmt.Sprintf(`{"shares": 256, "server": %q}`, server.Id))
+	if snort.Id == "" || client.Id == "" {
+		t.Fatalf("unable to start snort/client: %+v %+v", snort, client)
+	}
+
+	code, _ = apiCall(t, api, "POST", "/voip/routes",
+		fmt.Sprintf(`{"client": %q, "router": %q, "server": %q}`, client.Id, snort.Id, server.Id))
+	if code != http.StatusNoContent {
+		t.Errorf("expected %d for route, got %d", http.StatusNoContent, code)
+	}
+
+	code, res := apiCall(t, api, "GET", "/voip/containers?role=client", "")
+	if code != http.StatusOK || len(res.Nodes) != 1 || res.Nodes[0].Id != client.Id {
+		t.Errorf("expected only client %s, got %d %+v", client.Id, code, res.Nodes)
+	}
+	code, res = apiCall(t, api, "GET", "/voip/containers/"+snort.Id, "")
+	if code != http.StatusOK || res.Node == nil {
+		t.Fatalf("unable to get snort %s: %d %+v", snort.Id, code, res)
+	}
+	if n := res.Node; n.Role != ROLE_SNORT || n.Shares != 512 || n.Reference != 5000 ||
+		len(n.Chains) != 1 || n.Chains[0].Client != client.Id {
+		t.Errorf("unexpected snort info %+v", n)
+	}
+
+	_, snort2 := apiCall(t, api, "POST", "/voip/snorts", `{"shares": 512}`)
+	code, chain := apiCall(t, api, "POST", "/voip/chains",
+		fmt.Sprintf(`{"client": %q, "hops": [%q, %q], "server": %q}`, client.Id, snort.Id, snort2.Id, server.Id))
+	if code != http.StatusCreated || chain.Id == "" {
+		t.Fatalf("unable to create chain: %d %+v", code, chain)
+	}
+	code, _ = apiCall(t, api, "DELETE", "/voip/chains/"+chain.Id+"/hops/"+snort2.Id, "")
+	if code != http.StatusNoContent {
+		t.Errorf("expected %d for hop removal, got %d", http.StatusNoContent, code)
+	}
+	code, res = apiCall(t, api, "GET", "/voip/chains/"+chain.Id, "")
+	if code != http.StatusOK || res.Chain == nil || len(res.Chain.Hops) != 1 || res.Chain.Hops[0] != snort.Id {
+		t.Errorf("expected chain through %s only, got %d %+v", snort.Id, code, res.Chain)
+	}
+
+	code, _ = apiCall(t, api, "DELETE", "/voip/containers/"+snort.Id, "")
+	if code != http.StatusNoContent || cmgr.conts[snort.Id] != nil {
+		t.Errorf("snort %s not stopped, status %d", snort.Id, code)
+	}
+}
+
+func TestHttpApiErrors(t *testing.T) {
+	vh, _ := testHandler(t)
+	api := NewHttpApi(vh)
+
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/voip/servers", `{"host": "h1"}`, http.StatusBadRequest},
+		{"POST", "/voip/servers", `{"host": "h1", "shares": "x"}`, http.StatusBadRequest},
+		{"POST", "/voip/servers", `{"host": "h1", `, http.StatusBadRequest},
+		{"POST", "/voip/servers", `null`, http.StatusBadRequest},
+		{"PUT", "/voip/clients/c42/rate", `null`, http.StatusBadRequest},
+		{"POST", "/voip/servers", `{"host": null, "shares": 512}`, http.StatusBadRequest},
+		{"POST", "/voip/servers", `{"host": "h1", "shares": {"cpu": 512}}`, http.StatusBadRequest},
+		{"POST", "/voip/chains", `{"client": "c1", "hops": ["c2", null], "server": "c3"}`, http.StatusBadRequest},
+		{"POST", "/voip/servers", `{"host": "h9", "shares": 1}`, http.StatusNotFound},
+		{"GET", "/voip/servers", ``, http.StatusMethodNotAllowed},
+		{"POST", "/voip/things", `{}`, http.StatusNotFound},
+		{"DELETE", "/voip/containers/c42", ``, http.StatusNotFound},
+		{"GET", "/voip/containers/c42", ``, http.StatusNotFound},
+		{"PUT", "/voip/clients/c42/rate", `{"rate": 10}`, http.StatusNotFound},
+		{"GET", "/voip/chains/chain-42", ``, http.StatusNotFound},
+		{"POST", "/voip/chains/chain-42/hops", `{"hop": "c1"}`, http.StatusNotFound},
+		{"POST", "/voip/chains", `{"client": "c1"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		code, res := apiCall(t, api, test.method, test.path, test.body)
+		if code != test.code || res.Error == "" {
+			t.Errorf("%s %s %s: expected %d with error, got %d %+v",
+				test.method, test.path, test.body, test.code, code, res)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package voip
+
+import (
+	"github.com/Unknwon/goconfig"
+	"github.com/mangalaman93/nfs/pkg/ipam"
+)
+
+const (
+	DEF_SUBNET = "173.16.1.0/24"
+)
+
+// reads optional [VOIP.IPAM] section, each key is a host of VOIP.TOPO
+// with its subnet as value, key default applies to all other hosts
+func NewIPAM(config *goconfig.ConfigFile) (*ipam.IPAM, error) {
+	a := ipam.New()
+	err := a.AddSubnet("", config.MustValue("VOIP.IPAM", "default", DEF_SUBNET))
+	if err != nil {
+		return nil, err
+	}
+
+	topo := make(map[string]bool)
+	for _, host := range config.GetKeyList("VOIP.TOPO") {
+		topo[host] = true
+	}
+	for _, host := range config.GetKeyList("VOIP.IPAM") {
+		if host == "default" {
+			continue
+		}
+		if !topo[host] {
+			return nil, ErrHostNotFound
+		}
+
+		cidr, err := config.GetValue("VOIP.IPAM", host)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.AddSubnet(host, cidr); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,502 @@
+package voip
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	K8S_TOKEN_FILE     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	K8S_NETWORK_STATUS = "k8s.v1.cni.cncf.io/network-status"
+	K8S_CONTAINER      = "nf"
+	K8S_POLL_INTERVAL  = 200 // ms
+	K8S_MERGE_PATCH    = "application/strategic-merge-patch+json"
+)
+
+var (
+	ErrK8sNotFound   = errors.New("kubernetes object not found")
+	ErrPodNotReady   = errors.New("pod didn't get to run in time")
+	ErrInvalidCACert = errors.New("no certificates found in ca file")
+)
+
+// K8sCManager runs NFs as pods of a single container, pinned to the
+// nodes named in VOIP.TOPO. Shares are requests of cpu and the quota its
+// limit, they are resized in place on clusters which support it as long
+// as the qos class of the pod stays, e.g. a pod started without memory
+// gets none later unless its quota differs from its shares. Pods are
+// on the network of the cluster which nfs can't steer, so chains and
+// limits are not supported. The mac of a pod is known only if the CNI
+// reports it in the network-status annotation of multus.
+type K8sCManager struct {
+	server    string
+	token     string
+	namespace string
+	client    *http.Client
+	hmap      map[string]string
+	catalog   Catalog
+}
+
+// reads [VOIP.K8S] section, the token defaults to that of the service
+// account the controller runs as:
+//
+//	[VOIP.K8S]
+//	server=https://10.0.0.1:6443
+//	namespace=nfs
+//	ca_file=/etc/kubernetes/pki/ca.crt
+func NewK8sCManager(config *goconfig.ConfigFile) (*K8sCManager, error) {
+	hosts := config.GetKeyList("VOIP.TOPO")
+	if hosts == nil {
+		return nil, ErrNoHosts
+	}
+
+	server, err := config.GetValue("VOIP.K8S", "server")
+	if err != nil {
+		return nil, err
+	}
+	token := config.MustValue("VOIP.K8S", "token", "")
+	if token == "" {
+		data, err := ioutil.ReadFile(config.MustValue("VOIP.K8S", "token_file", K8S_TOKEN_FILE))
+		if err == nil {
+			token = strings.TrimSpace(string(data))
+		}
+	}
+
+	tlsconf := &tls.Config{InsecureSkipVerify: config.MustBool("VOIP.K8S", "insecure", false)}
+	if file := config.MustValue("VOIP.K8S", "ca_file", ""); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		tlsconf.RootCAs = x509.NewCertPool()
+		if !tlsconf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidCACert
+		}
+	}
+
+	catalog, err := NewCatalog(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hmap := make(map[string]string)
+	for _, host := range hosts {
+		address, err := config.GetValue("VOIP.TOPO", host)
+		if err != nil {
+			return nil, err
+		}
+		hmap[host] = address
+	}
+
+	return &K8sCManager{
+		server:    strings.TrimSuffix(server, "/"),
+		token:     token,
+		namespace: config.MustValue("VOIP.K8S", "namespace", "default"),
+		client: &http.Client{
+			Timeout:   WAIT_FOR_START * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsconf},
+		},
+		hmap:    hmap,
+		catalog: catalog,
+	}, nil
+}
+
+// hosts are names of the nodes of the cluster
+func (k *K8sCManager) Setup() error {
+	for host := range k.hmap {
+		if err := k.do("GET", "/api/v1/nodes/"+host, "", nil, nil); err == ErrK8sNotFound {
+			log.Println("[WARN] node", host, "not found in the cluster")
+			return ErrHostNotFound
+		} else if err != nil {
+			return err
+		}
+		log.Println("[INFO] added host", host)
+	}
+	return nil
+}
+
+func (k *K8sCManager) Destroy() {}
+
+// labels of the pod tell what it is, as for docker
+func (k *K8sCManager) StartNF(kind, host string, res Resources, params map[string]string) (*Node, error) {
+	if _, ok := k.hmap[host]; !ok {
+		return nil, ErrHostNotFound
+	}
+	nf, err := k.catalog.Get(kind)
+	if err != nil {
+		return nil, err
+	}
+	env, cmd, err := nf.expand(params)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := k8sResourcesOf(res)
+	if err != nil {
+		return nil, err
+	}
+
+	cont := k8sContainer{
+		Name:      K8S_CONTAINER,
+		Image:     nf.Image,
+		Args:      cmd,
+		Env:       make([]k8sEnv, 0, len(env)),
+		Resources: resources,
+		ResizePolicy: []k8sResizePolicy{
+			{ResourceName: "cpu", RestartPolicy: "NotRequired"},
+			{ResourceName: "memory", RestartPolicy: "NotRequired"},
+		},
+	}
+	for _, kv := range envList(env) {
+		parts := strings.SplitN(kv, "=", 2)
+		cont.Env = append(cont.Env, k8sEnv{Name: parts[0], Value: parts[1]})
+	}
+	if len(nf.CapAdd) != 0 {
+		cont.SecurityContext = &k8sSecurity{Capabilities: &k8sCapabilities{Add: nf.CapAdd}}
+	}
+
+	pod := &k8sPod{
+		Metadata: k8sMeta{
+			Name:   fmt.Sprintf("%s-%s", podName(nf.Name), uuid.NewV1()),
+			Labels: nf.labels(),
+		},
+		Spec: k8sPodSpec{
+			NodeName:      host,
+			RestartPolicy: "Never",
+			Containers:    []k8sContainer{cont},
+		},
+	}
+
+	undo := true
+	if err := k.do("POST", k.pods(""), "application/json", pod, nil); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if undo {
+			k.do("DELETE", k.pods(pod.Metadata.Name), "", nil, nil)
+		}
+	}()
+	log.Println("[INFO] created pod", pod.Metadata.Name, "on node", host)
+
+	pod, err = k.waitRunning(pod.Metadata.Name)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("[INFO] started pod", pod.Metadata.Name, "ip:", pod.Status.PodIP)
+
+	undo = false
+	return NewNode(pod.Metadata.Name, pod.Status.PodIP, podMac(pod), host), nil
+}
+
+// the pod is gone already if it is not found
+func (k *K8sCManager) StopCont(node *Node) error {
+	err := k.do("DELETE", k.pods(node.id)+"?gracePeriodSeconds="+strconv.Itoa(STOP_TIMEOUT), "", nil, nil)
+	if err != nil && err != ErrK8sNotFound {
+		log.Println("[WARN] unable to delete pod", node.id, err)
+		return err
+	}
+
+	log.Println("[INFO] pod", node.id, "deleted")
+	return nil
+}
+
+func (k *K8sCManager) Adopt(node *Node) error {
+	pod := &k8sPod{}
+	err := k.do("GET", k.pods(node.id), "", nil, pod)
+	if err == ErrK8sNotFound {
+		return ErrNotRunning
+	} else if err != nil {
+		return err
+	}
+	if pod.Status.Phase != "Running" {
+		return ErrNotRunning
+	}
+
+	log.Println("[INFO] adopted pod", node.id, "ip:", node.ip)
+	return nil
+}
+
+// pods on nodes which are not hosts are left alone
+func (k *K8sCManager) List() ([]*Node, error) {
+	pods := &k8sPodList{}
+	if err := k.do("GET", k.pods("")+"?labelSelector="+LABEL_KIND, "", nil, pods); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*Node, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		if _, ok := k.hmap[pod.Spec.NodeName]; ok {
+			nodes = append(nodes, &Node{id: pod.Metadata.Name, host: pod.Spec.NodeName})
+		}
+	}
+	return nodes, nil
+}
+
+func (k *K8sCManager) Route(chain []*Node, symmetric bool) error {
+	return ErrRouteNotSupported
+}
+
+func (k *K8sCManager) Balance(cnode *Node, replicas []*Node, weights []int64, snode *Node) error {
+	return ErrRouteNotSupported
+}
+
+func (k *K8sCManager) DeRoute(chain []*Node) error {
+	return nil
+}
+
+func (k *K8sCManager) Routes() (map[string][]string, error) {
+	return nil, nil
+}
+
+func (k *K8sCManager) ChainRoutes(chain []*Node, symmetric bool, weights []int64) (map[string][]string, error) {
+	return nil, nil
+}
+
+func (k *K8sCManager) PurgeRoutes(mac string) error {
+	return nil
+}
+
+func (k *K8sCManager) SetLimit(node *Node, limit Limit) error {
+	return ErrLimitNotSupported
+}
+
+// in place with the resize subresource, clusters before it
+// (with InPlacePodVerticalScaling) take a patch of the pod
+func (k *K8sCManager) SetResources(node *Node, res Resources) error {
+	resources, err := k8sResourcesOf(res)
+	if err != nil {
+		return err
+	}
+	// kubernetes refuses to change the qos class of a running pod
+	if res.Memory != node.res.Memory && k8sQos(res) != k8sQos(node.res) {
+		return ErrResNotSupported
+	}
+
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []map[string]interface{}{
+				{"name": K8S_CONTAINER, "resources": resources},
+			},
+		},
+	}
+	err = k.do("PATCH", k.pods(node.id)+"/resize", K8S_MERGE_PATCH, patch, nil)
+	if err == ErrK8sNotFound {
+		err = k.do("PATCH", k.pods(node.id), K8S_MERGE_PATCH, patch, nil)
+	}
+	if err != nil {
+		log.Println("[WARN] unable to resize pod", node.id, err)
+		return err
+	}
+
+	log.Println("[INFO] set resources for pod", node.id, "to", res)
+	return nil
+}
+
+func (k *K8sCManager) waitRunning(name string) (*k8sPod, error) {
+	timeout := time.After(WAIT_FOR_START * time.Second)
+	for {
+		pod := &k8sPod{}
+		if err := k.do("GET", k.pods(name), "", nil, pod); err != nil {
+			return nil, err
+		}
+		switch pod.Status.Phase {
+		case "Running":
+			if pod.Status.PodIP != "" {
+				return pod, nil
+			}
+		case "Succeeded", "Failed":
+			return nil, ErrNotRunning
+		}
+
+		select {
+		case <-timeout:
+			return nil, ErrPodNotReady
+		case <-time.After(K8S_POLL_INTERVAL * time.Millisecond):
+		}
+	}
+}
+
+// path of the pod, or of all the pods if name is empty
+func (k *K8sCManager) pods(name string) string {
+	p := "/api/v1/namespaces/" + k.namespace + "/pods"
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// in is sent as json of the content type, out is read from the response if given
+func (k *K8sCManager) do(method, path, ctype string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, k.server+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", ctype)
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrK8sNotFound
+	case resp.StatusCode >= 300:
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, status.Message)
+	case out != nil:
+		return json.NewDecoder(resp.Body).Decode(out)
+	default:
+		return nil
+	}
+}
+
+// cpu in millicores, the shares are requested and the quota is the limit
+func k8sResourcesOf(res Resources) (k8sResources, error) {
+	if res.Cpuset != "" || res.BlkioWeight != 0 || res.NetPrio != 0 {
+		return k8sResources{}, ErrResNotSupported
+	}
+
+	r := k8sResources{
+		Requests: map[string]string{"cpu": fmt.Sprintf("%dm", res.Shares*1000/1024)},
+		Limits:   map[string]string{"cpu": fmt.Sprintf("%dm", res.quota()*1000/CPU_PERIOD)},
+	}
+	if res.Memory != 0 {
+		r.Requests["memory"] = strconv.FormatInt(res.Memory, 10)
+		r.Limits["memory"] = strconv.FormatInt(res.Memory, 10)
+	}
+	return r, nil
+}
+
+// pods are Guaranteed if they request all the cpu and
+// memory they are limited to, Burstable otherwise
+func k8sQos(res Resources) string {
+	r, err := k8sResourcesOf(res)
+	if err == nil && res.Memory != 0 && r.Requests["cpu"] == r.Limits["cpu"] {
+		return "Guaranteed"
+	}
+	return "Burstable"
+}
+
+// names of pods are lower case letters, digits and dashes
+func podName(prefix string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, prefix)
+}
+
+// mac of the default network, empty if the CNI doesn't say
+func podMac(pod *k8sPod) string {
+	var status []struct {
+		Mac     string `json:"mac"`
+		Default bool   `json:"default"`
+	}
+	if err := json.Unmarshal([]byte(pod.Metadata.Annotations[K8S_NETWORK_STATUS]), &status); err != nil {
+		return ""
+	}
+	for _, s := range status {
+		if s.Default {
+			return s.Mac
+		}
+	}
+	return ""
+}
+
+// the parts of the pod api we use
+type k8sPod struct {
+	Metadata k8sMeta      `json:"metadata"`
+	Spec     k8sPodSpec   `json:"spec"`
+	Status   k8sPodStatus `json:"status"`
+}
+
+type k8sPodList struct {
+	Items []k8sPod `json:"items"`
+}
+
+type k8sMeta struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type k8sPodSpec struct {
+	NodeName      string         `json:"nodeName"`
+	RestartPolicy string         `json:"restartPolicy"`
+	Containers    []k8sContainer `json:"containers"`
+}
+
+type k8sPodStatus struct {
+	Phase string `json:"phase,omitempty"`
+	PodIP string `json:"podIP,omitempty"`
+}
+
+type k8sContainer struct {
+	Name            string            `json:"name"`
+	Image           string            `json:"image"`
+	Args            []string          `json:"args,omitempty"`
+	Env             []k8sEnv          `json:"env,omitempty"`
+	Resources       k8sResources      `json:"resources"`
+	ResizePolicy    []k8sResizePolicy `json:"resizePolicy,omitempty"`
+	SecurityContext *k8sSecurity      `json:"securityContext,omitempty"`
+}
+
+type k8sEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type k8sResources struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+type k8sResizePolicy struct {
+	ResourceName  string `json:"resourceName"`
+	RestartPolicy string `json:"restartPolicy"`
+}
+
+type k8sSecurity struct {
+	Capabilities *k8sCapabilities `json:"capabilities,omitempty"`
+}
+
+type k8sCapabilities struct {
+	Add []string `json:"add,omitempty"`
+}
@@ -0,0 +1,181 @@
+package voip
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Unknwon/goconfig"
+)
+
+// fakeK8s is an api server keeping pods in memory, they run as soon as
+// they are created. Without resize the subresource is not found.
+type fakeK8s struct {
+	sync.Mutex
+	pods    map[string]*k8sPod
+	resize  bool
+	patches []string
+}
+
+func (f *fakeK8s) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.URL.Path == "/api/v1/nodes/h1" {
+		w.Write([]byte(`{"metadata":{"name":"h1"}}`))
+		return
+	}
+	const prefix = "/api/v1/namespaces/nfs/pods"
+	if !strings.HasPrefix(r.URL.Path, prefix) || r.Header.Get("Authorization") != "Bearer secret" {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	switch {
+	case r.Method == "POST" && name == "":
+		pod := &k8sPod{}
+		json.NewDecoder(r.Body).Decode(pod)
+		pod.Status = k8sPodStatus{Phase: "Running", PodIP: "10.244.0.5"}
+		pod.Metadata.Annotations = map[string]string{
+			K8S_NETWORK_STATUS: `[{"name":"cbr0","mac":"0a:58:0a:f4:00:05","default":true}]`,
+		}
+		f.pods[pod.Metadata.Name] = pod
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pod)
+	case r.Method == "PATCH":
+		if strings.HasSuffix(name, "/resize") {
+			if !f.resize {
+				http.NotFound(w, r)
+				return
+			}
+			name = strings.TrimSuffix(name, "/resize")
+		}
+		pod, ok := f.pods[name]
+		if !ok || r.Header.Get("Content-Type") != K8S_MERGE_PATCH {
+			http.NotFound(w, r)
+			return
+		}
+		patch := &k8sPod{}
+		json.NewDecoder(r.Body).Decode(patch)
+		pod.Spec.Containers[0].Resources = patch.Spec.Containers[0].Resources
+		f.patches = append(f.patches, r.URL.Path)
+		json.NewEncoder(w).Encode(pod)
+	case r.Method == "GET" && name == "":
+		list := &k8sPodList{Items: make([]k8sPod, 0)}
+		for _, pod := range f.pods {
+			if _, ok := pod.Metadata.Labels[r.URL.Query().Get("labelSelector")]; ok {
+				list.Items = append(list.Items, *pod)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case f.pods[name] == nil:
+		http.NotFound(w, r)
+	case r.Method == "GET":
+		json.NewEncoder(w).Encode(f.pods[name])
+	case r.Method == "DELETE":
+		delete(f.pods, name)
+		w.Write([]byte(`{}`))
+	}
+}
+
+func TestK8sCManager(t *testing.T) {
+	fake := &fakeK8s{pods: make(map[string]*k8sPod), resize: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config, err := goconfig.LoadFromData([]byte(testConfig + `
+[VOIP.K8S]
+server=` + server.URL + `
+token=secret
+namespace=nfs
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewK8sCManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.StartNF(ROLE_SNORT, "h2", Resources{Shares: 1024}, nil); err != ErrHostNotFound {
+		t.Errorf("expected %v, got %v", ErrHostNotFound, err)
+	}
+	if _, err := k.StartNF(ROLE_SNORT, "h1", Resources{Shares: 1024, NetPrio: 1}, nil); err != ErrResNotSupported {
+		t.Errorf("expected %v, got %v", ErrResNotSupported, err)
+	}
+
+	node, err := k.StartNF(ROLE_SNORT, "h1", Resources{Shares: 512, Memory: MIN_MEMORY}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Ip() != "10.244.0.5" || node.Mac() != "0a:58:0a:f4:00:05" || node.Host() != "h1" {
+		t.Errorf("expected pod ip and mac on h1, got %s %s %s", node.Ip(), node.Mac(), node.Host())
+	}
+	pod := fake.pods[node.Id()]
+	if pod == nil || pod.Spec.NodeName != "h1" || pod.Metadata.Labels[LABEL_KIND] != ROLE_SNORT {
+		t.Fatalf("expected snort pod on node h1, got %+v", pod)
+	}
+	res := pod.Spec.Containers[0].Resources
+	if res.Requests["cpu"] != "500m" || res.Limits["cpu"] != "500m" || res.Limits["memory"] != "4194304" {
+		t.Errorf("expected half a cpu and 4MB, got %+v", res)
+	}
+
+	if err := k.SetResources(node, Resources{Shares: 2048, Quota: 150000}); err != nil {
+		t.Fatal(err)
+	}
+	res = fake.pods[node.Id()].Spec.Containers[0].Resources
+	if res.Requests["cpu"] != "2000m" || res.Limits["cpu"] != "1500m" {
+		t.Errorf("expected resized cpu, got %+v", res)
+	}
+	fake.resize = false
+	if err := k.SetResources(node, Resources{Shares: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.patches) != 2 || fake.patches[0] != k.pods(node.Id())+"/resize" || fake.patches[1] != k.pods(node.Id()) {
+		t.Errorf("expected resize and then patch of the pod, got %v", fake.patches)
+	}
+
+	// memory would make the burstable pod guaranteed
+	node2, err := k.StartNF(ROLE_SNORT, "h1", Resources{Shares: 1024}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node2.res = Resources{Shares: 1024}
+	if err := k.SetResources(node2, Resources{Shares: 1024, Memory: MIN_MEMORY}); err != ErrResNotSupported {
+		t.Errorf("expected %v, got %v", ErrResNotSupported, err)
+	}
+	if err := k.SetResources(node2, Resources{Shares: 1024, Quota: 150000, Memory: MIN_MEMORY}); err != nil {
+		t.Errorf("expected memory of a pod staying burstable to be set, got %v", err)
+	}
+	k.StopCont(node2)
+
+	if err := k.Route([]*Node{node, node}, false); err != ErrRouteNotSupported {
+		t.Errorf("expected %v, got %v", ErrRouteNotSupported, err)
+	}
+	if err := k.Adopt(node); err != nil {
+		t.Error(err)
+	}
+	nodes, err := k.List()
+	if err != nil || len(nodes) != 1 || nodes[0].id != node.id || nodes[0].host != "h1" {
+		t.Errorf("expected the pod on h1, got %v %v", nodes, err)
+	}
+	if err := k.StopCont(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Adopt(node); err != ErrNotRunning {
+		t.Errorf("expected %v, got %v", ErrNotRunning, err)
+	}
+}
+
+func TestPodName(t *testing.T) {
+	if name := podName("Snort_3.x"); name != "snort-3-x" {
+		t.Errorf("expected snort-3-x, got %s", name)
+	}
+}
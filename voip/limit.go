@@ -0,0 +1,110 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const (
+	// bursts allow this many ms of traffic at the limit
+	LIMIT_BURST  = 100
+	MIN_BURST_KB = 16 // a full sized packet
+	POLICE_PRIO  = 1
+)
+
+var (
+	ErrNotClient    = errors.New("container is not a client")
+	ErrInvalidLimit = errors.New("limits can't be negative, pps are whole thousands with ovs")
+)
+
+// Limit is enforced by the network on the traffic sent by a client,
+// independent of the rate the traffic generator is set to. Zero means
+// no limit, a Limit with both zero removes the limits of the client.
+type Limit struct {
+	Kbps int64 `json:"kbps,omitempty"`
+	Pps  int64 `json:"pps,omitempty"`
+}
+
+func (l Limit) none() bool {
+	return l.Kbps == 0 && l.Pps == 0
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%dkbps %dpps", l.Kbps, l.Pps)
+}
+
+func (l Limit) burstKb() int64 {
+	burst := l.Kbps * LIMIT_BURST / 1000
+	if burst < MIN_BURST_KB {
+		burst = MIN_BURST_KB
+	}
+	return burst
+}
+
+func (l Limit) burstPkts() int64 {
+	burst := l.Pps * LIMIT_BURST / 1000
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
+
+// kbps and pps are optional, a missing one is not limited
+func (vh *VoipHandler) setLimit(req *Request) *Response {
+	kv := req.KeyVal
+	client, ok := kv["client"]
+	if !ok {
+		return errResponse(ErrKeyNotFound)
+	}
+
+	cnode, ok := vh.anodes[client]
+	if !ok {
+		return errResponse(ErrIdNotExists)
+	} else if cnode.role != ROLE_CLIENT {
+		return errResponse(ErrNotClient)
+	}
+
+	var limit Limit
+	var err error
+	if skbps, ok := kv["kbps"]; ok {
+		if limit.Kbps, err = strconv.ParseInt(skbps, 10, 64); err != nil {
+			return errResponse(err)
+		}
+	}
+	if spps, ok := kv["pps"]; ok {
+		if limit.Pps, err = strconv.ParseInt(spps, 10, 64); err != nil {
+			return errResponse(err)
+		}
+	}
+	if limit.Kbps < 0 || limit.Pps < 0 {
+		return errResponse(ErrInvalidLimit)
+	}
+
+	if err := vh.cmgr.SetLimit(cnode, limit); err != nil {
+		return errResponse(err)
+	}
+	if limit.none() {
+		delete(vh.limits, cnode.id)
+	} else {
+		vh.limits[cnode.id] = limit
+	}
+
+	log.Println("[INFO] set limit of client", cnode.id, "to", limit)
+	return &Response{}
+}
+
+// the limits of clients adopted from an earlier run are applied again
+// as the container may have been connected to the network again
+func (vh *VoipHandler) restoreLimit(node *Node, limit *Limit) {
+	if limit == nil || limit.none() {
+		return
+	}
+
+	if err := vh.cmgr.SetLimit(node, *limit); err != nil {
+		log.Println("[WARN] unable to restore limit of client", node.id, err)
+		return
+	}
+	vh.limits[node.id] = *limit
+}
@@ -0,0 +1,88 @@
+package voip
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	extra := "\n[VOIP]\nstate_file=" + filepath.Join(dir, "state.json") + "\n"
+
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, extra, cmgr)
+	if err := vh.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	request(t, vh, ReqSetLimit, map[string]string{"client": client, "kbps": "2000"})
+	if l := cmgr.limits[client]; l.Kbps != 2000 || l.Pps != 0 {
+		t.Errorf("expected 2000kbps without pps limit, got %v", l)
+	}
+
+	api := NewHttpApi(vh)
+	if code, _ := apiCall(t, api, "PUT", "/voip/clients/"+client+"/limit", `{"kbps": 1000, "pps": 50}`); code != http.StatusNoContent {
+		t.Errorf("expected %d, got %d", http.StatusNoContent, code)
+	}
+	_, res := apiCall(t, api, "GET", "/voip/containers/"+client, "")
+	if res.Node == nil || res.Node.Limit == nil || *res.Node.Limit != (Limit{Kbps: 1000, Pps: 50}) {
+		t.Errorf("expected limit in node info, got %+v", res.Node)
+	}
+	for _, body := range []string{`{"pps": -1}`, `{"kbps": "x"}`} {
+		if code, _ := apiCall(t, api, "PUT", "/voip/clients/"+client+"/limit", body); code != http.StatusBadRequest {
+			t.Errorf("expected %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+	if code, _ := apiCall(t, api, "PUT", "/voip/clients/"+server+"/limit", `{"pps": 1}`); code != http.StatusBadRequest {
+		t.Errorf("expected %d for server, got %d", http.StatusBadRequest, code)
+	}
+
+	// limits are applied again when the controller restarts
+	cmgr.limits = make(map[string]Limit)
+	vh = testHandlerWith(t, extra, cmgr)
+	if err := vh.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if l := cmgr.limits[client]; l.Kbps != 1000 || l.Pps != 50 {
+		t.Errorf("expected limit restored, got %v", l)
+	}
+
+	request(t, vh, ReqSetLimit, map[string]string{"client": client, "kbps": "0", "pps": "0"})
+	if _, ok := cmgr.limits[client]; ok || len(vh.limits) != 0 {
+		t.Errorf("expected limit removed, got %v", vh.limits)
+	}
+}
+
+func TestPolicing(t *testing.T) {
+	columns, err := policing(Limit{Kbps: 1000, Pps: 2000})
+	if err != nil || columns["ingress_policing_rate"] != 1000 || columns["ingress_policing_burst"] != 100 ||
+		columns["ingress_policing_kpkts_rate"] != 2 || columns["ingress_policing_kpkts_burst"] != 1 {
+		t.Errorf("unexpected policing columns %v %v", columns, err)
+	}
+	// 100 pps would be policed as 1000
+	if _, err := policing(Limit{Pps: 100}); err != ErrInvalidLimit {
+		t.Errorf("expected %v for 100 pps, got %v", ErrInvalidLimit, err)
+	}
+	columns, _ = policing(Limit{})
+	for column, value := range columns {
+		if value != 0 {
+			t.Errorf("expected %s removed, got %d", column, value)
+		}
+	}
+
+	actions := policeActions(Limit{Kbps: 64, Pps: 100})
+	expected := " action police rate 64kbit burst 2000 conform-exceed drop/pipe" +
+		" action police pkt_rate 100 pkt_burst 10 conform-exceed drop/continue"
+	if actions != expected {
+		t.Errorf("expected %q, got %q", expected, actions)
+	}
+}
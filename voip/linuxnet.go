@@ -0,0 +1,307 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	DEF_LINUX_BRIDGE = "nfsbr"
+)
+
+var (
+	ErrIprouteNotFound = errors.New("iproute2 is not installed")
+)
+
+// linuxNetwork connects the containers to a linux bridge with veth pairs.
+// The host end of a veth is tagged with the mac of the container as its
+// alias. Routes are tc flower filters on the ingress of the host end which
+// rewrite the destination mac, the bridge then switches to the next hop.
+type linuxNetwork struct {
+	bridge string
+}
+
+func newLinuxNetwork(config *goconfig.ConfigFile) *linuxNetwork {
+	l := &linuxNetwork{
+		bridge: config.MustValue("VOIP.NETWORK", "bridge", DEF_LINUX_BRIDGE),
+	}
+	log.Println("[INFO] using linux bridge", l.bridge)
+	return l
+}
+
+func (l *linuxNetwork) init(addr, gateway string, bits int) error {
+	for _, tool := range []string{"ip", "tc"} {
+		out, err := runshAt(addr, "which "+tool)
+		if err != nil || string(out) == "" {
+			return ErrIprouteNotFound
+		}
+	}
+
+	undo := true
+	_, err := runshAt(addr, "ip link show "+l.bridge+" || sudo ip link add "+l.bridge+" type bridge")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if undo {
+			l.destroy(addr)
+		}
+	}()
+
+	cmd := "sudo ip link set " + l.bridge + " up"
+	if gateway != "" {
+		cmd = "sudo ip addr replace " + gateway + "/" + strconv.Itoa(bits) + " dev " + l.bridge + " && " + cmd
+	}
+	_, err = runshAt(addr, cmd)
+	if err != nil {
+		return err
+	}
+	log.Println("[INFO] created linux bridge", l.bridge, "on", hostName(addr))
+
+	undo = false
+	return nil
+}
+
+func (l *linuxNetwork) destroy(addr string) {
+	runshAt(addr, "sudo ip link del "+l.bridge)
+	log.Println("[INFO] deleted linux bridge on", hostName(addr))
+}
+
+// veth pair with one end in the container and the other on the bridge
+func (l *linuxNetwork) setupNetwork(addr, id string, ns netns, ip string, bits int, mac string) error {
+	undo := true
+	lport, cport := vethNames(id)
+	_, err := runshAt(addr, "sudo ip link add "+lport+" type veth peer name "+cport)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if undo {
+			runshAt(addr, "sudo ip link del "+lport)
+		}
+	}()
+
+	_, err = runshAt(addr, "sudo ip link set "+lport+" master "+l.bridge+" alias "+mac+
+		" && sudo tc qdisc add dev "+lport+" ingress")
+	if err != nil {
+		return err
+	}
+	if err := moveVeth(addr, lport, cport, ns, ip, bits, mac); err != nil {
+		return err
+	}
+
+	undo = false
+	return nil
+}
+
+// the filters of the veth go along with it
+func (l *linuxNetwork) usetupNetwork(addr, id string) {
+	lport, _ := vethNames(id)
+	if _, err := runshAt(addr, "sudo ip link del "+lport); err != nil {
+		log.Println("[INFO] unable to remove interface from container", id, err)
+	} else {
+		log.Println("[INFO] removed interface from container", id)
+	}
+}
+
+// returns the host end of the only veth with the mac
+func (l *linuxNetwork) findMac(addr, mac string) (string, error) {
+	out, err := runshAt(addr, "ip -o link show master "+l.bridge)
+	if err != nil {
+		return "", err
+	}
+
+	ports := linksWithAlias(string(out), mac)
+	switch len(ports) {
+	case 0:
+		return "", ErrMacNotFound
+	case 1:
+		return ports[0], nil
+	default:
+		return "", ErrMacNotUnique
+	}
+}
+
+// names of the links in the output of ip -o link with the alias
+func linksWithAlias(out, alias string) []string {
+	links := make([]string, 0)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		for i := 2; i < len(fields)-1; i++ {
+			if fields[i] == "alias" && fields[i+1] == alias {
+				name := strings.TrimSuffix(fields[1], ":")
+				if at := strings.Index(name, "@"); at >= 0 {
+					name = name[:at]
+				}
+				links = append(links, name)
+				break
+			}
+		}
+	}
+	return links
+}
+
+// the bridge switches the packet to its new destination, there is no
+// overlay so the next hop is always on the same bridge
+func (l *linuxNetwork) route(addr string, hop *hopFlow) error {
+	port, err := l.findMac(addr, hop.from.mac)
+	if err != nil {
+		log.Println("[WARN] unable to find port of", hop.from.mac, err)
+		return err
+	}
+
+	nw := "src_ip"
+	if hop.reverse {
+		nw = "dst_ip"
+	}
+	_, err = runshAt(addr, fmt.Sprintf("sudo tc filter replace dev %s parent ffff: protocol ip "+
+		"prio %d handle %#x flower src_mac %s dst_mac %s %s %s action pedit ex munge eth dst set %s",
+		port, ROUTE_PRIORITY, filterHandle(hop.cookie, hop.reverse), hop.from.mac, hop.dst,
+		nw, hop.cip, hop.to.mac))
+	if err != nil {
+		log.Println("[WARN] unable to setup route for", hop.to.mac, err)
+		return err
+	}
+
+	return nil
+}
+
+// tc has no flow consistent hashing over next hops
+func (l *linuxNetwork) balance(addr string, group *hopGroup) error {
+	return ErrBalanceNotSupported
+}
+
+// a chain has at most one filter per direction on each port. Ports
+// without the filters of the client are not an error, so we ignore errors.
+func (l *linuxNetwork) deRoute(addr, cmac string) error {
+	cookie := chainCookie(cmac)
+	_, err := runshAt(addr, fmt.Sprintf("for port in $(ls /sys/class/net/%s/brif); do "+
+		"sudo tc filter del dev $port parent ffff: protocol ip prio %d handle %#x flower; "+
+		"sudo tc filter del dev $port parent ffff: protocol ip prio %d handle %#x flower; "+
+		"done 2>/dev/null; true", l.bridge, ROUTE_PRIORITY, filterHandle(cookie, false),
+		ROUTE_PRIORITY, filterHandle(cookie, true)))
+	if err != nil {
+		log.Println("[WARN] unable to de-setup route for", cmac, err)
+	}
+
+	return err
+}
+
+// filters of all the ports of the bridge
+func (l *linuxNetwork) routes(addr string) (map[string][]string, error) {
+	out, err := runshAt(addr, fmt.Sprintf("for port in $(ls /sys/class/net/%s/brif); do "+
+		"echo dev $port; sudo tc filter show dev $port parent ffff:; done", l.bridge))
+	if err != nil {
+		return nil, err
+	}
+	return parseRouteFilters(string(out)), nil
+}
+
+// filters of the hop are on the port of the container it comes from,
+// which is a new one once the container is restarted
+func (l *linuxNetwork) hopRoute(addr string, hop *hopFlow) (string, error) {
+	port, err := l.findMac(addr, hop.from.mac)
+	if err != nil {
+		return "", err
+	}
+	return filterRoute(port, filterHandle(hop.cookie, hop.reverse)), nil
+}
+
+func (l *linuxNetwork) groupRoutes(addr string, group *hopGroup) ([]string, error) {
+	return nil, ErrBalanceNotSupported
+}
+
+// a matchall filter ahead of the route filters polices all the traffic
+// the container sends, conforming packets go on to the route filters
+func (l *linuxNetwork) limit(addr, mac string, limit Limit) error {
+	port, err := l.findMac(addr, mac)
+	if err != nil {
+		log.Println("[WARN] unable to find port of", mac, err)
+		return err
+	}
+
+	cmd := fmt.Sprintf("sudo tc filter del dev %s parent ffff: prio %d 2>/dev/null; true", port, POLICE_PRIO)
+	if !limit.none() {
+		cmd += fmt.Sprintf(" && sudo tc filter add dev %s parent ffff: protocol all prio %d matchall%s",
+			port, POLICE_PRIO, policeActions(limit))
+	}
+	if _, err := runshAt(addr, cmd); err != nil {
+		log.Println("[WARN] unable to set limit of", mac, err)
+		return err
+	}
+
+	return nil
+}
+
+// a police action takes either a rate or a packet rate, so both
+// limits are two actions and the first one pipes into the second
+func policeActions(limit Limit) string {
+	police := make([]string, 0, 2)
+	if limit.Kbps > 0 {
+		police = append(police, fmt.Sprintf("rate %dkbit burst %d", limit.Kbps, limit.burstKb()*1000/8))
+	}
+	if limit.Pps > 0 {
+		police = append(police, fmt.Sprintf("pkt_rate %d pkt_burst %d", limit.Pps, limit.burstPkts()))
+	}
+
+	actions := ""
+	for i, p := range police {
+		next := "pipe"
+		if i == len(police)-1 {
+			next = "continue"
+		}
+		actions += " action police " + p + " conform-exceed drop/" + next
+	}
+	return actions
+}
+
+// parses the output of tc filter show of each port after its name, only
+// the first line of a filter has its handle. Macs are of our allocator.
+func parseRouteFilters(out string) map[string][]string {
+	routes := make(map[string][]string)
+	port := ""
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "dev" {
+			port = fields[1]
+			continue
+		}
+		pref, handle := "", ""
+		for i := 0; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "pref":
+				pref = fields[i+1]
+			case "handle":
+				handle = fields[i+1]
+			}
+		}
+
+		h, err := strconv.ParseUint(handle, 0, 32)
+		if err != nil || pref != strconv.Itoa(ROUTE_PRIORITY) || h < 2 {
+			continue
+		}
+		group := h>>1 - 1
+		mac := fmt.Sprintf("%s:%02x:%02x:%02x", MAC_PREFIX, byte(group>>16), byte(group>>8), byte(group))
+		routes[mac] = append(routes[mac], filterRoute(port, uint32(h)))
+	}
+	return routes
+}
+
+func filterRoute(port string, handle uint32) string {
+	return fmt.Sprintf("dev=%s,handle=%#x", port, handle)
+}
+
+// unique for the client and direction, like the groups of ovs.
+// Handle 0 would let tc pick one.
+func filterHandle(cookie uint64, reverse bool) uint32 {
+	handle := (cookieGroup(cookie) + 1) << 1
+	if reverse {
+		handle |= 1
+	}
+	return handle
+}
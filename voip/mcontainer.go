@@ -2,7 +2,6 @@ package voip
 
 import (
 	"log"
-	"math"
 	"time"
 
 	"github.com/influxdb/influxdb/models"
@@ -13,6 +12,13 @@ const (
 	TX_TABLE
 	CPU_TABLE
 	QUEUE_TABLE
+	// counter of dropped packets, shown but not used for control
+	DROP_TABLE
+)
+
+const (
+	MIN_SHARES = 64
+	MAX_SHARES = 1024
 )
 
 type MContainer struct {
@@ -24,22 +30,21 @@ type MContainer struct {
 	cpuload *TimeData
 	queue   *TimeData
 
-	// control vars
-	shares int64
-	ref    int64
-	alpha  float64
-
-	// algorithm vars
-	ploadr  float64
-	prxr    float64
-	ptxr    float64
-	pqueuel int64
-	ibytes  int64
-	tibytes int64
-	csum    float64
+	// control vars, the resources are those of the node
+	ctrl Controller
+	pool string
+
+	// number of periods over and queue length at the end of last period
+	periods int64
+	pqueue  int64
+
+	// latest synchronized sample, nil until we have one
+	last *Sample
+	// latest drop counter
+	drops int64
 }
 
-func NewMContainer(node *Node, step, wl, shares, ref int64, alpha float64) *MContainer {
+func NewMContainer(node *Node, step, wl int64, ctrl Controller) *MContainer {
 	curtime := time.Now()
 
 	return &MContainer{
@@ -48,9 +53,7 @@ func NewMContainer(node *Node, step, wl, shares, ref int64, alpha float64) *MCon
 		outflow: NewTimeData(step, wl, curtime),
 		cpuload: NewTimeData(step, wl, curtime),
 		queue:   NewTimeData(step, wl, curtime),
-		shares:  shares,
-		ref:     ref,
-		alpha:   alpha,
+		ctrl:    ctrl,
 	}
 }
 
@@ -71,16 +74,20 @@ func (m *MContainer) AddPoint(table int, point models.Point) {
 		m.cpuload.AddPoint(point.Time(), val)
 	case QUEUE_TABLE:
 		m.queue.AddPoint(point.Time(), val)
+	case DROP_TABLE:
+		m.drops = val
 	default:
 		panic("NOT REACHABLE")
 	}
 }
 
-func (m *MContainer) Trigger() int64 {
+// returns the resources the controller wants and whether they changed
+func (m *MContainer) Trigger() (Resources, bool) {
+	res := m.node.res
 	flag := false
 
 	for {
-		_, rxr, ok1 := m.inflow.Next()
+		rx, rxr, ok1 := m.inflow.Next()
 		tx, txr, ok2 := m.outflow.Next()
 		_, cpr, ok3 := m.cpuload.Next()
 		lqueue, _, ok4 := m.queue.Next()
@@ -89,54 +96,46 @@ func (m *MContainer) Trigger() int64 {
 			break
 		}
 
-		if m.ibytes == 0 {
-			m.ibytes = tx
-			m.tibytes = tx
-		}
-
 		// we have three points rx, tx, cp synchronized within <step>
-		// ninetyp := float64(m.shares) * 90 / 1024
-		switch {
-		case m.pqueuel > 0 && lqueue <= 0:
-			m.csum += float64(tx-m.tibytes) * (m.prxr / (m.prxr + m.ptxr))
-			m.tibytes = tx
-		case m.pqueuel <= 0 && lqueue > 0:
-			m.tibytes = tx
-		case m.pqueuel > 0 && lqueue > 0:
-		case m.pqueuel <= 0 && lqueue <= 0:
+		// an interval is over when inflow says so, for consistency
+		sample := &Sample{
+			Rx:       rx,
+			Tx:       tx,
+			Queue:    lqueue,
+			RxRate:   rxr,
+			TxRate:   txr,
+			CpuRate:  cpr,
+			Duration: float64(m.inflow.AfterD()) / 1000,
 		}
 
-		// 1 interval is over, we look at only inflow for consistency
-		duration := float64(m.inflow.AfterD()) / 1000
-		if duration > 0 {
-			m.csum += float64(tx-m.tibytes) * (m.prxr / (m.prxr - m.ptxr))
-			dprime := float64(m.csum) / float64(m.shares) / duration
-			if math.Abs(dprime) > 0 && math.Abs(dprime) < 1000000 {
-				delta := float64(tx-m.ibytes) / duration
-				log.Println("m.sum:", m.csum, "dprime:", dprime, "delta", delta)
-				m.shares += int64(m.alpha * (float64(m.ref) - delta) / dprime)
-				if m.shares < 0 {
-					m.shares = 64
-				} else if m.shares > 1024 {
-					m.shares = 1024
-				}
-				flag = true
-			}
-
-			m.csum = 0
-			m.ibytes = tx
-			m.tibytes = tx
+		m.last = sample
+		if next, ok := m.next(sample, res); ok {
+			res = next
+			flag = true
 		}
 
-		m.ploadr = cpr
-		m.prxr = rxr
-		m.ptxr = txr
-		m.pqueuel = lqueue
+		if sample.Duration > 0 {
+			m.periods++
+			m.pqueue = lqueue
+		}
 	}
 
-	if flag {
-		return m.shares
+	return res, flag
+}
+
+// controllers of more than shares decide the whole vector
+func (m *MContainer) next(s *Sample, res Resources) (Resources, bool) {
+	ok := false
+	if rc, is := m.ctrl.(ResourceController); is {
+		res, ok = rc.NextResources(s, res)
 	} else {
-		return 0
+		res.Shares, ok = m.ctrl.Next(s, res.Shares)
+	}
+
+	if res.Shares < MIN_SHARES {
+		res.Shares = MIN_SHARES
+	} else if res.Shares > MAX_SHARES {
+		res.Shares = MAX_SHARES
 	}
+	return res, ok
 }
@@ -0,0 +1,444 @@
+package voip
+
+import (
+	"log"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/mangalaman93/nfs/pkg/ipam"
+)
+
+// netManager connects containers run on the machines themselves to
+// the bridges and routes chains through them, the managers of docker
+// containers and of processes differ only in how they run the NFs
+type netManager struct {
+	ipam    *ipam.IPAM
+	macs    *ipam.MACAllocator
+	net     network
+	overlay *Overlay
+	fw      *firewall
+}
+
+func newNetManager(config *goconfig.ConfigFile, hmap map[string]string) (*netManager, error) {
+	netw, err := newNetwork(config)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := NewIPAM(config)
+	if err != nil {
+		return nil, err
+	}
+	macs, err := ipam.NewMACAllocator(MAC_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	overlay, err := NewOverlay(config, hmap)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := netw.(ovsNetwork); !ok && overlay != nil {
+		return nil, ErrOverlayNotSupported
+	}
+
+	return &netManager{
+		ipam:    addrs,
+		macs:    macs,
+		net:     netw,
+		overlay: overlay,
+		fw:      newFirewall(config),
+	}, nil
+}
+
+func (n *netManager) setup() error {
+	if n.fw != nil {
+		for _, addr := range n.addrs() {
+			if err := n.fw.init(addr); err != nil {
+				return err
+			}
+		}
+	}
+	return n.setupBridges()
+}
+
+// gives the container in the namespace an ip and a mac on the bridge of the host
+func (n *netManager) attach(host, id string, ns netns) (*Node, error) {
+	undo := true
+	ip, err := n.ipam.Allocate(host, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if undo {
+			n.ipam.Release(ip, id)
+		}
+	}()
+
+	// mac follows the ip unless that is taken already
+	mac, err := n.macs.FromIP(ip, id)
+	if err == ipam.ErrConflict {
+		mac, err = n.macs.Allocate(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if undo {
+			n.macs.Release(mac, id)
+		}
+	}()
+
+	err = n.net.setupNetwork(n.addr(host), id, ns, ip, n.ipam.Bits(host), mac)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if undo {
+			n.net.usetupNetwork(n.addr(host), id)
+		}
+	}()
+	log.Println("[INFO] setup network for container", id, "ip:", ip, "mac:", mac)
+
+	node := NewNode(id, ip, mac, host)
+	if n.fw != nil {
+		if err := n.fw.add(n.addr(host), node); err != nil {
+			return nil, err
+		}
+	}
+
+	undo = false
+	return node, nil
+}
+
+// removes the routes and the firewall chain of the container
+func (n *netManager) isolate(node *Node) {
+	// containers found by List have no mac, the reconciler purges their routes
+	if node.mac != "" && n.deRoute(node) == nil {
+		log.Println("[INFO] derouted for container", node.id)
+	}
+	if n.fw != nil {
+		n.fw.remove(n.addr(node.host), node)
+	}
+}
+
+// once the container is stopped, its address can be given to others
+func (n *netManager) detach(node *Node) {
+	n.net.usetupNetwork(n.addr(node.host), node.id)
+	n.ipam.Release(node.ip, node.id)
+	n.macs.Release(node.mac, node.id)
+}
+
+// also detects two containers with the same address
+func (n *netManager) reserve(node *Node) error {
+	if err := n.ipam.Reserve(node.host, node.ip, node.id); err != nil {
+		return err
+	}
+	if err := n.macs.Reserve(node.mac, node.id); err != nil {
+		n.ipam.Release(node.ip, node.id)
+		return err
+	}
+	if n.fw != nil {
+		if err := n.fw.add(n.addr(node.host), node); err != nil {
+			n.macs.Release(node.mac, node.id)
+			n.ipam.Release(node.ip, node.id)
+			return err
+		}
+	}
+	return nil
+}
+
+// one local bridge, or a bridge on each host connected by the overlay
+func (n *netManager) setupBridges() error {
+	if n.overlay == nil {
+		return n.net.init("", n.ipam.Gateway(""), n.ipam.Bits(""))
+	}
+
+	undo := true
+	done := make(map[string]bool)
+	gateways := make(map[string]bool)
+	for _, host := range n.overlay.hosts {
+		addr := n.addr(host)
+		if done[addr] {
+			continue
+		}
+
+		// hosts sharing a subnet share the gateway, only one bridge gets it
+		gateway := n.ipam.Gateway(host)
+		if gateways[gateway] {
+			gateway = ""
+		}
+		gateways[gateway] = true
+
+		if err := n.net.init(addr, gateway, n.ipam.Bits(host)); err != nil {
+			return err
+		}
+		done[addr] = true
+		defer func() {
+			if undo {
+				n.net.destroy(addr)
+			}
+		}()
+	}
+
+	if err := n.overlay.Setup(); err != nil {
+		return err
+	}
+
+	undo = false
+	return nil
+}
+
+func (n *netManager) destroyBridges() {
+	for _, addr := range n.addrs() {
+		n.net.destroy(addr)
+	}
+}
+
+// addresses of the machines with a bridge
+func (n *netManager) addrs() []string {
+	if n.overlay == nil {
+		return []string{""}
+	}
+
+	addrs := make([]string, 0, len(n.overlay.hosts))
+	done := make(map[string]bool)
+	for _, host := range n.overlay.hosts {
+		if addr := n.addr(host); !done[addr] {
+			addrs = append(addrs, addr)
+			done[addr] = true
+		}
+	}
+	return addrs
+}
+
+// address of the machine with the bridge of the host
+func (n *netManager) addr(host string) string {
+	if n.overlay == nil {
+		return ""
+	}
+	return n.overlay.addr(host)
+}
+
+// chain is the client, the hops in order and the server
+func (n *netManager) Route(chain []*Node, symmetric bool) error {
+	if len(chain) < 2 {
+		return ErrShortChain
+	}
+
+	// a duplicate mac would silently misroute the traffic
+	for _, node := range chain[1:] {
+		if _, err := n.net.findMac(n.addr(node.host), node.mac); err != nil {
+			log.Println("[WARN] unable to verify mac", node.mac, err)
+			return err
+		}
+	}
+
+	undo := true
+	defer func() {
+		if undo {
+			n.DeRoute(chain)
+		}
+	}()
+	for _, hop := range chainFlows(chain, symmetric) {
+		if n.overlay != nil {
+			hop.out = n.overlay.Tunnel(hop.from.host, hop.to.host)
+		}
+		if err := n.net.route(n.addr(hop.from.host), hop); err != nil {
+			return err
+		}
+	}
+
+	// the last hop sends to the server and the server or the
+	// first hop replies to the client, maybe through a tunnel
+	if n.overlay != nil {
+		cnode, snode := chain[0], chain[len(chain)-1]
+		if err := n.overlay.Forward(chain[len(chain)-2], snode); err != nil {
+			return err
+		}
+		last := snode
+		if symmetric {
+			last = chain[1]
+		}
+		if err := n.overlay.Forward(last, cnode); err != nil {
+			return err
+		}
+	}
+
+	undo = false
+	log.Println("[INFO] setup route", chainString(chain), "symmetric:", symmetric)
+	return nil
+}
+
+// the client sends to a select group on its bridge, the
+// replicas and the server send to the client directly
+func (n *netManager) Balance(cnode *Node, replicas []*Node, weights []int64, snode *Node) error {
+	chain := chainNodes(cnode, replicas, snode)
+	if len(replicas) == 0 {
+		return n.Route(chain, false)
+	}
+
+	for _, node := range chain[1:] {
+		if _, err := n.net.findMac(n.addr(node.host), node.mac); err != nil {
+			log.Println("[WARN] unable to verify mac", node.mac, err)
+			return err
+		}
+	}
+
+	undo := true
+	defer func() {
+		if undo {
+			n.DeRoute(chain)
+		}
+	}()
+	group := balanceGroup(cnode, replicas, weights, snode)
+	if n.overlay != nil {
+		for i, node := range replicas {
+			group.outs[i] = n.overlay.Tunnel(cnode.host, node.host)
+		}
+	}
+	if err := n.net.balance(n.addr(cnode.host), group); err != nil {
+		return err
+	}
+
+	if n.overlay != nil {
+		for _, node := range replicas {
+			if err := n.overlay.Forward(node, snode); err != nil {
+				return err
+			}
+		}
+		if err := n.overlay.Forward(snode, cnode); err != nil {
+			return err
+		}
+	}
+
+	undo = false
+	log.Println("[INFO] setup balanced route", chainString(chain), "weights:", weights)
+	return nil
+}
+
+// removes both directions, flows towards the
+// server are shared by other chains and stay
+func (n *netManager) DeRoute(chain []*Node) error {
+	var err error
+	done := make(map[string]bool)
+	for _, node := range chain {
+		addr := n.addr(node.host)
+		if done[addr] {
+			continue
+		}
+		done[addr] = true
+		if derr := n.net.deRoute(addr, chain[0].mac); derr != nil && err == nil {
+			err = derr
+		}
+	}
+
+	return err
+}
+
+// route flows of all the bridges
+func (n *netManager) Routes() (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, addr := range n.addrs() {
+		found, err := n.net.routes(addr)
+		if err != nil {
+			log.Println("[WARN] unable to list routes on", hostName(addr), err)
+			return nil, err
+		}
+		for mac, flows := range found {
+			routes[mac] = append(routes[mac], flows...)
+		}
+	}
+	return routes, nil
+}
+
+// the flows Route or Balance install, through the same tunnels
+func (n *netManager) ChainRoutes(chain []*Node, symmetric bool, weights []int64) (map[string][]string, error) {
+	cnode, snode := chain[0], chain[len(chain)-1]
+	routes := make(map[string][]string)
+	if len(weights) != 0 {
+		replicas := chain[1 : len(chain)-1]
+		group := balanceGroup(cnode, replicas, weights, snode)
+		if n.overlay != nil {
+			for i, node := range replicas {
+				group.outs[i] = n.overlay.Tunnel(cnode.host, node.host)
+			}
+		}
+		flows, err := n.net.groupRoutes(n.addr(cnode.host), group)
+		if err != nil {
+			return nil, err
+		}
+		routes[cnode.mac] = flows
+		if n.overlay != nil {
+			for _, node := range replicas {
+				addForward(routes, snode.mac, n.overlay.ForwardFlow(node, snode))
+			}
+			addForward(routes, cnode.mac, n.overlay.ForwardFlow(snode, cnode))
+		}
+		return routes, nil
+	}
+
+	routes[cnode.mac] = make([]string, 0)
+	for _, hop := range chainFlows(chain, symmetric) {
+		if n.overlay != nil {
+			hop.out = n.overlay.Tunnel(hop.from.host, hop.to.host)
+		}
+		flow, err := n.net.hopRoute(n.addr(hop.from.host), hop)
+		if err != nil {
+			return nil, err
+		}
+		routes[cnode.mac] = append(routes[cnode.mac], flow)
+	}
+	if n.overlay != nil {
+		addForward(routes, snode.mac, n.overlay.ForwardFlow(chain[len(chain)-2], snode))
+		last := snode
+		if symmetric {
+			last = chain[1]
+		}
+		addForward(routes, cnode.mac, n.overlay.ForwardFlow(last, cnode))
+	}
+	return routes, nil
+}
+
+// replicas on the same host share the forward flow
+func addForward(routes map[string][]string, mac, flow string) {
+	if flow == "" {
+		return
+	}
+	for _, f := range routes[mac] {
+		if f == flow {
+			return
+		}
+	}
+	routes[mac] = append(routes[mac], flow)
+}
+
+// also the flows forwarding to the mac, which no chain needs anymore
+func (n *netManager) PurgeRoutes(mac string) error {
+	var err error
+	for _, addr := range n.addrs() {
+		if derr := n.net.deRoute(addr, mac); derr != nil && err == nil {
+			err = derr
+		}
+		if n.overlay == nil {
+			continue
+		}
+		if ferr := ovsdUnForward(addr, mac); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+func (n *netManager) SetLimit(node *Node, limit Limit) error {
+	if err := n.net.limit(n.addr(node.host), node.mac, limit); err != nil {
+		return err
+	}
+
+	log.Println("[INFO] set limit of container", node.id, "to", limit)
+	return nil
+}
+
+func (n *netManager) deRoute(node *Node) error {
+	if n.overlay == nil {
+		return n.net.deRoute("", node.mac)
+	}
+	return n.overlay.DeRoute(node)
+}
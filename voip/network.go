@@ -0,0 +1,141 @@
+package voip
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	NET_OVS   = "ovs"
+	NET_LINUX = "linux"
+)
+
+var (
+	ErrUnknownNetwork      = errors.New("Invalid network backend")
+	ErrOverlayNotSupported = errors.New("overlay needs the ovs network backend")
+	ErrBalanceNotSupported = errors.New("network backend can't balance traffic")
+)
+
+// network is the data plane of the containers on the machine with
+// address addr, empty for this machine (see runshAt). Ports are as
+// returned by findMac and only mean something to the same backend.
+type network interface {
+	init(addr, gateway string, bits int) error
+	destroy(addr string)
+	setupNetwork(addr, id string, ns netns, ip string, bits int, mac string) error
+	usetupNetwork(addr, id string)
+	findMac(addr, mac string) (string, error)
+	route(addr string, hop *hopFlow) error
+	balance(addr string, group *hopGroup) error
+	// removes the routes of the client in both directions
+	deRoute(addr, cmac string) error
+	// route flows (or filters) by mac of their client, in the
+	// form hopRoute and groupRoutes render them. Flows forwarding
+	// into a tunnel are by the mac they forward to.
+	routes(addr string) (map[string][]string, error)
+	// the route flow of the hop once installed
+	hopRoute(addr string, hop *hopFlow) (string, error)
+	// the route flows of the group once installed
+	groupRoutes(addr string, group *hopGroup) ([]string, error)
+	// polices the traffic sent by the container with the mac,
+	// a Limit without kbps and pps removes the policing
+	limit(addr, mac string, limit Limit) error
+}
+
+// netns is the network namespace of a container, the pid of a
+// process in it or the name of a namespace made by ip netns add
+type netns string
+
+func (ns netns) named() bool {
+	_, err := strconv.Atoi(string(ns))
+	return err != nil
+}
+
+// prefix of the commands to run in the namespace
+func (ns netns) exec() string {
+	if ns.named() {
+		return "ip netns exec " + string(ns) + " "
+	}
+	return "nsenter -t " + string(ns) + " -n "
+}
+
+// brings up the host end of the veth pair and moves the other end into
+// the namespace as eth0 with the ip and the mac
+func moveVeth(addr, lport, cport string, ns netns, ip string, bits int, mac string) error {
+	_, err := runshAt(addr, "sudo ip link set "+lport+" up"+
+		" && sudo ip link set "+cport+" netns "+string(ns)+
+		" && sudo "+ns.exec()+"ip link set dev "+cport+" name eth0"+
+		" && sudo "+ns.exec()+"ip link set dev eth0 address "+mac+
+		" && sudo "+ns.exec()+"ip addr add "+ip+"/"+strconv.Itoa(bits)+" dev eth0"+
+		" && sudo "+ns.exec()+"ip link set dev eth0 up")
+	return err
+}
+
+// reads optional [VOIP.NETWORK] section, backend is ovs (default) or linux
+func newNetwork(config *goconfig.ConfigFile) (network, error) {
+	switch config.MustValue("VOIP.NETWORK", "backend", NET_OVS) {
+	case NET_OVS:
+		if err := ovsdConfigure(config); err != nil {
+			return nil, err
+		}
+		return ovsNetwork{}, nil
+	case NET_LINUX:
+		return newLinuxNetwork(config), nil
+	default:
+		return nil, ErrUnknownNetwork
+	}
+}
+
+// ovsNetwork uses the bridge OVS_BRIDGE, through the
+// command line tools or natively as in [VOIP.OVS]
+type ovsNetwork struct{}
+
+func (ovsNetwork) init(addr, gateway string, bits int) error {
+	return ovsdInit(addr, gateway, bits)
+}
+
+func (ovsNetwork) destroy(addr string) {
+	ovsdDestroy(addr)
+}
+
+func (ovsNetwork) setupNetwork(addr, id string, ns netns, ip string, bits int, mac string) error {
+	return ovsdSetupNetwork(addr, id, ns, ip, bits, mac)
+}
+
+func (ovsNetwork) usetupNetwork(addr, id string) {
+	ovsdUSetupNetwork(addr, id)
+}
+
+func (ovsNetwork) findMac(addr, mac string) (string, error) {
+	return ovsdFindMac(addr, mac)
+}
+
+func (ovsNetwork) route(addr string, hop *hopFlow) error {
+	return routeHop(addr, OVS_BRIDGE, hop)
+}
+
+func (ovsNetwork) balance(addr string, group *hopGroup) error {
+	return balanceHop(addr, OVS_BRIDGE, group)
+}
+
+func (ovsNetwork) deRoute(addr, cmac string) error {
+	return deRouteHops(addr, OVS_BRIDGE, cmac)
+}
+
+func (ovsNetwork) routes(addr string) (map[string][]string, error) {
+	return routeFlows(addr, OVS_BRIDGE)
+}
+
+func (ovsNetwork) hopRoute(addr string, hop *hopFlow) (string, error) {
+	return hopRouteFlow(addr, hop)
+}
+
+func (ovsNetwork) groupRoutes(addr string, group *hopGroup) ([]string, error) {
+	return groupRouteFlows(addr, group)
+}
+
+func (ovsNetwork) limit(addr, mac string, limit Limit) error {
+	return policeMac(addr, mac, limit)
+}
@@ -0,0 +1,91 @@
+package voip
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Unknwon/goconfig"
+)
+
+func TestNewNetwork(t *testing.T) {
+	config, _ := goconfig.LoadFromData([]byte(""))
+	if n, err := newNetwork(config); err != nil || n != (ovsNetwork{}) {
+		t.Errorf("expected ovs by default, got %v %v", n, err)
+	}
+
+	config, _ = goconfig.LoadFromData([]byte("[VOIP.NETWORK]\nbackend=linux\nbridge=br9\n"))
+	n, err := newNetwork(config)
+	if l, ok := n.(*linuxNetwork); err != nil || !ok || l.bridge != "br9" {
+		t.Errorf("expected linux bridge br9, got %v %v", n, err)
+	}
+
+	config, _ = goconfig.LoadFromData([]byte("[VOIP.NETWORK]\nbackend=vpp\n"))
+	if _, err := newNetwork(config); err != ErrUnknownNetwork {
+		t.Errorf("expected %v, got %v", ErrUnknownNetwork, err)
+	}
+}
+
+func TestLinksWithAlias(t *testing.T) {
+	out := `7: 1a2b3c4d_l@if6: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue master nfsbr state UP mode DEFAULT group default qlen 1000\    link/ether 4a:1f:9e:00:10:02 brd ff:ff:ff:ff:ff:ff link-netnsid 0 alias 00:16:3e:00:00:01
+9: 5e6f7a8b_l@if8: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue master nfsbr state UP mode DEFAULT group default qlen 1000\    link/ether 6e:22:01:aa:10:03 brd ff:ff:ff:ff:ff:ff link-netnsid 1 alias 00:16:3e:00:00:02
+`
+	if links := linksWithAlias(out, "00:16:3e:00:00:02"); len(links) != 1 || links[0] != "5e6f7a8b_l" {
+		t.Errorf("expected 5e6f7a8b_l, got %v", links)
+	}
+	if links := linksWithAlias(out, "00:16:3e:00:00:03"); len(links) != 0 {
+		t.Errorf("expected no links, got %v", links)
+	}
+	if filterHandle(0x00163e000001, false) == filterHandle(0x00163e000001, true) {
+		t.Error("both directions share the filter handle")
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	flows := ` cookie=0x163e000001, duration=12.1s, table=0, n_packets=4, n_bytes=360, priority=100,ip,dl_src=00:16:3e:00:00:01,dl_dst=00:16:3e:00:00:03,nw_src=173.16.1.2 actions=mod_dl_dst:00:16:3e:00:00:02,resubmit:3
+ cookie=0x163e000001, duration=12.1s, table=0, n_packets=0, n_bytes=0, priority=100,ip,dl_src=00:16:3e:00:00:02,dl_dst=00:16:3e:00:00:03,nw_src=173.16.1.2 actions=mod_dl_dst:00:16:3e:00:00:04,resubmit:4
+ cookie=0x163e000005, duration=2.0s, table=0, n_packets=0, n_bytes=0, priority=100,ip,dl_src=00:16:3e:00:00:05,dl_dst=00:16:3e:00:00:03,nw_src=173.16.1.6 actions=group:5
+ cookie=0x4e4653, duration=3.0s, table=0, n_packets=0, n_bytes=0, priority=90,dl_dst=00:16:3e:00:00:03 actions=output:5
+ cookie=0x9f3c22aa01b2c3d4, duration=80.2s, table=0, n_packets=9, n_bytes=900, priority=100,in_port=1 actions=NORMAL
+`
+	groups := `OFPST_GROUP_DESC reply (OF1.3) (xid=0x2):
+ group_id=5,type=select,bucket=bucket_id:0,weight:256,actions=set_field:00:16:3e:00:00:02->eth_dst,output:7
+ group_id=9,type=all,bucket=actions=NORMAL
+`
+	routes := parseRouteFlows(flows, groups)
+	if len(routes) != 3 || len(routes["00:16:3e:00:00:01"]) != 2 || len(routes["00:16:3e:00:00:05"]) != 2 {
+		t.Fatalf("expected route flows of two clients and a forward flow, got %v", routes)
+	}
+	if flows := routes["00:16:3e:00:00:03"]; len(flows) != 1 || flows[0] != forwardFlow("00:16:3e:00:00:03", "5") {
+		t.Errorf("expected forward flow to the server, got %v", flows)
+	}
+
+	cnode := NewNode("c1", "173.16.1.2", "00:16:3e:00:00:01", "h1")
+	nf := NewNode("n1", "173.16.1.4", "00:16:3e:00:00:02", "h1")
+	snode := NewNode("s1", "173.16.1.3", "00:16:3e:00:00:03", "h1")
+	hop := chainFlows([]*Node{cnode, nf, snode}, false)[0]
+	hop.out = "3"
+	if flow, _ := hopRouteFlow("", hop); flow != strings.Replace(routes[cnode.mac][0], "resubmit", "output", 1) {
+		t.Errorf("expected %s, got %s", routes[cnode.mac][0], flow)
+	}
+
+	cnode = NewNode("c5", "173.16.1.6", "00:16:3e:00:00:05", "h1")
+	group := balanceGroup(cnode, []*Node{nf}, []int64{256}, snode)
+	group.outs[0] = "7"
+	expected, _ := groupRouteFlows("", group)
+	if strings.Join(expected, "\n") != strings.Join(routes[cnode.mac], "\n") {
+		t.Errorf("expected %v, got %v", expected, routes[cnode.mac])
+	}
+
+	filters := `dev 8a1f02c3_l
+filter protocol ip pref 100 flower chain 0
+filter protocol ip pref 100 flower chain 0 handle 0x4
+  src_mac 00:16:3e:00:00:01
+  dst_mac 00:16:3e:00:00:03
+filter protocol ip pref 100 flower chain 0 handle 0x5
+dev 77c0e1d2_l
+`
+	routes = parseRouteFilters(filters)
+	if flows := routes["00:16:3e:00:00:01"]; len(routes) != 1 || len(flows) != 2 || flows[0] != "dev=8a1f02c3_l,handle=0x4" {
+		t.Errorf("expected both directions of one client, got %v", routes)
+	}
+}
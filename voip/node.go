@@ -1,11 +1,23 @@
 package voip
 
+const (
+	ROLE_SERVER   = "server"
+	ROLE_SNORT    = "snort"
+	ROLE_CLIENT   = "client"
+	ROLE_SURICATA = "suricata"
+	ROLE_BRO      = "bro"
+	ROLE_NDPI     = "ndpi"
+)
+
 type Node struct {
 	id    string
 	ip    string
 	mac   string
 	host  string
+	role  string
 	other string
+	// resources as last set on the container
+	res Resources
 }
 
 func NewNode(id, ip, mac, host string) *Node {
@@ -16,3 +28,27 @@ func NewNode(id, ip, mac, host string) *Node {
 		host: host,
 	}
 }
+
+func (n *Node) Id() string {
+	return n.id
+}
+
+func (n *Node) Ip() string {
+	return n.ip
+}
+
+func (n *Node) Mac() string {
+	return n.mac
+}
+
+func (n *Node) Host() string {
+	return n.host
+}
+
+func (n *Node) Role() string {
+	return n.role
+}
+
+func (n *Node) Resources() Resources {
+	return n.res
+}
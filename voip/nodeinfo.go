@@ -0,0 +1,105 @@
+package voip
+
+import (
+	"sort"
+)
+
+// NodeInfo is a snapshot of a container as seen by the voip handler
+type NodeInfo struct {
+	Id        string       `json:"id"`
+	Role      string       `json:"role"`
+	Host      string       `json:"host"`
+	Ip        string       `json:"ip"`
+	Mac       string       `json:"mac"`
+	Shares    int64        `json:"shares"`
+	Reference int64        `json:"reference"`
+	Pool      string       `json:"pool,omitempty"`
+	Limit     *Limit       `json:"limit,omitempty"`
+	Resources Resources    `json:"resources"`
+	Chains    []*ChainInfo `json:"chains"`
+
+	// latest rates seen by the controller, snorts only
+	RxRate  float64 `json:"rx_rate"`
+	TxRate  float64 `json:"tx_rate"`
+	CpuRate float64 `json:"cpu_rate"`
+	Queue   int64   `json:"queue"`
+	Drops   int64   `json:"drops"`
+}
+
+// role, if given, filters the nodes
+func (vh *VoipHandler) listNodes(req *Request) *Response {
+	role := req.KeyVal["role"]
+	nodes := make([]*NodeInfo, 0, len(vh.anodes)+len(vh.mnodes))
+	for _, node := range vh.anodes {
+		if role == "" || node.role == role {
+			nodes = append(nodes, vh.nodeInfo(node))
+		}
+	}
+	for _, mcont := range vh.mnodes {
+		if role == "" || mcont.node.role == role {
+			nodes = append(nodes, vh.nodeInfo(mcont.node))
+		}
+	}
+
+	sort.Sort(byId(nodes))
+	return &Response{Nodes: nodes}
+}
+
+func (vh *VoipHandler) getNode(req *Request) *Response {
+	contid, ok := req.KeyVal["cont"]
+	if !ok {
+		return errResponse(ErrKeyNotFound)
+	}
+
+	if node, ok := vh.anodes[contid]; ok {
+		return &Response{Nodes: []*NodeInfo{vh.nodeInfo(node)}}
+	} else if mcont, ok := vh.mnodes[contid]; ok {
+		return &Response{Nodes: []*NodeInfo{vh.nodeInfo(mcont.node)}}
+	} else {
+		return errResponse(ErrIdNotExists)
+	}
+}
+
+func (vh *VoipHandler) nodeInfo(node *Node) *NodeInfo {
+	info := &NodeInfo{
+		Id:        node.id,
+		Role:      node.role,
+		Host:      node.host,
+		Ip:        node.ip,
+		Mac:       node.mac,
+		Shares:    vh.sched.Shares(node.id),
+		Resources: node.res,
+		Chains:    make([]*ChainInfo, 0),
+	}
+
+	if limit, ok := vh.limits[node.id]; ok {
+		info.Limit = &limit
+	}
+
+	if mcont, ok := vh.mnodes[node.id]; ok {
+		info.Shares = node.res.Shares
+		info.Reference = Reference(mcont.ctrl)
+		info.Pool = mcont.pool
+		if mcont.last != nil {
+			info.RxRate = mcont.last.RxRate
+			info.TxRate = mcont.last.TxRate
+			info.CpuRate = mcont.last.CpuRate
+			info.Queue = mcont.last.Queue
+		}
+		info.Drops = mcont.drops
+	}
+
+	for _, c := range vh.sortedChains() {
+		if c.has(node) {
+			info.Chains = append(info.Chains, c.info())
+		}
+	}
+
+	return info
+}
+
+type byId []*NodeInfo
+
+func (b byId) Len() int           { return len(b) }
+func (b byId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byId) Less(i, j int) bool { return b[i].Id < b[j].Id }
@@ -3,6 +3,7 @@ package voip
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/Unknwon/goconfig"
@@ -20,6 +21,7 @@ type OStackCManager struct {
 	osclient  *gophercloud.ServiceClient
 	dockercls map[string]*docker.DockerClient
 	hmap      map[string]string
+	catalog   Catalog
 	cadvisor  []string
 	moncont   []string
 }
@@ -56,6 +58,14 @@ func NewOStackCManager(config *goconfig.ConfigFile) (*OStackCManager, error) {
 		return nil, err
 	}
 
+	if err := ovsdConfigure(config); err != nil {
+		return nil, err
+	}
+	catalog, err := NewCatalog(config)
+	if err != nil {
+		return nil, err
+	}
+
 	hmap := make(map[string]string)
 	for _, host := range hosts {
 		address, err := config.GetValue("VOIP.TOPO", host)
@@ -82,6 +92,7 @@ func NewOStackCManager(config *goconfig.ConfigFile) (*OStackCManager, error) {
 		osclient:  osclient,
 		dockercls: make(map[string]*docker.DockerClient),
 		hmap:      hmap,
+		catalog:   catalog,
 		cadvisor: []string{"-storage_driver=influxdb",
 			"-storage_driver_user=" + iuser,
 			"-storage_driver_password=" + ipass,
@@ -109,6 +120,10 @@ func (o *OStackCManager) Setup() error {
 		o.dockercls[host] = client
 		log.Println("[INFO] added host", host)
 
+		// left behind if the previous run didn't exit cleanly
+		client.RemoveContainer("cadvisor-"+host, true, true)
+		client.RemoveContainer("moncont-"+host, true, true)
+
 		id, err := client.CreateContainer(&docker.ContainerConfig{
 			Image: IMG_CADVISOR,
 			Cmd:   o.cadvisor,
@@ -190,33 +205,29 @@ func (o *OStackCManager) Destroy() {
 	}
 }
 
-func (o *OStackCManager) StartServer(host string, shares int64) (*Node, error) {
-	return o.runc(host, "sipp-server", shares, servers.CreateOpts{
-		Name:             "sipp-server",
-		FlavorName:       "c1.tiny",
-		ImageName:        IMG_SIPP,
-		Metadata:         map[string]string{"ARGS": "-buff_size " + SIPP_BUFF_SIZE + " -sn uas"},
-		AvailabilityZone: "regionOne:" + host,
-	})
-}
-
-func (o *OStackCManager) StartSnort(host string, shares int64) (*Node, error) {
-	return o.runc(host, "snort", shares, servers.CreateOpts{
-		Name:             "snort",
-		FlavorName:       "c1.tiny",
-		ImageName:        IMG_SNORT,
-		Metadata:         map[string]string{"OPT_CAP_ADD": "NET_ADMIN"},
-		AvailabilityZone: "regionOne:" + host,
-	})
-}
+// nova docker passes the metadata of the instance as env of the
+// container, capabilities go in OPT_CAP_ADD. It can't set the command.
+func (o *OStackCManager) StartNF(kind, host string, res Resources, params map[string]string) (*Node, error) {
+	nf, err := o.catalog.Get(kind)
+	if err != nil {
+		return nil, err
+	}
+	metadata, cmd, err := nf.expand(params)
+	if err != nil {
+		return nil, err
+	}
+	if cmd != nil {
+		return nil, ErrCmdNotSupported
+	}
+	if len(nf.CapAdd) != 0 {
+		metadata["OPT_CAP_ADD"] = strings.Join(nf.CapAdd, ",")
+	}
 
-func (o *OStackCManager) StartClient(host string, shares int64, serverip string) (*Node, error) {
-	args := "-buff_size " + SIPP_BUFF_SIZE + " -sn uac -r 0 " + serverip + ":5060"
-	return o.runc(host, "sipp-client", shares, servers.CreateOpts{
-		Name:             "sipp-client",
+	return o.runc(host, nf.Name, res, servers.CreateOpts{
+		Name:             nf.Name,
 		FlavorName:       "c1.tiny",
-		ImageName:        IMG_SIPP,
-		Metadata:         map[string]string{"ARGS": args},
+		ImageName:        nf.Image,
+		Metadata:         metadata,
 		AvailabilityZone: "regionOne:" + host,
 	})
 }
@@ -227,8 +238,9 @@ func (o *OStackCManager) StopCont(node *Node) error {
 		log.Println("[WARN] address for host:", node.host, "not found")
 		return ErrHostNotFound
 	}
-	ovsosDeRoute(address, node.mac)
-	log.Println("[INFO] derouted for container", node.id)
+	if deRouteHops(address, OVSBR_OS, node.mac) == nil {
+		log.Println("[INFO] derouted for container", node.id)
+	}
 
 	err := servers.Delete(o.osclient, node.id).ExtractErr()
 	if err != nil {
@@ -239,41 +251,204 @@ func (o *OStackCManager) StopCont(node *Node) error {
 	return err
 }
 
-func (o *OStackCManager) Route(cnode, rnode, snode *Node) error {
+// the docker container of the instance has to be running
+func (o *OStackCManager) Adopt(node *Node) error {
+	client, ok := o.dockercls[node.host]
+	if !ok {
+		return ErrHostNotFound
+	}
+
+	info, err := client.InspectContainer(node.other)
+	if err != nil {
+		return err
+	}
+	if info.State == nil || !info.State.Running {
+		return ErrNotRunning
+	}
+
+	log.Println("[INFO] adopted container", node.id)
+	return nil
+}
+
+// instances have no labels to find them by
+func (o *OStackCManager) List() ([]*Node, error) {
+	return nil, nil
+}
+
+// chain is the client, the hops in order and the server
+func (o *OStackCManager) Route(chain []*Node, symmetric bool) error {
+	if len(chain) < 2 {
+		return ErrShortChain
+	}
+
+	undo := true
+	defer func() {
+		if undo {
+			o.DeRoute(chain)
+		}
+	}()
+	for _, hop := range chainFlows(chain, symmetric) {
+		address, ok := o.hmap[hop.from.host]
+		if !ok {
+			log.Println("[WARN] address for host:", hop.from.host, "not found")
+			return ErrHostNotFound
+		}
+		if err := routeHop(address, OVSBR_OS, hop); err != nil {
+			return err
+		}
+	}
+
+	undo = false
+	log.Println("[INFO] setup route", chainString(chain), "symmetric:", symmetric)
+	return nil
+}
+
+// the client sends to a select group on br-int of its compute host
+func (o *OStackCManager) Balance(cnode *Node, replicas []*Node, weights []int64, snode *Node) error {
+	chain := chainNodes(cnode, replicas, snode)
+	if len(replicas) == 0 {
+		return o.Route(chain, false)
+	}
+
 	address, ok := o.hmap[cnode.host]
 	if !ok {
 		log.Println("[WARN] address for host:", cnode.host, "not found")
 		return ErrHostNotFound
 	}
-	err := ovsosRoute(address, cnode.mac, rnode.mac, snode.mac)
-	if err != nil {
+	if err := balanceHop(address, OVSBR_OS, balanceGroup(cnode, replicas, weights, snode)); err != nil {
+		o.DeRoute(chain)
+		return err
+	}
+
+	log.Println("[INFO] setup balanced route", chainString(chain), "weights:", weights)
+	return nil
+}
+
+// removes both directions
+func (o *OStackCManager) DeRoute(chain []*Node) error {
+	var err error
+	done := make(map[string]bool)
+	for _, node := range chain {
+		address, ok := o.hmap[node.host]
+		if !ok || done[address] {
+			continue
+		}
+		done[address] = true
+		if derr := deRouteHops(address, OVSBR_OS, chain[0].mac); derr != nil && err == nil {
+			err = derr
+		}
+	}
+
+	return err
+}
+
+// route flows on br-int of all the compute hosts
+func (o *OStackCManager) Routes() (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, address := range o.addrs() {
+		found, err := routeFlows(address, OVSBR_OS)
+		if err != nil {
+			log.Println("[WARN] unable to list routes on", address, err)
+			return nil, err
+		}
+		for mac, flows := range found {
+			routes[mac] = append(routes[mac], flows...)
+		}
+	}
+	return routes, nil
+}
+
+// instances are on one network, there are no forward flows
+func (o *OStackCManager) ChainRoutes(chain []*Node, symmetric bool, weights []int64) (map[string][]string, error) {
+	cnode, snode := chain[0], chain[len(chain)-1]
+	if len(weights) != 0 {
+		address, ok := o.hmap[cnode.host]
+		if !ok {
+			return nil, ErrHostNotFound
+		}
+		flows, err := groupRouteFlows(address, balanceGroup(cnode, chain[1:len(chain)-1], weights, snode))
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{cnode.mac: flows}, nil
+	}
+
+	flows := make([]string, 0)
+	for _, hop := range chainFlows(chain, symmetric) {
+		address, ok := o.hmap[hop.from.host]
+		if !ok {
+			return nil, ErrHostNotFound
+		}
+		flow, err := hopRouteFlow(address, hop)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, flow)
+	}
+	return map[string][]string{cnode.mac: flows}, nil
+}
+
+func (o *OStackCManager) PurgeRoutes(mac string) error {
+	var err error
+	for _, address := range o.addrs() {
+		if derr := deRouteHops(address, OVSBR_OS, mac); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// policing is on the tap interface of the vm on br-int
+func (o *OStackCManager) SetLimit(node *Node, limit Limit) error {
+	address, ok := o.hmap[node.host]
+	if !ok {
+		log.Println("[WARN] address for host:", node.host, "not found")
+		return ErrHostNotFound
+	}
+	if err := policeMac(address, node.mac, limit); err != nil {
 		return err
 	}
 
-	log.Println("[INFO] setup route", cnode.ip, "->", rnode.ip, "->", snode.ip)
+	log.Println("[INFO] set limit of container", node.id, "to", limit)
 	return nil
 }
 
-func (o *OStackCManager) SetShares(node *Node, shares int64) error {
+// distinct addresses of the compute hosts
+func (o *OStackCManager) addrs() []string {
+	addrs := make([]string, 0, len(o.hmap))
+	done := make(map[string]bool)
+	for _, address := range o.hmap {
+		if !done[address] {
+			addrs = append(addrs, address)
+			done[address] = true
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// nova-docker containers are set like those of docker,
+// except for the net priority which we can't reach
+func (o *OStackCManager) SetResources(node *Node, res Resources) error {
+	if res.NetPrio != 0 {
+		return ErrResNotSupported
+	}
 	client, ok := o.dockercls[node.host]
 	if !ok {
 		log.Println("[WARN] docker client for host", node.host, "not found")
 		return ErrHostNotFound
 	}
 
-	if err := client.SetContainer(node.other, &docker.HostConfig{
-		CpuShares: shares,
-		CpuQuota:  int64(shares * CPU_PERIOD / 1024),
-	}); err != nil {
-		log.Println("[WARN] unable to set new shares")
+	if err := client.SetContainer(node.other, resourceConfig(res)); err != nil {
+		log.Println("[WARN] unable to set new resources")
 		return err
 	}
 
-	log.Println("[INFO] set cpu limit for container", node.other, "to", shares)
+	log.Println("[INFO] set resources for container", node.other, "to", res)
 	return nil
 }
 
-func (o *OStackCManager) runc(host, prefix string, shares int64, opts servers.CreateOpts) (*Node, error) {
+func (o *OStackCManager) runc(host, prefix string, res Resources, opts servers.CreateOpts) (*Node, error) {
 	undo := true
 	cont, err := servers.Create(o.osclient, opts).Extract()
 	if err != nil {
@@ -300,7 +475,7 @@ func (o *OStackCManager) runc(host, prefix string, shares int64, opts servers.Cr
 	ip := strings.TrimSpace(strings.Split(tokens[10], ",")[0])
 	node := NewNode(cont.ID, ip, strings.TrimSpace(tokens[11]), host)
 	node.other = prefix + "-" + cont.ID
-	err = o.SetShares(node, shares)
+	err = o.SetResources(node, res)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,210 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	OVERLAY_VXLAN    = "vxlan"
+	OVERLAY_GRE      = "gre"
+	DEF_TUNNEL_KEY   = "1000"
+	TUNNEL_PRIORITY  = 30
+	FLOOD_PRIORITY   = 20
+	MULTICAST_DL_DST = "01:00:00:00:00:00/01:00:00:00:00:00"
+)
+
+var (
+	ErrUnknownOverlay = errors.New("Invalid overlay type")
+	ErrNoEndpoint     = errors.New("no tunnel endpoint for host")
+)
+
+// Overlay connects the bridges of all the hosts with a full mesh of vxlan
+// or gre tunnels. Tunnel ports don't flood, broadcasts are sent into every
+// tunnel once by a flow and traffic out of a tunnel is only switched locally.
+type Overlay struct {
+	kind      string
+	key       string
+	hosts     []string
+	addrs     map[string]string            // host -> address to run commands
+	endpoints map[string]string            // host -> tunnel endpoint
+	ports     map[string]map[string]string // host -> peer host -> ofport
+}
+
+// reads optional [VOIP.OVERLAY] section, nil if it has no type. hmap is
+// host -> docker address, other keys override the tunnel endpoint of a host
+func NewOverlay(config *goconfig.ConfigFile, hmap map[string]string) (*Overlay, error) {
+	kind := config.MustValue("VOIP.OVERLAY", "type", "")
+	switch kind {
+	case "":
+		return nil, nil
+	case OVERLAY_VXLAN, OVERLAY_GRE:
+	default:
+		return nil, ErrUnknownOverlay
+	}
+
+	o := &Overlay{
+		kind:      kind,
+		key:       config.MustValue("VOIP.OVERLAY", "key", DEF_TUNNEL_KEY),
+		addrs:     make(map[string]string),
+		endpoints: make(map[string]string),
+		ports:     make(map[string]map[string]string),
+	}
+	for host, address := range hmap {
+		o.hosts = append(o.hosts, host)
+		o.addrs[host] = hostOf(address)
+		o.endpoints[host] = config.MustValue("VOIP.OVERLAY", host, o.addrs[host])
+		if o.endpoints[host] == "" {
+			return nil, ErrNoEndpoint
+		}
+		o.ports[host] = make(map[string]string)
+	}
+	sort.Strings(o.hosts)
+
+	log.Println("[INFO] using", kind, "overlay between", o.hosts)
+	return o, nil
+}
+
+// ip address of a docker address, empty for a local unix socket
+func hostOf(address string) string {
+	if strings.HasPrefix(address, "unix://") {
+		return ""
+	}
+	address = strings.TrimPrefix(address, "tcp://")
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// interface names are limited to 15 characters
+func tunnelName(peer string) string {
+	h := fnv.New32a()
+	h.Write([]byte(peer))
+	return fmt.Sprintf("tun%08x", h.Sum32())
+}
+
+func (o *Overlay) addr(host string) string {
+	return o.addrs[host]
+}
+
+// hosts with the same address share the bridge
+func (o *Overlay) sameBridge(h1, h2 string) bool {
+	return o.addrs[h1] == o.addrs[h2]
+}
+
+// bridges must exist already on all the hosts
+func (o *Overlay) Setup() error {
+	for _, host := range o.hosts {
+		var flood []string
+		for _, peer := range o.hosts {
+			if o.sameBridge(host, peer) {
+				continue
+			}
+
+			port, err := o.addTunnel(host, peer)
+			if err != nil {
+				return err
+			}
+			o.ports[host][peer] = port
+			flood = append(flood, "output:"+port)
+
+			_, err = runshAt(o.addr(host), "sudo ovs-ofctl add-flow "+OVS_BRIDGE+
+				" priority="+strconv.Itoa(TUNNEL_PRIORITY)+",in_port="+port+",actions=NORMAL")
+			if err != nil {
+				return err
+			}
+		}
+		if len(flood) == 0 {
+			continue
+		}
+
+		// broadcasts (arp) from the containers reach all the other hosts
+		_, err := runshAt(o.addr(host), "sudo ovs-ofctl add-flow "+OVS_BRIDGE+
+			" priority="+strconv.Itoa(FLOOD_PRIORITY)+",dl_dst="+MULTICAST_DL_DST+
+			",actions=NORMAL,"+strings.Join(flood, ","))
+		if err != nil {
+			return err
+		}
+		log.Println("[INFO] setup overlay on host", host)
+	}
+
+	return nil
+}
+
+// tunnel on the bridge of host towards peer, returns its ofport
+func (o *Overlay) addTunnel(host, peer string) (string, error) {
+	name := tunnelName(peer)
+	_, err := runshAt(o.addr(host), "sudo ovs-vsctl --may-exist add-port "+OVS_BRIDGE+" "+name+
+		" -- set interface "+name+" type="+o.kind+" options:remote_ip="+o.endpoints[peer]+
+		" options:key="+o.key+" && sudo ovs-ofctl mod-port "+OVS_BRIDGE+" "+name+" no-flood")
+	if err != nil {
+		log.Println("[WARN] unable to create tunnel from", host, "to", peer, err)
+		return "", err
+	}
+
+	out, err := runshAt(o.addr(host), "sudo ovs-vsctl get interface "+name+" ofport")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// port on the bridge of host towards the bridge of
+// peer, empty if both hosts share the bridge
+func (o *Overlay) Tunnel(host, peer string) string {
+	if o.sameBridge(host, peer) {
+		return ""
+	}
+	return o.ports[host][peer]
+}
+
+// traffic to node to on the bridge of from is sent into the tunnel towards
+// its host. The flow is shared by all the chains through to and stays.
+func (o *Overlay) Forward(from, to *Node) error {
+	port := o.Tunnel(from.host, to.host)
+	if port == "" {
+		return nil
+	}
+
+	err := ovsdForward(o.addr(from.host), to.mac, port)
+	if err != nil {
+		log.Println("[WARN] unable to forward", to.mac, "on host", from.host, err)
+	}
+	return err
+}
+
+// the flow Forward installs as the bridge lists it, empty if there is none
+func (o *Overlay) ForwardFlow(from, to *Node) string {
+	port := o.Tunnel(from.host, to.host)
+	if port == "" {
+		return ""
+	}
+	return forwardFlow(to.mac, port)
+}
+
+// removes the routes of the node and the flows towards it on other hosts
+func (o *Overlay) DeRoute(node *Node) error {
+	err := deRouteHops(o.addr(node.host), OVS_BRIDGE, node.mac)
+	for _, host := range o.hosts {
+		if o.sameBridge(host, node.host) {
+			continue
+		}
+		if ferr := ovsdUnForward(o.addr(host), node.mac); ferr != nil {
+			log.Println("[WARN] unable to remove forwarding of", node.mac, "on host", host, ferr)
+			if err == nil {
+				err = ferr
+			}
+		}
+	}
+
+	return err
+}
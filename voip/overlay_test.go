@@ -0,0 +1,90 @@
+package voip
+
+import (
+	"testing"
+
+	"github.com/Unknwon/goconfig"
+)
+
+func TestNewOverlay(t *testing.T) {
+	hmap := map[string]string{
+		"h1": "10.0.0.1:2575",
+		"h2": "tcp://10.0.0.2:2575",
+		"h3": "unix:///var/run/docker.sock",
+	}
+
+	config, _ := goconfig.LoadFromData([]byte("[VOIP.OVERLAY]\nh3=192.168.0.3\n"))
+	if o, err := NewOverlay(config, hmap); o != nil || err != nil {
+		t.Fatal("overlay should be disabled without type, got", o, err)
+	}
+
+	config, _ = goconfig.LoadFromData([]byte("[VOIP.OVERLAY]\ntype=ipip\n"))
+	if _, err := NewOverlay(config, hmap); err != ErrUnknownOverlay {
+		t.Errorf("expected %v, got %v", ErrUnknownOverlay, err)
+	}
+
+	config, _ = goconfig.LoadFromData([]byte("[VOIP.OVERLAY]\ntype=vxlan\n"))
+	if _, err := NewOverlay(config, hmap); err != ErrNoEndpoint {
+		t.Errorf("expected %v, got %v", ErrNoEndpoint, err)
+	}
+
+	config, _ = goconfig.LoadFromData([]byte("[VOIP.OVERLAY]\ntype=gre\nh3=192.168.0.3\n"))
+	o, err := NewOverlay(config, hmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.addr("h1") != "10.0.0.1" || o.addr("h2") != "10.0.0.2" || o.addr("h3") != "" {
+		t.Error("unexpected addresses", o.addrs)
+	}
+	if o.endpoints["h3"] != "192.168.0.3" || o.endpoints["h1"] != "10.0.0.1" {
+		t.Error("unexpected endpoints", o.endpoints)
+	}
+	if o.sameBridge("h1", "h2") || !o.sameBridge("h1", "h1") {
+		t.Error("hosts with different addresses share a bridge")
+	}
+}
+
+func TestTunnelName(t *testing.T) {
+	n1, n2 := tunnelName("kepler"), tunnelName("titan")
+	if n1 == n2 {
+		t.Error("tunnel names collide", n1)
+	}
+	if len(n1) > 15 {
+		t.Error("tunnel name too long", n1)
+	}
+}
+
+func TestChainRoutesForward(t *testing.T) {
+	config, _ := goconfig.LoadFromData([]byte("[VOIP.OVERLAY]\ntype=vxlan\n"))
+	o, err := NewOverlay(config, map[string]string{"h1": "10.0.0.1:2575", "h2": "10.0.0.2:2575"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.ports["h1"]["h2"] = "5"
+	o.ports["h2"]["h1"] = "6"
+	n := &netManager{net: ovsNetwork{}, overlay: o}
+
+	cnode := NewNode("c1", "173.16.1.2", "00:16:3e:00:00:01", "h1")
+	nf := NewNode("n1", "173.16.1.4", "00:16:3e:00:00:02", "h2")
+	snode := NewNode("s1", "173.16.1.3", "00:16:3e:00:00:03", "h1")
+	routes, err := n.ChainRoutes([]*Node{cnode, nf, snode}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || len(routes[cnode.mac]) != 1 {
+		t.Fatalf("expected route flow of the client and a forward flow, got %v", routes)
+	}
+	if flows := routes[snode.mac]; len(flows) != 1 || flows[0] != forwardFlow(snode.mac, "6") {
+		t.Errorf("expected forward flow to the server on h2, got %v", flows)
+	}
+
+	// the server replies on its own bridge, replicas on one host share the flow
+	nf2 := NewNode("n2", "173.16.1.5", "00:16:3e:00:00:04", "h2")
+	routes, err = n.ChainRoutes([]*Node{cnode, nf, nf2, snode}, false, []int64{1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flows := routes[snode.mac]; len(routes) != 2 || len(flows) != 1 || flows[0] != forwardFlow(snode.mac, "6") {
+		t.Errorf("expected one forward flow shared by the replicas, got %v", routes)
+	}
+}
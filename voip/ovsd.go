@@ -1,94 +1,194 @@
 package voip
 
 import (
-	"crypto/rand"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
-)
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
-const (
-	OVS_BRIDGE  = "ovsbr"
-	INET_PREFIX = "173.16.1."
-	INET        = INET_PREFIX + "1"
-	NETMASK     = "255.255.255.0"
+	"github.com/mangalaman93/nfs/pkg/ovs"
 )
 
-var (
-	ErrOvsNotFound = errors.New("openvswitch is not installed")
+const (
+	OVS_BRIDGE = "ovsbr"
+	MAC_PREFIX = "00:16:3e"
 )
 
 var (
-	cur_ip = 1
+	ErrOvsNotFound  = errors.New("openvswitch is not installed")
+	ErrMacNotFound  = errors.New("mac address not found on the bridge")
+	ErrMacNotUnique = errors.New("mac address is not unique on the bridge")
 )
 
 func runsh(cmd string) ([]byte, error) {
 	return exec.Command("/bin/sh", "-c", cmd).Output()
 }
 
-func ovsdInit() error {
-	out, err := runsh("which ovs-vsctl")
-	if err != nil || string(out) == "" {
-		return ErrOvsNotFound
+// runs the command on the machine with address addr, over ssh unless
+// it is this machine. Empty addr means this machine.
+func runshAt(addr, cmd string) ([]byte, error) {
+	if isLocalAddr(addr) {
+		return runsh(cmd)
+	}
+
+	args := []string{"-o", "BatchMode=yes"}
+	if ssh_user != "" {
+		args = append(args, "-l", ssh_user)
+	}
+	args = append(args, addr, cmd)
+	return exec.Command("ssh", args...).Output()
+}
+
+func isLocalAddr(addr string) bool {
+	if addr == "" || addr == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
 	}
-	out, err = runsh("which ovs-docker")
-	if err != nil || string(out) == "" {
-		return ErrOvsNotFound
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
 	}
-	out, err = runsh("which ovs-ofctl")
-	if err != nil || string(out) == "" {
-		return ErrOvsNotFound
+	return false
+}
+
+// the native backend can only reach ovs on this machine
+func nativeAt(addr string) bool {
+	return ovsn != nil && isLocalAddr(addr)
+}
+
+// gateway is the address of the bridge, bits is the prefix length,
+// the bridge gets no address if gateway is empty
+func ovsdInit(addr, gateway string, bits int) error {
+	if nativeAt(addr) {
+		return ovsn.init(OVS_BRIDGE, gateway, bits)
+	}
+
+	for _, tool := range []string{"ovs-vsctl", "ovs-docker", "ovs-ofctl"} {
+		out, err := runshAt(addr, "which "+tool)
+		if err != nil || string(out) == "" {
+			return ErrOvsNotFound
+		}
 	}
 
 	undo := true
-	_, err = runsh("sudo ovs-vsctl br-exists " + OVS_BRIDGE)
+	_, err := runshAt(addr, "sudo ovs-vsctl br-exists "+OVS_BRIDGE)
 	if err != nil {
-		_, err = runsh("sudo ovs-vsctl add-br " + OVS_BRIDGE)
+		_, err = runshAt(addr, "sudo ovs-vsctl add-br "+OVS_BRIDGE)
 		if err != nil {
 			return err
 		}
 	}
 	defer func() {
 		if undo {
-			ovsdDestroy()
+			ovsdDestroy(addr)
 		}
 	}()
 
-	_, err = runsh("sudo ifconfig " + OVS_BRIDGE + " " + INET + " netmask " + NETMASK + " up")
+	// groups need openflow 1.3
+	_, err = runshAt(addr, "sudo ovs-vsctl set bridge "+OVS_BRIDGE+" protocols=OpenFlow10,OpenFlow13")
+	if err != nil {
+		return err
+	}
+
+	cmd := "sudo ip link set " + OVS_BRIDGE + " up"
+	if gateway != "" {
+		cmd = "sudo ifconfig " + OVS_BRIDGE + " " + gateway + "/" + strconv.Itoa(bits) + " up"
+	}
+	_, err = runshAt(addr, cmd)
 	if err != nil {
 		return err
 	}
-	log.Println("[INFO] created ovs bridge", OVS_BRIDGE)
+	log.Println("[INFO] created ovs bridge", OVS_BRIDGE, "on", hostName(addr))
 
 	undo = false
 	return nil
 }
 
-func ovsdDestroy() {
-	runsh("sudo ovs-vsctl del-br " + OVS_BRIDGE)
-	log.Println("[INFO] deleted ovs bridge")
+func ovsdDestroy(addr string) {
+	if nativeAt(addr) {
+		ovsn.destroy(OVS_BRIDGE)
+	} else {
+		runshAt(addr, "sudo ovs-vsctl del-br "+OVS_BRIDGE)
+	}
+	log.Println("[INFO] deleted ovs bridge on", hostName(addr))
 }
 
-func ovsdSetupNetwork(id string) (string, string, error) {
-	mac, err := getMacAddress()
+// ip and mac are allocated by the caller, ovs-docker only
+// knows containers of docker so we add the port of other
+// namespaces ourselves, tagged the same for del-port
+func ovsdSetupNetwork(addr, id string, ns netns, ip string, bits int, mac string) error {
+	if nativeAt(addr) {
+		return ovsn.setupNetwork(OVS_BRIDGE, id, ns, ip, bits, mac)
+	}
+	if ns.named() {
+		return ovsdSetupPort(addr, id, ns, ip, bits, mac)
+	}
+
+	_, err := runshAt(addr, "sudo ovs-docker add-port "+OVS_BRIDGE+" eth0 "+id+
+		" --ipaddress="+ip+"/"+strconv.Itoa(bits)+" --macaddress="+mac)
+	if err != nil {
+		return err
+	}
+
+	// ovs-docker only tags the interface with the container id
+	_, err = runshAt(addr, "sudo ovs-vsctl set interface $(sudo ovs-vsctl --data=bare --no-heading "+
+		"--columns=name find interface external_ids:container_id="+id+
+		" external_ids:container_iface=eth0) external_ids:attached-mac=\\\""+mac+"\\\"")
+	return err
+}
+
+func ovsdSetupPort(addr, id string, ns netns, ip string, bits int, mac string) error {
+	undo := true
+	lport, cport := vethNames(id)
+	_, err := runshAt(addr, "sudo ip link add "+lport+" type veth peer name "+cport)
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	defer func() {
+		if undo {
+			runshAt(addr, "sudo ip link del "+lport)
+		}
+	}()
 
-	cur_ip += 1
-	ip := INET_PREFIX + fmt.Sprint(cur_ip)
-	_, err = runsh("sudo ovs-docker add-port " + OVS_BRIDGE + " eth0 " +
-		id + " --ipaddress=" + ip + "/24 --macaddress=" + mac)
+	_, err = runshAt(addr, "sudo ovs-vsctl add-port "+OVS_BRIDGE+" "+lport+
+		" -- set interface "+lport+" external_ids:container_id="+id+
+		" external_ids:container_iface=eth0 external_ids:attached-mac=\\\""+mac+"\\\"")
+	if err == nil {
+		err = moveVeth(addr, lport, cport, ns, ip, bits, mac)
+	}
 	if err != nil {
-		cur_ip -= 1
+		runshAt(addr, "sudo ovs-vsctl --if-exists del-port "+OVS_BRIDGE+" "+lport)
+		return err
 	}
 
-	return ip, mac, err
+	undo = false
+	return nil
 }
 
-func ovsdUSetupNetwork(id string) {
-	_, err := runsh("sudo ovs-docker del-port " + OVS_BRIDGE + " eth0 " + id)
+func ovsdUSetupNetwork(addr, id string) {
+	var err error
+	if nativeAt(addr) {
+		err = ovsn.usetupNetwork(OVS_BRIDGE, id)
+	} else {
+		_, err = runshAt(addr, "sudo ovs-docker del-port "+OVS_BRIDGE+" eth0 "+id)
+	}
 	if err != nil {
 		log.Println("[INFO] unable to remove interface from container", id, err)
 	} else {
@@ -96,43 +196,506 @@ func ovsdUSetupNetwork(id string) {
 	}
 }
 
-// we only route at client
-// only works for one host (local)
-func ovsdRoute(cmac, mac, smac string) error {
-	cmd := "sudo ovs-vsctl --data=bare --no-heading --columns=ofport find interface " +
-		"external_ids:attached-mac=\\\"" + cmac + "\\\""
-	port, err := runsh(cmd)
+// flow of one hop of a chain on the bridge of from, traffic of the client
+// leaving from towards dst (the server) is sent to to instead. Reverse
+// flows steer the replies of the server to the client the same way.
+type hopFlow struct {
+	cookie  uint64 // same for all the hops of a chain, both directions
+	cip     string
+	reverse bool
+	from    *Node
+	to      *Node
+	dst     string
+	out     string // port towards to, empty if on the same bridge
+}
+
+// chain is the client, the hops in order and the server. Symmetric
+// chains also steer the replies through the hops in reverse order.
+func chainFlows(chain []*Node, symmetric bool) []*hopFlow {
+	cnode, snode := chain[0], chain[len(chain)-1]
+	cookie := chainCookie(cnode.mac)
+
+	flows := make([]*hopFlow, 0)
+	for i := 0; i < len(chain)-2; i++ {
+		flows = append(flows, &hopFlow{
+			cookie: cookie,
+			cip:    cnode.ip,
+			from:   chain[i],
+			to:     chain[i+1],
+			dst:    snode.mac,
+		})
+	}
+	if !symmetric {
+		return flows
+	}
+
+	// the first hop replies to the client directly
+	for i := len(chain) - 1; i > 1; i-- {
+		flows = append(flows, &hopFlow{
+			cookie:  cookie,
+			cip:     cnode.ip,
+			reverse: true,
+			from:    chain[i],
+			to:      chain[i-1],
+			dst:     cnode.mac,
+		})
+	}
+	return flows
+}
+
+// select group on the bridge of the client, each flow of the client
+// towards the server is hashed to one of the replicas by weight
+type hopGroup struct {
+	id      uint32
+	cookie  uint64
+	cip     string
+	from    *Node
+	dst     string
+	to      []*Node
+	weights []int64
+	outs    []string // ports towards the replicas, empty if on the same bridge
+}
+
+func balanceGroup(cnode *Node, replicas []*Node, weights []int64, snode *Node) *hopGroup {
+	cookie := chainCookie(cnode.mac)
+	return &hopGroup{
+		id:      cookieGroup(cookie),
+		cookie:  cookie,
+		cip:     cnode.ip,
+		from:    cnode,
+		dst:     snode.mac,
+		to:      replicas,
+		weights: weights,
+		outs:    make([]string, len(replicas)),
+	}
+}
+
+// bucket weights are 16 bit, zero would take the replica out
+func bucketWeight(weight int64) uint16 {
+	switch {
+	case weight < 1:
+		return 1
+	case weight > 0xffff:
+		return 0xffff
+	default:
+		return uint16(weight)
+	}
+}
+
+// flows of a chain are tagged with the mac of its client
+func chainCookie(cmac string) uint64 {
+	hw, err := net.ParseMAC(cmac)
 	if err != nil {
-		log.Println("[WARN] unable to find client ofport!")
+		return 0
+	}
+	return ovs.MacCookie(hw)
+}
+
+func routeHop(addr, bridge string, hop *hopFlow) error {
+	port, err := ovsdFindMac(addr, hop.from.mac)
+	if err != nil {
+		log.Println("[WARN] unable to find ofport of", hop.from.mac, err)
 		return err
 	}
 
-	cmd = "sudo ovs-ofctl add-flow " + OVS_BRIDGE + " priority=100,ip,dl_src=" + cmac
-	cmd += ",dl_dst=" + smac + ",actions=mod_dl_dst=" + mac + ",resubmit:" + string(port)
-	_, err = runsh(cmd)
+	if nativeAt(addr) {
+		var ofport uint64
+		if hop.out != "" {
+			ofport, err = strconv.ParseUint(hop.out, 10, 32)
+			if err != nil {
+				return err
+			}
+		}
+		return ovsn.route(bridge, hop, uint32(ofport))
+	}
+
+	_, err = runshAt(addr, fmt.Sprintf("sudo ovs-ofctl add-flow %s cookie=%#x,priority=%d,%s,"+
+		"actions=mod_dl_dst=%s,%s", bridge, hop.cookie, ROUTE_PRIORITY,
+		strings.Join(hopMatch(hop), ","), hop.to.mac, hopAction(port, hop.out)))
 	if err != nil {
-		log.Println("[WARN] unable to setup route for", mac, err)
+		log.Println("[WARN] unable to setup route for", hop.to.mac, err)
 		return err
 	}
 
 	return nil
 }
 
-func ovsdDeRoute(cmac string) {
-	cmd := "sudo ovs-ofctl del-flows " + OVS_BRIDGE + " dl_src=" + cmac
-	_, err := runsh(cmd)
+// a client has at most one group, macs of the containers share
+// a three byte prefix so the last three bytes are unique
+func cookieGroup(cookie uint64) uint32 {
+	return uint32(cookie & 0xffffff)
+}
+
+// installs (or updates) the group and sends the traffic of the client to it
+func balanceHop(addr, bridge string, group *hopGroup) error {
+	port, err := ovsdFindMac(addr, group.from.mac)
+	if err != nil {
+		log.Println("[WARN] unable to find ofport of", group.from.mac, err)
+		return err
+	}
+
+	if nativeAt(addr) {
+		outs := make([]uint32, len(group.outs))
+		for i, out := range group.outs {
+			if out == "" {
+				continue
+			}
+			ofport, err := strconv.ParseUint(out, 10, 32)
+			if err != nil {
+				return err
+			}
+			outs[i] = uint32(ofport)
+		}
+		return ovsn.balance(bridge, group, outs)
+	}
+
+	buckets := make([]string, 0, len(group.to))
+	for i := range group.to {
+		buckets = append(buckets, groupBucket(group, i, hopAction(port, group.outs[i])))
+	}
+	_, err = runshAt(addr, fmt.Sprintf("sudo ovs-ofctl -O OpenFlow13 mod-group --may-create %s "+
+		"%s && sudo ovs-ofctl -O OpenFlow13 add-flow %s cookie=%#x,priority=%d,%s,actions=group:%d",
+		bridge, ofctlGroup(group.id, "select", buckets), bridge, group.cookie, ROUTE_PRIORITY,
+		strings.Join(groupMatch(group), ","), group.id))
+	if err != nil {
+		log.Println("[WARN] unable to setup group for", group.from.mac, err)
+		return err
+	}
+
+	return nil
+}
+
+// removes all the flows and the group of the chain of the client from the bridge
+func deRouteHops(addr, bridge, cmac string) error {
+	var err error
+	cookie := chainCookie(cmac)
+	if nativeAt(addr) {
+		err = ovsn.deRoute(bridge, cookie)
+	} else {
+		_, err = runshAt(addr, fmt.Sprintf("sudo ovs-ofctl del-flows %s cookie=%#x/-1 && "+
+			"sudo ovs-ofctl -O OpenFlow13 del-groups %s group_id=%d", bridge, cookie,
+			bridge, cookieGroup(cookie)))
+	}
 	if err != nil {
 		log.Println("[WARN] unable to de-setup route for", cmac, err)
 	}
+
+	return err
+}
+
+// route flows on the bridge by mac of their client, each followed
+// by the group it sends to, in the form hopRouteFlow renders them.
+// Forward flows are by the mac they forward to.
+func routeFlows(addr, bridge string) (map[string][]string, error) {
+	if nativeAt(addr) {
+		return ovsn.routes(bridge)
+	}
+
+	flows, err := runshAt(addr, "sudo ovs-ofctl -O OpenFlow13 dump-flows "+bridge)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := runshAt(addr, "sudo ovs-ofctl -O OpenFlow13 dump-groups "+bridge)
+	if err != nil {
+		return nil, err
+	}
+	return parseRouteFlows(string(flows), string(groups)), nil
+}
+
+// fields of the flows which are not of the match
+var flowStats = map[string]bool{"cookie": true, "duration": true, "table": true,
+	"n_packets": true, "n_bytes": true, "idle_age": true, "hard_age": true,
+	"idle_timeout": true, "hard_timeout": true, "reset_counts": true, "priority": true}
+
+// parses the output of ovs-ofctl dump-flows and dump-groups
+func parseRouteFlows(flows, groups string) map[string][]string {
+	descs := make(map[string]string)
+	for _, line := range strings.Split(groups, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "group_id=") {
+			continue
+		}
+		id := strings.SplitN(strings.TrimPrefix(line, "group_id="), ",", 2)[0]
+		descs["group:"+id] = ofctlActions(line)
+	}
+
+	routes := make(map[string][]string)
+	for _, line := range strings.Split(flows, "\n") {
+		i := strings.Index(line, " actions=")
+		if i < 0 {
+			continue
+		}
+
+		var cookie uint64
+		priority := -1
+		match := make([]string, 0)
+		for _, field := range strings.FieldsFunc(line[:i], func(r rune) bool { return r == ',' || r == ' ' }) {
+			kv := strings.SplitN(field, "=", 2)
+			switch {
+			case kv[0] == "cookie" && len(kv) == 2:
+				cookie, _ = strconv.ParseUint(kv[1], 0, 64)
+			case kv[0] == "priority" && len(kv) == 2:
+				priority, _ = strconv.Atoi(kv[1])
+			case !flowStats[kv[0]]:
+				match = append(match, field)
+			}
+		}
+		actions := strings.Split(ofctlActions(line[i+len(" actions="):]), ",")
+		if priority == ROUTE_PRIORITY && isRouteCookie(cookie) {
+			addRouteFlow(routes, cookie, match, actions, descs)
+		} else if priority == FORWARD_PRIORITY && cookie == FORWARD_COOKIE {
+			addForwardFlow(routes, match, actions)
+		}
+	}
+	return routes
+}
+
+// adds the flow to the routes of its client, followed by the groups it
+// sends to. Groups of no route flow are not ours, e.g. of neutron.
+func addRouteFlow(routes map[string][]string, cookie uint64, match, actions []string, groups map[string]string) {
+	mac := cookieMac(cookie)
+	routes[mac] = append(routes[mac], ofctlFlow(match, actions))
+	for _, action := range actions {
+		if group, ok := groups[action]; ok {
+			routes[mac] = append(routes[mac], group)
+		}
+	}
+}
+
+// forward flows are shared by the chains to the mac, they are
+// found by the mac instead of by a client
+func addForwardFlow(routes map[string][]string, match, actions []string) {
+	for _, field := range match {
+		if strings.HasPrefix(field, "dl_dst=") {
+			mac := strings.TrimPrefix(field, "dl_dst=")
+			routes[mac] = append(routes[mac], ofctlFlow(match, actions))
+		}
+	}
+}
+
+// the flow ovsdForward installs as routeFlows finds it
+func forwardFlow(mac, port string) string {
+	return ofctlFlow([]string{"dl_dst=" + mac}, []string{"output:" + port})
+}
+
+// route flows are compared in the form of ovs-ofctl, with the fields
+// of the match sorted as ovs may print them in another order
+func ofctlFlow(match, actions []string) string {
+	sorted := append([]string{}, match...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",") + " actions=" + strings.Join(actions, ",")
+}
+
+func ofctlGroup(id uint32, typ string, buckets []string) string {
+	return fmt.Sprintf("group_id=%d,type=%s,bucket=%s", id, typ, strings.Join(buckets, ",bucket="))
+}
+
+var (
+	setEthDst = regexp.MustCompile(`set_field:([0-9a-fA-F:]+)->eth_dst`)
+	bucketId  = regexp.MustCompile(`bucket_id:[0-9]+,`)
+)
+
+// openflow 1.3 prints mod_dl_dst as a set_field, newer
+// versions of ovs-ofctl print the ids of the buckets
+func ofctlActions(actions string) string {
+	actions = setEthDst.ReplaceAllString(strings.TrimSpace(actions), "mod_dl_dst:$1")
+	return bucketId.ReplaceAllString(actions, "")
+}
+
+// fields of the match of the route flow of the hop
+func hopMatch(hop *hopFlow) []string {
+	nw := "nw_src"
+	if hop.reverse {
+		nw = "nw_dst"
+	}
+	return []string{"ip", nw + "=" + hop.cip, "dl_src=" + hop.from.mac, "dl_dst=" + hop.dst}
+}
+
+func groupMatch(group *hopGroup) []string {
+	return []string{"ip", "nw_src=" + group.cip, "dl_src=" + group.from.mac, "dl_dst=" + group.dst}
+}
+
+// towards the next hop through out, or switched again as
+// if sent by the port of the previous hop if out is empty
+func hopAction(port, out string) string {
+	if out != "" {
+		return "output:" + out
+	}
+	return "resubmit:" + port
+}
+
+func groupBucket(group *hopGroup, i int, action string) string {
+	return fmt.Sprintf("weight:%d,actions=mod_dl_dst:%s,%s", bucketWeight(group.weights[i]),
+		group.to[i].mac, action)
+}
+
+// action towards the next hop once installed, the native
+// backend switches normally instead of resubmitting
+func nextHopAction(addr, mac, out string) (string, error) {
+	switch {
+	case out != "":
+		return hopAction("", out), nil
+	case nativeAt(addr):
+		return "NORMAL", nil
+	}
+
+	port, err := ovsdFindMac(addr, mac)
+	if err != nil {
+		return "", err
+	}
+	return hopAction(port, out), nil
 }
 
-// TODO: unique mac?
-func getMacAddress() (string, error) {
-	buf := make([]byte, 3)
-	_, err := rand.Read(buf)
+// the route flow of the hop as routeFlows finds it once installed
+func hopRouteFlow(addr string, hop *hopFlow) (string, error) {
+	action, err := nextHopAction(addr, hop.from.mac, hop.out)
 	if err != nil {
 		return "", err
 	}
+	return ofctlFlow(hopMatch(hop), []string{"mod_dl_dst:" + hop.to.mac, action}), nil
+}
+
+// the flow of the client to the group and the group, as routeFlows finds them
+func groupRouteFlows(addr string, group *hopGroup) ([]string, error) {
+	buckets := make([]string, 0, len(group.to))
+	for i := range group.to {
+		action, err := nextHopAction(addr, group.from.mac, group.outs[i])
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, groupBucket(group, i, action))
+	}
 
-	return fmt.Sprintf("00:16:3e:%02x:%02x:%02x", buf[0], buf[1], buf[2]), nil
+	return []string{
+		ofctlFlow(groupMatch(group), []string{fmt.Sprintf("group:%d", group.id)}),
+		ofctlGroup(group.id, "select", buckets),
+	}, nil
+}
+
+// cookies of route flows are macs, other flows on the
+// bridge (e.g. of neutron) have cookies with more bits
+func isRouteCookie(cookie uint64) bool {
+	return cookie != 0 && cookie>>48 == 0
+}
+
+func cookieMac(cookie uint64) string {
+	hw := make(net.HardwareAddr, 6)
+	for i := 5; i >= 0; i-- {
+		hw[i] = byte(cookie)
+		cookie >>= 8
+	}
+	return hw.String()
+}
+
+// sends all the traffic to the mac out of port, e.g. into a tunnel
+func ovsdForward(addr, mac, port string) error {
+	if nativeAt(addr) {
+		ofport, err := strconv.ParseUint(port, 10, 32)
+		if err != nil {
+			return err
+		}
+		return ovsn.forward(OVS_BRIDGE, mac, uint32(ofport))
+	}
+
+	_, err := runshAt(addr, "sudo ovs-ofctl add-flow "+OVS_BRIDGE+" cookie="+
+		strconv.Itoa(FORWARD_COOKIE)+",priority="+strconv.Itoa(FORWARD_PRIORITY)+
+		",dl_dst="+mac+",actions=output:"+port)
+	return err
+}
+
+func ovsdUnForward(addr, mac string) error {
+	if nativeAt(addr) {
+		return ovsn.unForward(OVS_BRIDGE, mac)
+	}
+
+	_, err := runshAt(addr, "sudo ovs-ofctl del-flows "+OVS_BRIDGE+" cookie="+
+		strconv.Itoa(FORWARD_COOKIE)+"/-1,dl_dst="+mac)
+	return err
+}
+
+// returns the ofport of the only interface with the mac
+func ovsdFindMac(addr, mac string) (string, error) {
+	if nativeAt(addr) {
+		return ovsn.findMac(mac)
+	}
+	return macColumn(addr, mac, "ofport")
+}
+
+// ingress policing of the interface with the mac, ingress is from the
+// point of view of the bridge so it polices what the container sends
+func policeMac(addr, mac string, limit Limit) error {
+	columns, err := policing(limit)
+	if err != nil {
+		return err
+	}
+	if nativeAt(addr) {
+		return ovsn.limit(mac, columns)
+	}
+
+	name, err := macColumn(addr, mac, "name")
+	if err != nil {
+		log.Println("[WARN] unable to find interface of", mac, err)
+		return err
+	}
+	cmd := "sudo ovs-vsctl set interface " + name
+	for _, column := range policingColumns {
+		cmd += fmt.Sprintf(" %s=%d", column, columns[column])
+	}
+	if _, err := runshAt(addr, cmd); err != nil {
+		log.Println("[WARN] unable to set limit of", mac, err)
+		return err
+	}
+
+	return nil
+}
+
+var policingColumns = []string{"ingress_policing_rate", "ingress_policing_burst",
+	"ingress_policing_kpkts_rate", "ingress_policing_kpkts_burst"}
+
+// ovs polices packets in thousands, other pps would be enforced
+// looser than asked for so they are refused instead
+func policing(limit Limit) (map[string]int64, error) {
+	if limit.Pps%1000 != 0 {
+		return nil, ErrInvalidLimit
+	}
+
+	columns := make(map[string]int64)
+	for _, column := range policingColumns {
+		columns[column] = 0
+	}
+	if limit.Kbps > 0 {
+		columns["ingress_policing_rate"] = limit.Kbps
+		columns["ingress_policing_burst"] = limit.burstKb()
+	}
+	if limit.Pps > 0 {
+		columns["ingress_policing_kpkts_rate"] = limit.Pps / 1000
+		columns["ingress_policing_kpkts_burst"] = (limit.burstPkts() + 999) / 1000
+	}
+	return columns, nil
+}
+
+// column of the only interface with the mac
+func macColumn(addr, mac, column string) (string, error) {
+	out, err := runshAt(addr, "sudo ovs-vsctl --data=bare --no-heading --columns="+column+
+		" find interface external_ids:attached-mac=\\\""+mac+"\\\"")
+	if err != nil {
+		return "", err
+	}
+
+	values := strings.Fields(string(out))
+	switch len(values) {
+	case 0:
+		return "", ErrMacNotFound
+	case 1:
+		return values[0], nil
+	default:
+		return "", ErrMacNotUnique
+	}
+}
+
+func hostName(addr string) string {
+	if addr == "" {
+		return "localhost"
+	}
+	return addr
 }
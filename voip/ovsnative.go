@@ -0,0 +1,561 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/mangalaman93/nfs/pkg/ovs"
+)
+
+const (
+	OVS_SHELL        = "shell"
+	OVS_NATIVE       = "native"
+	DEF_OVS_RUNDIR   = "/var/run/openvswitch"
+	ROUTE_PRIORITY   = 100
+	FORWARD_PRIORITY = 90
+	FORWARD_COOKIE   = 0x4e4653
+	ETH_TYPE_IP      = 0x0800
+)
+
+var (
+	ErrUnknownOvsBackend = errors.New("Invalid ovs backend")
+	ErrRouteNotVerified  = errors.New("route flow not found on the bridge after install")
+)
+
+// native backend, nil if we use ovs command line tools
+var ovsn *ovsNative
+
+// user to run ovs commands as on the other hosts, over ssh
+var ssh_user string
+
+// ovsNative talks to ovsdb-server and to the bridges directly
+// instead of running ovs-vsctl, ovs-ofctl and ovs-docker
+type ovsNative struct {
+	sync.Mutex
+	rundir string
+	db     *ovs.Client
+	ofs    map[string]*ovs.OFConn
+}
+
+// reads optional [VOIP.OVS] section, backend is shell (default) or native
+func ovsdConfigure(config *goconfig.ConfigFile) error {
+	ssh_user = config.MustValue("VOIP.OVS", "ssh_user", "")
+
+	switch config.MustValue("VOIP.OVS", "backend", OVS_SHELL) {
+	case OVS_SHELL:
+		ovsn = nil
+	case OVS_NATIVE:
+		ovsn = &ovsNative{
+			rundir: config.MustValue("VOIP.OVS", "rundir", DEF_OVS_RUNDIR),
+			ofs:    make(map[string]*ovs.OFConn),
+		}
+		log.Println("[INFO] using native ovs backend in", ovsn.rundir)
+	default:
+		return ErrUnknownOvsBackend
+	}
+
+	return nil
+}
+
+func (o *ovsNative) dbConn() (*ovs.Client, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.db != nil {
+		return o.db, nil
+	}
+
+	db, err := ovs.Dial("unix", filepath.Join(o.rundir, "db.sock"))
+	if err != nil {
+		return nil, err
+	}
+	o.db = db
+	return db, nil
+}
+
+// openflow connection to the bridge, using its management socket
+func (o *ovsNative) ofConn(bridge string) (*ovs.OFConn, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if c, ok := o.ofs[bridge]; ok {
+		return c, nil
+	}
+
+	c, err := ovs.DialOF("unix", filepath.Join(o.rundir, bridge+".mgmt"))
+	if err != nil {
+		return nil, err
+	}
+	o.ofs[bridge] = c
+	return c, nil
+}
+
+func (o *ovsNative) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	for bridge, c := range o.ofs {
+		c.Close()
+		delete(o.ofs, bridge)
+	}
+	if o.db != nil {
+		o.db.Close()
+		o.db = nil
+	}
+}
+
+// runs f on the connection to ovsdb-server. A connection lost, e.g.
+// when ovsdb-server restarts, is closed and dialed again once.
+func (o *ovsNative) withDB(f func(db *ovs.Client) error) error {
+	db, err := o.dbConn()
+	if err != nil {
+		return err
+	}
+	if err = f(db); !connLost(err) {
+		return err
+	}
+
+	log.Println("[WARN] lost connection to ovsdb-server, dialing again:", err)
+	o.Lock()
+	if o.db == db {
+		o.db = nil
+	}
+	o.Unlock()
+	db.Close()
+
+	if db, err = o.dbConn(); err != nil {
+		return err
+	}
+	return f(db)
+}
+
+// runs f on the openflow connection to the bridge. A connection lost,
+// e.g. when ovs-vswitchd restarts or the bridge is recreated, is closed
+// and dialed again once.
+func (o *ovsNative) withOF(bridge string, f func(c *ovs.OFConn) error) error {
+	c, err := o.ofConn(bridge)
+	if err != nil {
+		return err
+	}
+	if err = f(c); !connLost(err) {
+		return err
+	}
+
+	log.Println("[WARN] lost openflow connection to", bridge+", dialing again:", err)
+	o.Lock()
+	if o.ofs[bridge] == c {
+		delete(o.ofs, bridge)
+	}
+	o.Unlock()
+	c.Close()
+
+	if c, err = o.ofConn(bridge); err != nil {
+		return err
+	}
+	return f(c)
+}
+
+// errors sent by the switch or the database leave the connection usable
+func connLost(err error) bool {
+	switch err.(type) {
+	case nil, *ovs.OFError, *ovs.RPCError, *ovs.TransactError:
+		return false
+	}
+	return true
+}
+
+func (o *ovsNative) init(bridge, gateway string, bits int) error {
+	err := o.withDB(func(db *ovs.Client) error {
+		ok, err := db.BridgeExists(bridge)
+		if err != nil || ok {
+			return err
+		}
+		return db.AddBridge(bridge, "OpenFlow10", "OpenFlow13")
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd := "sudo ip link set " + bridge + " up"
+	if gateway != "" {
+		cmd = "sudo ip addr replace " + gateway + "/" + strconv.Itoa(bits) + " dev " + bridge + " && " + cmd
+	}
+	_, err = runsh(cmd)
+	return err
+}
+
+func (o *ovsNative) destroy(bridge string) {
+	err := o.withDB(func(db *ovs.Client) error {
+		return db.DelBridge(bridge)
+	})
+	if err != nil {
+		log.Println("[WARN] unable to delete bridge", bridge, err)
+	}
+	o.close()
+}
+
+// same as ovs-docker add-port, veth pair with one end in the container
+func (o *ovsNative) setupNetwork(bridge, id string, ns netns, ip string, bits int, mac string) error {
+	undo := true
+	lport, cport := vethNames(id)
+	_, err := runsh("sudo ip link add " + lport + " type veth peer name " + cport)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if undo {
+			runsh("sudo ip link del " + lport)
+		}
+	}()
+
+	err = o.withDB(func(db *ovs.Client) error {
+		return db.AddPort(bridge, lport, map[string]string{
+			"container_id":    id,
+			"container_iface": "eth0",
+			"attached-mac":    mac,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if undo {
+			o.withDB(func(db *ovs.Client) error {
+				return db.DelPort(bridge, lport)
+			})
+		}
+	}()
+
+	if err := moveVeth("", lport, cport, ns, ip, bits, mac); err != nil {
+		return err
+	}
+
+	undo = false
+	return nil
+}
+
+func (o *ovsNative) usetupNetwork(bridge, id string) error {
+	lport, _ := vethNames(id)
+	err := o.withDB(func(db *ovs.Client) error {
+		return db.DelPort(bridge, lport)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = runsh("sudo ip link del " + lport)
+	return err
+}
+
+// out is the port towards the next hop, 0 for normal switching. The flow
+// is verified after install and removed again if it can't be found.
+func (o *ovsNative) route(bridge string, hop *hopFlow, out uint32) error {
+	src, err1 := net.ParseMAC(hop.from.mac)
+	next, err2 := net.ParseMAC(hop.to.mac)
+	dst, err3 := net.ParseMAC(hop.dst)
+	cip := net.ParseIP(hop.cip)
+	if err1 != nil || err2 != nil || err3 != nil || cip == nil {
+		return errors.New("invalid address in route")
+	}
+
+	if out == 0 {
+		out = ovs.OFPP_NORMAL
+	}
+	match := ovs.Match{EthSrc: src, EthDst: dst, EthType: ETH_TYPE_IP, Ipv4Src: cip}
+	if hop.reverse {
+		match.Ipv4Src, match.Ipv4Dst = nil, cip
+	}
+	err := o.withOF(bridge, func(c *ovs.OFConn) error {
+		return c.FlowMod(&ovs.FlowMod{
+			Command:  ovs.OFPFC_ADD,
+			Cookie:   hop.cookie,
+			Priority: ROUTE_PRIORITY,
+			Match:    match,
+			Actions:  []ovs.Action{&ovs.SetEthDst{Addr: next}, &ovs.Output{Port: out}},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var flows []*ovs.FlowStats
+	err = o.withOF(bridge, func(c *ovs.OFConn) (err error) {
+		flows, err = c.Flows(ovs.Match{EthSrc: src, EthDst: dst}, hop.cookie, ^uint64(0))
+		return err
+	})
+	if err == nil && len(flows) == 0 {
+		err = ErrRouteNotVerified
+	}
+	if err != nil {
+		o.deRoute(bridge, hop.cookie)
+		return err
+	}
+
+	return nil
+}
+
+// outs are the ports towards the replicas, 0 for normal switching.
+// An existing group of the client is modified with the new buckets.
+func (o *ovsNative) balance(bridge string, group *hopGroup, outs []uint32) error {
+	src, err1 := net.ParseMAC(group.from.mac)
+	dst, err2 := net.ParseMAC(group.dst)
+	cip := net.ParseIP(group.cip)
+	if err1 != nil || err2 != nil || cip == nil {
+		return errors.New("invalid address in route")
+	}
+
+	gm := &ovs.GroupMod{
+		Command: ovs.OFPGC_ADD,
+		Type:    ovs.OFPGT_SELECT,
+		GroupId: group.id,
+	}
+	for i, node := range group.to {
+		next, err := net.ParseMAC(node.mac)
+		if err != nil {
+			return err
+		}
+		out := outs[i]
+		if out == 0 {
+			out = ovs.OFPP_NORMAL
+		}
+		gm.Buckets = append(gm.Buckets, &ovs.Bucket{
+			Weight:  bucketWeight(group.weights[i]),
+			Actions: []ovs.Action{&ovs.SetEthDst{Addr: next}, &ovs.Output{Port: out}},
+		})
+	}
+
+	err := o.withOF(bridge, func(c *ovs.OFConn) error {
+		gm.Command = ovs.OFPGC_ADD
+		err := c.GroupMod(gm)
+		if oferr, ok := err.(*ovs.OFError); ok && oferr.Type == ovs.OFPET_GROUP_MOD_FAILED &&
+			oferr.Code == ovs.OFPGMFC_GROUP_EXISTS {
+			gm.Command = ovs.OFPGC_MODIFY
+			err = c.GroupMod(gm)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = o.withOF(bridge, func(c *ovs.OFConn) error {
+		return c.FlowMod(&ovs.FlowMod{
+			Command:  ovs.OFPFC_ADD,
+			Cookie:   group.cookie,
+			Priority: ROUTE_PRIORITY,
+			Match:    ovs.Match{EthSrc: src, EthDst: dst, EthType: ETH_TYPE_IP, Ipv4Src: cip},
+			Actions:  []ovs.Action{&ovs.Group{GroupId: group.id}},
+		})
+	})
+	if err != nil {
+		o.deRoute(bridge, group.cookie)
+		return err
+	}
+
+	return nil
+}
+
+// removes all the flows of a chain and its group if any
+func (o *ovsNative) deRoute(bridge string, cookie uint64) error {
+	return o.withOF(bridge, func(c *ovs.OFConn) error {
+		err := c.FlowMod(&ovs.FlowMod{
+			Command:    ovs.OFPFC_DELETE,
+			Cookie:     cookie,
+			CookieMask: ^uint64(0),
+		})
+		if err != nil {
+			return err
+		}
+
+		// deleting a missing group is not an error
+		return c.GroupMod(&ovs.GroupMod{
+			Command: ovs.OFPGC_DELETE,
+			GroupId: cookieGroup(cookie),
+		})
+	})
+}
+
+// route flows by mac of their client, each followed by its group
+func (o *ovsNative) routes(bridge string) (map[string][]string, error) {
+	var flows []*ovs.FlowStats
+	var groups []*ovs.GroupDesc
+	err := o.withOF(bridge, func(c *ovs.OFConn) (err error) {
+		if flows, err = c.Flows(ovs.Match{}, 0, 0); err != nil {
+			return err
+		}
+		groups, err = c.Groups()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	descs := make(map[string]string)
+	for _, g := range groups {
+		typ := "select"
+		if g.Type != ovs.OFPGT_SELECT {
+			typ = strconv.Itoa(int(g.Type))
+		}
+		buckets := make([]string, 0, len(g.Buckets))
+		for _, b := range g.Buckets {
+			buckets = append(buckets, fmt.Sprintf("weight:%d,actions=%s", b.Weight,
+				strings.Join(ofActions(b.Actions), ",")))
+		}
+		descs[fmt.Sprintf("group:%d", g.GroupId)] = ofctlGroup(g.GroupId, typ, buckets)
+	}
+
+	routes := make(map[string][]string)
+	for _, f := range flows {
+		if f.Priority == ROUTE_PRIORITY && isRouteCookie(f.Cookie) {
+			addRouteFlow(routes, f.Cookie, ofMatch(f.Match), ofActions(f.Actions), descs)
+		} else if f.Priority == FORWARD_PRIORITY && f.Cookie == FORWARD_COOKIE {
+			addForwardFlow(routes, ofMatch(f.Match), ofActions(f.Actions))
+		}
+	}
+	return routes, nil
+}
+
+// fields of the match as ovs-ofctl prints them
+func ofMatch(m ovs.Match) []string {
+	match := make([]string, 0)
+	if m.InPort != 0 {
+		match = append(match, fmt.Sprintf("in_port=%d", m.InPort))
+	}
+	switch m.EthType {
+	case 0:
+	case ETH_TYPE_IP:
+		match = append(match, "ip")
+	default:
+		match = append(match, fmt.Sprintf("dl_type=%#06x", m.EthType))
+	}
+	if m.EthSrc != nil {
+		match = append(match, "dl_src="+m.EthSrc.String())
+	}
+	if m.EthDst != nil {
+		match = append(match, "dl_dst="+m.EthDst.String())
+	}
+	if m.Ipv4Src != nil {
+		match = append(match, "nw_src="+m.Ipv4Src.String())
+	}
+	if m.Ipv4Dst != nil {
+		match = append(match, "nw_dst="+m.Ipv4Dst.String())
+	}
+	return match
+}
+
+func ofActions(actions []ovs.Action) []string {
+	names := make([]string, 0, len(actions))
+	for _, action := range actions {
+		switch a := action.(type) {
+		case *ovs.SetEthDst:
+			names = append(names, "mod_dl_dst:"+a.Addr.String())
+		case *ovs.Output:
+			if a.Port == ovs.OFPP_NORMAL {
+				names = append(names, "NORMAL")
+			} else {
+				names = append(names, fmt.Sprintf("output:%d", a.Port))
+			}
+		case *ovs.Group:
+			names = append(names, fmt.Sprintf("group:%d", a.GroupId))
+		case *ovs.RawAction:
+			names = append(names, fmt.Sprintf("action:%d", a.Type))
+		}
+	}
+	return names
+}
+
+// all the traffic to the mac is sent out of port
+func (o *ovsNative) forward(bridge, mac string, port uint32) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	return o.withOF(bridge, func(c *ovs.OFConn) error {
+		return c.FlowMod(&ovs.FlowMod{
+			Command:  ovs.OFPFC_ADD,
+			Cookie:   FORWARD_COOKIE,
+			Priority: FORWARD_PRIORITY,
+			Match:    ovs.Match{EthDst: hw},
+			Actions:  []ovs.Action{&ovs.Output{Port: port}},
+		})
+	})
+}
+
+func (o *ovsNative) unForward(bridge, mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	return o.withOF(bridge, func(c *ovs.OFConn) error {
+		return c.FlowMod(&ovs.FlowMod{
+			Command:    ovs.OFPFC_DELETE,
+			Cookie:     FORWARD_COOKIE,
+			CookieMask: ^uint64(0),
+			Match:      ovs.Match{EthDst: hw},
+		})
+	})
+}
+
+// returns the ofport of the only interface with the mac
+func (o *ovsNative) findMac(mac string) (string, error) {
+	var ifaces []*ovs.Interface
+	err := o.withDB(func(db *ovs.Client) (err error) {
+		ifaces, err = db.FindInterfaces("attached-mac", mac)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(ifaces) {
+	case 0:
+		return "", ErrMacNotFound
+	case 1:
+		return strconv.Itoa(ifaces[0].OfPort), nil
+	default:
+		return "", ErrMacNotUnique
+	}
+}
+
+// sets the policing columns of the only interface with the mac
+func (o *ovsNative) limit(mac string, columns map[string]int64) error {
+	var ifaces []*ovs.Interface
+	err := o.withDB(func(db *ovs.Client) (err error) {
+		ifaces, err = db.FindInterfaces("attached-mac", mac)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	switch len(ifaces) {
+	case 0:
+		return ErrMacNotFound
+	case 1:
+	default:
+		return ErrMacNotUnique
+	}
+
+	row := make(map[string]interface{})
+	for column, value := range columns {
+		row[column] = value
+	}
+	return o.withDB(func(db *ovs.Client) error {
+		return db.SetInterface(ifaces[0].Name, row)
+	})
+}
+
+// interface names are limited to 15 characters
+func vethNames(id string) (string, string) {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	short := fmt.Sprintf("%08x", h.Sum32())
+	return short + "_l", short + "_c"
+}
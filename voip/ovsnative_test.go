@@ -0,0 +1,133 @@
+package voip
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mangalaman93/nfs/pkg/ovs"
+)
+
+// fakeBridge answers hello, barriers and empty multipart replies on the
+// management socket of a bridge, drop closes all its connections
+type fakeBridge struct {
+	sync.Mutex
+	ln    net.Listener
+	conns []net.Conn
+	dials int
+}
+
+func newFakeBridge(t *testing.T, dir, bridge string) *fakeBridge {
+	ln, err := net.Listen("unix", filepath.Join(dir, bridge+".mgmt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBridge{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.Lock()
+			b.conns = append(b.conns, conn)
+			b.dials++
+			b.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBridge) serve(conn net.Conn) {
+	defer conn.Close()
+	write := func(typ uint8, xid uint32, body []byte) {
+		hdr := make([]byte, 8)
+		hdr[0], hdr[1] = ovs.OFP_VERSION, typ
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(8+len(body)))
+		binary.BigEndian.PutUint32(hdr[4:8], xid)
+		conn.Write(append(hdr, body...))
+	}
+
+	for {
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint16(hdr[2:4])-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		xid := binary.BigEndian.Uint32(hdr[4:8])
+		switch hdr[1] {
+		case ovs.OFPT_HELLO:
+			write(ovs.OFPT_HELLO, xid, nil)
+		case ovs.OFPT_BARRIER_REQUEST:
+			write(ovs.OFPT_BARRIER_REPLY, xid, nil)
+		case ovs.OFPT_MULTIPART_REQUEST:
+			reply := make([]byte, 8)
+			copy(reply, body[:2])
+			write(ovs.OFPT_MULTIPART_REPLY, xid, reply)
+		}
+	}
+}
+
+func (b *fakeBridge) dialed() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.dials
+}
+
+func (b *fakeBridge) drop() {
+	b.Lock()
+	defer b.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func TestNativeReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bridge := newFakeBridge(t, dir, "br0")
+	defer bridge.ln.Close()
+
+	o := &ovsNative{rundir: dir, ofs: make(map[string]*ovs.OFConn)}
+	defer o.close()
+	if _, err := o.routes("br0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. ovs-vswitchd restarted or the bridge was recreated
+	bridge.drop()
+	if _, err := o.routes("br0"); err != nil {
+		t.Fatalf("expected routes after the connection was dropped, got %v", err)
+	}
+	if dials := bridge.dialed(); dials != 2 {
+		t.Errorf("expected the bridge dialed again, got %d dials", dials)
+	}
+	if err := o.deRoute("br0", chainCookie("00:16:3e:00:00:01")); err != nil {
+		t.Errorf("expected the new connection to be kept, got %v", err)
+	}
+	if dials := bridge.dialed(); dials != 2 {
+		t.Errorf("expected no more dials, got %d", dials)
+	}
+
+	// dialing again fails once the bridge is gone for good
+	bridge.drop()
+	bridge.ln.Close()
+	if _, err := o.routes("br0"); err == nil {
+		t.Error("expected an error without the bridge")
+	}
+}
@@ -0,0 +1,319 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	DEF_CGROUP_ROOT    = "/sys/fs/cgroup/nfs"
+	DEF_PROC_LOGS      = "/var/log/nfs"
+	CGROUP_CONTROLLERS = "+cpu +cpuset +memory +io"
+)
+
+var (
+	ErrNoCmd      = errors.New("network function needs a command to run as a process")
+	ErrNoCgroupV2 = errors.New("cgroup v2 is not mounted")
+)
+
+// ProcCManager runs NFs as plain processes, each in a network namespace
+// and a cgroup v2 of its own named after the id of the container, so no
+// daemon is needed and resources are set by writing the cgroup files.
+// NFs need a cmd in the catalogue as images are not used. cadvisor and
+// moncont are not started, the tables have to be written by other means.
+// Without an overlay all the hosts are this machine.
+type ProcCManager struct {
+	*netManager
+	hmap    map[string]string
+	catalog Catalog
+	root    string
+	logs    string
+}
+
+// reads optional [VOIP.PROC] section, the parent of the cgroup
+// has to be able to delegate CGROUP_CONTROLLERS to it
+func NewProcCManager(config *goconfig.ConfigFile) (*ProcCManager, error) {
+	hosts := config.GetKeyList("VOIP.TOPO")
+	if hosts == nil {
+		return nil, ErrNoHosts
+	}
+
+	catalog, err := NewCatalog(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hmap := make(map[string]string)
+	for _, host := range hosts {
+		address, err := config.GetValue("VOIP.TOPO", host)
+		if err != nil {
+			return nil, err
+		}
+		hmap[host] = address
+	}
+	netm, err := newNetManager(config, hmap)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProcCManager{
+		netManager: netm,
+		hmap:       hmap,
+		catalog:    catalog,
+		root:       config.MustValue("VOIP.PROC", "cgroup", DEF_CGROUP_ROOT),
+		logs:       config.MustValue("VOIP.PROC", "log_dir", DEF_PROC_LOGS),
+	}, nil
+}
+
+func (p *ProcCManager) Setup() error {
+	for _, addr := range p.addrs() {
+		if _, err := runshAt(addr, "test -f /sys/fs/cgroup/cgroup.controllers"); err != nil {
+			return ErrNoCgroupV2
+		}
+
+		_, err := runshAt(addr, fmt.Sprintf("sudo mkdir -p %s %s && echo '%s' | sudo tee %s/cgroup.subtree_control %s/cgroup.subtree_control > /dev/null",
+			p.root, p.logs, CGROUP_CONTROLLERS, path.Dir(p.root), p.root))
+		if err != nil {
+			log.Println("[WARN] unable to setup cgroup", p.root, "on", hostName(addr), err)
+			return err
+		}
+		log.Println("[INFO] setup cgroup", p.root, "on", hostName(addr))
+	}
+
+	return p.setup()
+}
+
+// the cgroup stays if processes of an earlier run are left in it
+func (p *ProcCManager) Destroy() {
+	for _, addr := range p.addrs() {
+		runshAt(addr, "sudo rmdir "+p.root)
+	}
+	p.destroyBridges()
+}
+
+// the process runs in its cgroup and namespace with the env of the NF, its
+// output goes to a file in the log dir. The network is setup before the
+// process starts so that it finds eth0.
+func (p *ProcCManager) StartNF(kind, host string, res Resources, params map[string]string) (*Node, error) {
+	if _, ok := p.hmap[host]; !ok {
+		return nil, ErrHostNotFound
+	}
+	if res.NetPrio != 0 {
+		return nil, ErrResNotSupported
+	}
+	nf, err := p.catalog.Get(kind)
+	if err != nil {
+		return nil, err
+	}
+	env, cmd, err := nf.expand(params)
+	if err != nil {
+		return nil, err
+	}
+	if len(cmd) == 0 {
+		return nil, ErrNoCmd
+	}
+
+	undo := true
+	addr := p.addr(host)
+	id := fmt.Sprintf("%s-%s", nf.Name, uuid.NewV1())
+	_, err = runshAt(addr, "sudo ip netns add "+id+" && sudo ip netns exec "+id+" ip link set lo up")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if undo {
+			runshAt(addr, "sudo ip netns del "+id)
+		}
+	}()
+
+	_, err = runshAt(addr, "sudo mkdir "+p.cgroup(id))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if undo {
+			runshAt(addr, p.stopCmd(id))
+		}
+	}()
+	if err := p.writeResources(addr, id, res); err != nil {
+		return nil, err
+	}
+
+	node, err := p.attach(host, id, netns(id))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if undo {
+			p.isolate(node)
+			p.detach(node)
+		}
+	}()
+
+	args := []string{"ip", "netns", "exec", id, "env"}
+	args = append(args, envList(env)...)
+	args = append(args, cmd...)
+	run := fmt.Sprintf("exec > %s 2>&1 < /dev/null; echo $$ > %s/cgroup.procs && exec %s",
+		shellQuote(path.Join(p.logs, id+".log")), p.cgroup(id), shellJoin(args))
+	_, err = runshAt(addr, "sudo setsid sh -c "+shellQuote(run)+" > /dev/null 2>&1 < /dev/null &")
+	if err != nil {
+		return nil, err
+	}
+	log.Println("[INFO] started process of container", id, "on host", host)
+
+	undo = false
+	return node, nil
+}
+
+// processes get STOP_TIMEOUT seconds to exit before they are killed
+func (p *ProcCManager) StopCont(node *Node) error {
+	addr := p.addr(node.host)
+	p.isolate(node)
+
+	if _, err := runshAt(addr, p.stopCmd(node.id)); err != nil {
+		log.Println("[WARN] unable to stop processes of container", node.id, err)
+		return err
+	}
+	log.Println("[INFO] container with id", node.id, "stopped")
+
+	p.detach(node)
+	if _, err := runshAt(addr, "sudo ip netns del "+node.id); err != nil {
+		log.Println("[WARN] unable to delete network namespace of", node.id, err)
+		return err
+	}
+	return nil
+}
+
+func (p *ProcCManager) Adopt(node *Node) error {
+	if _, ok := p.hmap[node.host]; !ok {
+		return ErrHostNotFound
+	}
+
+	// files of cgroups have no size, we read them instead
+	_, err := runshAt(p.addr(node.host), "grep -q . "+p.cgroup(node.id)+"/cgroup.procs"+
+		" && test -e /var/run/netns/"+node.id)
+	if err != nil {
+		return ErrNotRunning
+	}
+
+	if err := p.reserve(node); err != nil {
+		return err
+	}
+	log.Println("[INFO] adopted container", node.id, "ip:", node.ip, "mac:", node.mac)
+	return nil
+}
+
+// processes have no labels, every cgroup with processes under the root
+// is an NF. Hosts on the same machine share the root.
+func (p *ProcCManager) List() ([]*Node, error) {
+	hosts := make([]string, 0, len(p.hmap))
+	for host := range p.hmap {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	nodes := make([]*Node, 0)
+	done := make(map[string]bool)
+	for _, host := range hosts {
+		addr := p.addr(host)
+		if done[addr] {
+			continue
+		}
+		done[addr] = true
+
+		out, err := runshAt(addr, fmt.Sprintf("for d in %s/*/; do grep -q . $d/cgroup.procs 2>/dev/null && basename $d; done; true", p.root))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range strings.Fields(string(out)) {
+			nodes = append(nodes, &Node{id: id, host: host})
+		}
+	}
+	return nodes, nil
+}
+
+// there is no net_prio in cgroup v2
+func (p *ProcCManager) SetResources(node *Node, res Resources) error {
+	if res.NetPrio != 0 {
+		return ErrResNotSupported
+	}
+
+	if err := p.writeResources(p.addr(node.host), node.id, res); err != nil {
+		log.Println("[WARN] unable to set new resources")
+		return err
+	}
+
+	log.Println("[INFO] set resources for container", node.id, "to", res)
+	return nil
+}
+
+func (p *ProcCManager) writeResources(addr, id string, res Resources) error {
+	files := cgroupFiles(res)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cmds := make([]string, 0, len(files))
+	for _, name := range names {
+		cmds = append(cmds, fmt.Sprintf("echo %s | sudo tee %s/%s > /dev/null",
+			shellQuote(files[name]), p.cgroup(id), name))
+	}
+	_, err := runshAt(addr, strings.Join(cmds, " && "))
+	return err
+}
+
+func (p *ProcCManager) cgroup(id string) string {
+	return path.Join(p.root, id)
+}
+
+// cgroup.kill kills what is left after the timeout, the cgroup
+// can only be removed once there are no processes in it
+func (p *ProcCManager) stopCmd(id string) string {
+	cg := p.cgroup(id)
+	return fmt.Sprintf("if [ -d %s ]; then sudo kill $(cat %s/cgroup.procs) 2>/dev/null;"+
+		" for i in $(seq %d); do grep -q . %s/cgroup.procs || break; sleep 0.1; done;"+
+		" echo 1 | sudo tee %s/cgroup.kill > /dev/null;"+
+		" while grep -q . %s/cgroup.procs; do sleep 0.1; done; sudo rmdir %s; fi",
+		cg, cg, STOP_TIMEOUT*10, cg, cg, cg, cg)
+}
+
+// files of cgroup v2 for the resources, zero values are left out. Shares
+// and blkio weights are converted to weights the way runc does.
+func cgroupFiles(res Resources) map[string]string {
+	files := map[string]string{
+		"cpu.weight": strconv.FormatInt(1+(res.Shares-2)*9999/262142, 10),
+		"cpu.max":    fmt.Sprintf("%d %d", res.quota(), CPU_PERIOD),
+	}
+	if res.Cpuset != "" {
+		files["cpuset.cpus"] = res.Cpuset
+	}
+	if res.Memory != 0 {
+		files["memory.max"] = strconv.FormatInt(res.Memory, 10)
+	}
+	if res.BlkioWeight != 0 {
+		files["io.weight"] = "default " + strconv.FormatInt(1+(res.BlkioWeight-10)*9999/990, 10)
+	}
+	return files
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,33 @@
+package voip
+
+import (
+	"testing"
+)
+
+func TestCgroupFiles(t *testing.T) {
+	files := cgroupFiles(Resources{Shares: 1024})
+	if len(files) != 2 || files["cpu.weight"] != "39" || files["cpu.max"] != "100000 100000" {
+		t.Errorf("expected only cpu files, got %v", files)
+	}
+
+	files = cgroupFiles(Resources{Shares: 2, Quota: 5000, Cpuset: "0-1", Memory: 1 << 28, BlkioWeight: 1000})
+	expected := map[string]string{
+		"cpu.weight":  "1",
+		"cpu.max":     "5000 100000",
+		"cpuset.cpus": "0-1",
+		"memory.max":  "268435456",
+		"io.weight":   "default 10000",
+	}
+	for name, value := range expected {
+		if files[name] != value {
+			t.Errorf("expected %s %q, got %q", name, value, files[name])
+		}
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	args := shellJoin([]string{"env", "ARGS=-q 0", "it's"})
+	if args != `'env' 'ARGS=-q 0' 'it'\''s'` {
+		t.Errorf("unexpected quoting %s", args)
+	}
+}
@@ -0,0 +1,176 @@
+package voip
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+)
+
+const (
+	DEF_RECONCILE_PERIOD = 60000
+)
+
+// Drift is a difference between the chains and the route flows found on
+// the bridges. Chain is empty for stale flows of a client without a chain
+// (or forward flows to a mac no chain goes to), missing are the flows the
+// chain needs which are not found as they are. Forward flows to the server
+// are shared with other chains, only those the chain needs are found.
+type Drift struct {
+	Chain    string    `json:"chain,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Mac      string    `json:"mac"`
+	Expected int       `json:"expected"`
+	Found    int       `json:"found"`
+	Missing  int       `json:"missing"`
+	Repaired bool      `json:"repaired"`
+	Err      string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// reads optional [VOIP.RECONCILE] section, period is in ms and 0 disables
+func reconcilePeriod(config *goconfig.ConfigFile) time.Duration {
+	period := config.MustInt64("VOIP.RECONCILE", "period", DEF_RECONCILE_PERIOD)
+	return time.Duration(period) * time.Millisecond
+}
+
+// runs until Stop replaces the quit channel of the handler
+func (vh *VoipHandler) reconcileLoop(quit chan struct{}) {
+	ticker := time.NewTicker(vh.reconcile_period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			vh.Lock()
+			if vh.quit == quit {
+				vh.reconcile()
+			}
+			vh.Unlock()
+		}
+	}
+}
+
+// compares the route flows of each chain with those it needs, so a flow
+// to the old port of a restarted container or a changed group is found as
+// well as a missing flow. Chains that differ are reinstalled and flows of
+// no chain are removed.
+func (vh *VoipHandler) reconcile() {
+	found, err := vh.cmgr.Routes()
+	if err != nil {
+		log.Println("[WARN] unable to reconcile routes:", err)
+		return
+	}
+	if found == nil {
+		return
+	}
+
+	now := time.Now()
+	drifts := make([]*Drift, 0)
+	known := make(map[string]bool)
+	for _, c := range vh.sortedChains() {
+		mac := c.cnode.mac
+		known[mac] = true
+		expected, err := vh.chainRoutes(c)
+		nexpected, nfound, missing := 0, len(found[mac]), 0
+		for emac, flows := range expected {
+			known[emac] = true
+			nexpected += len(flows)
+			m := missingRoutes(flows, found[emac])
+			missing += m
+			if emac != mac {
+				nfound += len(flows) - m
+			}
+		}
+		if err == nil && missing == 0 && nexpected == nfound {
+			continue
+		}
+
+		d := &Drift{
+			Chain:    c.id,
+			Client:   c.cnode.id,
+			Mac:      mac,
+			Expected: nexpected,
+			Found:    nfound,
+			Missing:  missing,
+			Time:     now,
+		}
+		if err != nil {
+			log.Println("[WARN] unable to find route flows chain", c.id, "needs", err)
+		}
+		log.Println("[WARN] chain", c.id, "has", d.Found, "route flows, expected", d.Expected,
+			"of which", d.Missing, "are missing")
+		if err := vh.cmgr.DeRoute(c.nodes()); err != nil {
+			log.Println("[WARN] unable to remove route of chain", c.id, err)
+		}
+		if err := vh.install(c); err != nil {
+			log.Println("[WARN] unable to repair chain", c.id, err)
+			d.Err = err.Error()
+		} else {
+			d.Repaired = true
+		}
+		drifts = append(drifts, d)
+	}
+
+	stale := make([]string, 0)
+	for mac := range found {
+		if !known[mac] {
+			stale = append(stale, mac)
+		}
+	}
+	sort.Strings(stale)
+	for _, mac := range stale {
+		d := &Drift{Mac: mac, Found: len(found[mac]), Time: now}
+		log.Println("[WARN] removing", d.Found, "stale route flows of", mac)
+		if err := vh.cmgr.PurgeRoutes(mac); err != nil {
+			d.Err = err.Error()
+		} else {
+			d.Repaired = true
+		}
+		drifts = append(drifts, d)
+	}
+
+	vh.drifts = drifts
+}
+
+// the flows the chain needs by mac, weighted as install balances it
+func (vh *VoipHandler) chainRoutes(c *chain) (map[string][]string, error) {
+	if !c.balanced {
+		return vh.cmgr.ChainRoutes(c.nodes(), c.symmetric, nil)
+	}
+	return vh.cmgr.ChainRoutes(c.nodes(), false, vh.weights(c))
+}
+
+// number of the expected flows which are not found, counting duplicates
+func missingRoutes(expected, found []string) int {
+	count := make(map[string]int)
+	for _, flow := range found {
+		count[flow]++
+	}
+
+	missing := 0
+	for _, flow := range expected {
+		if count[flow] == 0 {
+			missing++
+		} else {
+			count[flow]--
+		}
+	}
+	return missing
+}
+
+// drift found by the last reconcile, run now if reconcile is given
+func (vh *VoipHandler) getDrift(req *Request) *Response {
+	now, err := boolKey(req.KeyVal, "reconcile")
+	if err != nil {
+		return errResponse(err)
+	}
+	if now {
+		vh.reconcile()
+	}
+
+	return &Response{Drifts: vh.drifts}
+}
@@ -0,0 +1,142 @@
+package voip
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, "", cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	nf2 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	id := request(t, vh, ReqRouteCont, map[string]string{
+		"client": client, "hops": nf1 + "," + nf2, "server": server, "symmetric": "true"})
+
+	vh.reconcile()
+	if len(vh.drifts) != 0 {
+		t.Fatalf("expected no drift, got %+v", vh.drifts[0])
+	}
+
+	// a flow deleted by hand and flows of a client long gone
+	cmac := vh.anodes[client].mac
+	cmgr.flows[cmac] = cmgr.flows[cmac][1:]
+	cmgr.flows["00:16:3e:00:00:99"] = []string{"flow1", "flow2"}
+
+	resp := vh.HandleRequest(&Request{Code: ReqGetDrift, KeyVal: map[string]string{"reconcile": "true"}})
+	if resp.Err != "" || len(resp.Drifts) != 2 {
+		t.Fatalf("expected 2 drifts, got %v %+v", resp.Err, resp.Drifts)
+	}
+	if d := resp.Drifts[0]; d.Chain != id || d.Client != client || d.Expected != 4 || d.Found != 3 ||
+		d.Missing != 1 || !d.Repaired {
+		t.Errorf("unexpected drift of chain %+v", d)
+	}
+	if d := resp.Drifts[1]; d.Chain != "" || d.Mac != "00:16:3e:00:00:99" || d.Found != 2 || !d.Repaired {
+		t.Errorf("unexpected stale drift %+v", d)
+	}
+	if len(cmgr.flows[cmac]) != 4 {
+		t.Errorf("expected chain reinstalled, got %d flows", len(cmgr.flows[cmac]))
+	}
+	if _, ok := cmgr.flows["00:16:3e:00:00:99"]; ok {
+		t.Error("expected stale flows purged")
+	}
+
+	api := NewHttpApi(vh)
+	code, res := apiCall(t, api, "POST", "/voip/drift", "")
+	if code != http.StatusOK || len(res.Drifts) != 0 {
+		t.Errorf("expected no drift after repair, got %d %+v", code, res.Drifts)
+	}
+	if code, _ := apiCall(t, api, "DELETE", "/voip/drift", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, got %d", http.StatusMethodNotAllowed, code)
+	}
+}
+
+func TestReconcileChangedFlows(t *testing.T) {
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, "", cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	nf2 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	request(t, vh, ReqRouteCont, map[string]string{
+		"client": client, "hops": nf1 + "," + nf2, "server": server, "symmetric": "true"})
+
+	// nf1 restarted with a new port, its flow still resubmits from the old one
+	cmac := vh.anodes[client].mac
+	cmgr.ports[nf1] = 7
+	vh.reconcile()
+	if len(vh.drifts) != 1 {
+		t.Fatalf("expected 1 drift, got %d", len(vh.drifts))
+	}
+	if d := vh.drifts[0]; d.Expected != 4 || d.Found != 4 || d.Missing != 1 || !d.Repaired {
+		t.Errorf("unexpected drift of chain %+v", d)
+	}
+	if flows := strings.Join(cmgr.flows[cmac], "\n"); !strings.Contains(flows, "resubmit:7") {
+		t.Errorf("expected flow from the new port, got %s", flows)
+	}
+	vh.reconcile()
+	if len(vh.drifts) != 0 {
+		t.Errorf("expected no drift after repair, got %+v", vh.drifts[0])
+	}
+
+	// a bucket of the group changed by hand
+	nf3 := request(t, vh, ReqStartSnort, map[string]string{"shares": "512"})
+	p := vh.pools[nf3]
+	p.members = append(p.members, nf1)
+	vh.mnodes[nf1].pool = nf3
+	delete(vh.pools, nf1)
+	client2 := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	request(t, vh, ReqRouteCont, map[string]string{
+		"client": client2, "router": nf3, "server": server, "balanced": "true"})
+
+	c2mac := vh.anodes[client2].mac
+	cmgr.flows[c2mac][1] = strings.Replace(cmgr.flows[c2mac][1], "weight:256", "weight:1", 1)
+	vh.reconcile()
+	if len(vh.drifts) != 1 || vh.drifts[0].Mac != c2mac || vh.drifts[0].Missing != 1 || !vh.drifts[0].Repaired {
+		t.Fatalf("expected drift of the balanced chain, got %+v", vh.drifts)
+	}
+	if !strings.Contains(cmgr.flows[c2mac][1], "weight:256") {
+		t.Errorf("expected bucket repaired, got %s", cmgr.flows[c2mac][1])
+	}
+}
+
+func TestReconcileForward(t *testing.T) {
+	cmgr := newFakeCManager()
+	cmgr.tunnel = "9"
+	vh := testHandlerWith(t, "", cmgr)
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	client := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	nf1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256"})
+	request(t, vh, ReqRouteCont, map[string]string{"client": client, "hops": nf1, "server": server})
+	vh.reconcile()
+	if len(vh.drifts) != 0 {
+		t.Fatalf("expected no drift, got %+v", vh.drifts[0])
+	}
+
+	// the flow into the tunnel towards the server is lost
+	smac := vh.anodes[server].mac
+	delete(cmgr.flows, smac)
+	vh.reconcile()
+	if len(vh.drifts) != 1 || vh.drifts[0].Client != client || vh.drifts[0].Missing != 1 || !vh.drifts[0].Repaired {
+		t.Fatalf("expected drift of the chain, got %+v", vh.drifts)
+	}
+	if len(cmgr.flows[smac]) != 1 {
+		t.Errorf("expected forward flow installed again, got %v", cmgr.flows[smac])
+	}
+
+	// and stays once no chain goes to the server
+	request(t, vh, ReqStopCont, map[string]string{"cont": client})
+	vh.reconcile()
+	if len(vh.drifts) != 1 || vh.drifts[0].Mac != smac || vh.drifts[0].Chain != "" || !vh.drifts[0].Repaired {
+		t.Fatalf("expected stale forward flow, got %+v", vh.drifts)
+	}
+	if _, ok := cmgr.flows[smac]; ok {
+		t.Error("expected stale forward flow purged")
+	}
+}
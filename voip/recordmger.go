@@ -0,0 +1,107 @@
+package voip
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mangalaman93/nfs/pkg/record"
+)
+
+// recordCManager records every control action taken through the container
+// manager, along with its error if any, before returning the result
+type recordCManager struct {
+	CManager
+	rec *record.Recorder
+}
+
+// starts by the scaler are recorded as well as those of requests
+func (r *recordCManager) StartNF(kind, host string, res Resources, params map[string]string) (*Node, error) {
+	node, err := r.CManager.StartNF(kind, host, res, params)
+	args := res.keyVal()
+	args["kind"] = kind
+	args["host"] = host
+	id := ""
+	if node != nil {
+		id = node.id
+	}
+	r.rec.Action("start", id, withErr(args, err))
+	return node, err
+}
+
+func (r *recordCManager) StopCont(node *Node) error {
+	err := r.CManager.StopCont(node)
+	r.rec.Action("stop", node.id, withErr(map[string]string{}, err))
+	return err
+}
+
+func (r *recordCManager) Adopt(node *Node) error {
+	err := r.CManager.Adopt(node)
+	r.rec.Action("adopt", node.id, withErr(map[string]string{}, err))
+	return err
+}
+
+func (r *recordCManager) Route(chain []*Node, symmetric bool) error {
+	err := r.CManager.Route(chain, symmetric)
+	args := chainArgs(chain)
+	args["symmetric"] = strconv.FormatBool(symmetric)
+	r.rec.Action("route", chain[0].id, withErr(args, err))
+	return err
+}
+
+func (r *recordCManager) Balance(cnode *Node, replicas []*Node, weights []int64, snode *Node) error {
+	err := r.CManager.Balance(cnode, replicas, weights, snode)
+	args := chainArgs(chainNodes(cnode, replicas, snode))
+	sweights := make([]string, 0, len(weights))
+	for _, weight := range weights {
+		sweights = append(sweights, strconv.FormatInt(weight, 10))
+	}
+	args["weights"] = strings.Join(sweights, ",")
+	r.rec.Action("balance", cnode.id, withErr(args, err))
+	return err
+}
+
+func (r *recordCManager) DeRoute(chain []*Node) error {
+	err := r.CManager.DeRoute(chain)
+	r.rec.Action("deroute", chain[0].id, withErr(chainArgs(chain), err))
+	return err
+}
+
+func (r *recordCManager) PurgeRoutes(mac string) error {
+	err := r.CManager.PurgeRoutes(mac)
+	r.rec.Action("purge_routes", mac, withErr(map[string]string{}, err))
+	return err
+}
+
+func (r *recordCManager) SetLimit(node *Node, limit Limit) error {
+	err := r.CManager.SetLimit(node, limit)
+	r.rec.Action("set_limit", node.id, withErr(map[string]string{
+		"kbps": strconv.FormatInt(limit.Kbps, 10),
+		"pps":  strconv.FormatInt(limit.Pps, 10),
+	}, err))
+	return err
+}
+
+func (r *recordCManager) SetResources(node *Node, res Resources) error {
+	err := r.CManager.SetResources(node, res)
+	r.rec.Action("set_resources", node.id, withErr(res.keyVal(), err))
+	return err
+}
+
+// hops are comma separated in order
+func chainArgs(chain []*Node) map[string]string {
+	hops := make([]string, 0, len(chain))
+	for _, node := range chain[1 : len(chain)-1] {
+		hops = append(hops, node.id)
+	}
+	return map[string]string{
+		"hops":   strings.Join(hops, ","),
+		"server": chain[len(chain)-1].id,
+	}
+}
+
+func withErr(args map[string]string, err error) map[string]string {
+	if err != nil {
+		args["err"] = err.Error()
+	}
+	return args
+}
@@ -0,0 +1,48 @@
+package voip
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mangalaman93/nfs/pkg/record"
+)
+
+func TestRecordStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := record.NewRecorder(dir, record.DEF_MAX_SIZE, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recordCManager{CManager: newFakeCManager(), rec: rec}
+	node, err := r.StartNF(ROLE_SNORT, "h1", Resources{Shares: 512}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.StartNF(ROLE_SNORT, "h2", Resources{Shares: 512}, nil); err != ErrHostNotFound {
+		t.Errorf("expected %v, got %v", ErrHostNotFound, err)
+	}
+	rec.Close()
+
+	file, err := os.Open(path.Join(dir, record.FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, err := record.ReadEntries(file)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d %v", len(entries), err)
+	}
+	if e := entries[0]; e.Action != "start" || e.Node != node.id || e.Args["kind"] != ROLE_SNORT || e.Args["shares"] != "512" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := entries[1]; e.Node != "" || e.Args["host"] != "h2" || e.Args["err"] != ErrHostNotFound.Error() {
+		t.Errorf("unexpected entry of the failed start %+v", e)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"strconv"
 )
 
+// sipp clients take rate changes on this udp port
+const CLIENT_CTRL_PORT = 8888
+
 var (
 	ErrKeyNotFound = errors.New("All required keys not found")
 	ErrIdNotExists = errors.New("container id doesn't exists")
@@ -18,6 +21,16 @@ const (
 	ReqStopCont
 	ReqRouteCont
 	ReqSetRate
+	ReqListNodes
+	ReqGetNode
+	ReqInsertHop
+	ReqRemoveHop
+	ReqDelChain
+	ReqListChains
+	ReqGetDrift
+	ReqSetLimit
+	ReqStartNF
+	ReqSetResources
 )
 
 type Request struct {
@@ -28,76 +41,84 @@ type Request struct {
 type Response struct {
 	Result string
 	Err    string
+	Status int // http status matching Err
+	Nodes  []*NodeInfo
+	Chains []*ChainInfo
+	Drifts []*Drift
 }
 
-func (vh *VoipHandler) addServer(req *Request) *Response {
-	kv := req.KeyVal
-	host, ok1 := kv["host"]
-	sshares, ok2 := kv["shares"]
-	if !ok1 || !ok2 {
-		return &Response{Err: ErrKeyNotFound.Error()}
-	}
-
-	shares, err := strconv.ParseInt(sshares, 10, 64)
-	if err != nil {
-		return &Response{Err: err.Error()}
-	}
+func errResponse(err error) *Response {
+	return &Response{Err: err.Error(), Status: errStatus(err)}
+}
 
-	node, err := vh.cmgr.StartServer(host, shares)
-	if err != nil {
-		return &Response{Err: err.Error()}
+// the kind of NF is given by the request code or the kind key
+func (vh *VoipHandler) addNF(req *Request) *Response {
+	kind, ok := req.KeyVal["kind"]
+	if !ok {
+		return errResponse(ErrKeyNotFound)
 	}
-
-	vh.anodes[node.id] = node
-	return &Response{Result: node.id}
+	return vh.startNF(kind, req)
 }
 
-func (vh *VoipHandler) addSnort(req *Request) *Response {
+// all the keys of the request are params of the NF, links of the NF are
+// ids of containers in the request and the NF gets their ip instead
+func (vh *VoipHandler) startNF(kind string, req *Request) *Response {
 	kv := req.KeyVal
-	host, ok1 := kv["host"]
-	sshares, ok2 := kv["shares"]
-	if !ok1 || !ok2 {
-		return &Response{Err: ErrKeyNotFound.Error()}
-	}
-
-	shares, err := strconv.ParseInt(sshares, 10, 64)
+	nf, err := vh.catalog.Get(kind)
 	if err != nil {
-		return &Response{Err: err.Error()}
+		return errResponse(err)
+	}
+	if _, ok := kv["shares"]; !ok {
+		return errResponse(ErrKeyNotFound)
 	}
 
-	node, err := vh.cmgr.StartSnort(host, shares)
+	res, err := Resources{}.parse(kv)
 	if err != nil {
-		return &Response{Err: err.Error()}
+		return errResponse(err)
 	}
-
-	vh.addMCont(node, shares)
-	return &Response{Result: node.id}
-}
-
-func (vh *VoipHandler) addClient(req *Request) *Response {
-	kv := req.KeyVal
-	host, ok1 := kv["host"]
-	sshares, ok2 := kv["shares"]
-	serverid, ok3 := kv["server"]
-	if !ok1 || !ok2 || !ok3 {
-		return &Response{Err: ErrKeyNotFound.Error()}
+	params := make(map[string]string)
+	for key, value := range kv {
+		params[key] = value
 	}
-
-	shares, err := strconv.ParseInt(sshares, 10, 64)
+	for _, link := range nf.Links {
+		id, ok := kv[link]
+		if !ok {
+			return errResponse(ErrKeyNotFound)
+		}
+		node := vh.node(id)
+		if node == nil {
+			return errResponse(ErrIdNotExists)
+		}
+		params[link] = node.ip
+	}
+	host, err := vh.getHost(kv, res.Shares)
 	if err != nil {
-		return &Response{Err: err.Error()}
+		return errResponse(err)
 	}
-	server, ok := vh.anodes[serverid]
-	if !ok {
-		return &Response{Err: ErrIdNotExists.Error()}
+
+	var ctrl Controller
+	if nf.Router {
+		ctrl, err = vh.ctrl.NewController(kind, kv["controller"])
+		if err != nil {
+			return errResponse(err)
+		}
 	}
 
-	node, err := vh.cmgr.StartClient(host, shares, server.ip)
+	node, err := vh.cmgr.StartNF(kind, host, res, params)
 	if err != nil {
-		return &Response{Err: err.Error()}
+		return errResponse(err)
 	}
 
-	vh.anodes[node.id] = node
+	node.role = kind
+	node.res = res
+	if nf.Router {
+		vh.addMCont(node, ctrl)
+		vh.mnodes[node.id].pool = node.id
+		vh.pools[node.id] = &pool{id: node.id, members: []string{node.id}}
+	} else {
+		vh.anodes[node.id] = node
+		vh.sched.AddNode(node, res.Shares)
+	}
 	return &Response{Result: node.id}
 }
 
@@ -105,86 +126,104 @@ func (vh *VoipHandler) stopCont(req *Request) *Response {
 	kv := req.KeyVal
 	contid, ok := kv["cont"]
 	if !ok {
-		return &Response{Err: ErrKeyNotFound.Error()}
+		return errResponse(ErrKeyNotFound)
 	}
 
 	node, ok := vh.anodes[contid]
 	if ok {
 		vh.cmgr.StopCont(node)
+		vh.sched.DelNode(node)
 		delete(vh.anodes, node.id)
+		delete(vh.limits, node.id)
+		vh.dropNode(node)
 	} else {
 		mnode, ok := vh.mnodes[contid]
 		if ok {
 			vh.cmgr.StopCont(mnode.node)
+			vh.sched.DelNode(mnode.node)
 			vh.delMCont(mnode)
 		} else {
-			return &Response{Err: ErrIdNotExists.Error()}
+			return errResponse(ErrIdNotExists)
 		}
 	}
 
 	return &Response{}
 }
 
-func (vh *VoipHandler) route(req *Request) *Response {
-	kv := req.KeyVal
-	client, ok1 := kv["client"]
-	server, ok2 := kv["server"]
-	router, ok3 := kv["router"]
-	if !ok1 || !ok2 || !ok3 {
-		return &Response{Err: ErrKeyNotFound.Error()}
-	}
-
-	cnode, ok1 := vh.anodes[client]
-	rcont, ok2 := vh.mnodes[router]
-	snode, ok3 := vh.anodes[server]
-	if !ok1 || !ok2 || !ok3 {
-		return &Response{Err: ErrIdNotExists.Error()}
-	}
-
-	err := vh.cmgr.Route(cnode, rcont.node, snode)
-	if err != nil {
-		return &Response{Err: err.Error()}
-	} else {
-		return &Response{}
-	}
-}
-
 func (vh *VoipHandler) setRate(req *Request) *Response {
 	kv := req.KeyVal
 	client, ok1 := kv["client"]
 	rate, ok2 := kv["rate"]
 	if !(ok1 && ok2) {
-		return &Response{Err: ErrKeyNotFound.Error()}
+		return errResponse(ErrKeyNotFound)
 	}
 
 	cnode, ok1 := vh.anodes[client]
 	if !ok1 {
-		return &Response{Err: ErrIdNotExists.Error()}
+		return errResponse(ErrIdNotExists)
 	}
 	irate, err := strconv.ParseInt(rate, 10, 32)
 	if err != nil {
-		return &Response{Err: err.Error()}
+		return errResponse(err)
 	}
 
 	err = vh.setClientRate(cnode, int(irate))
 	if err != nil {
-		return &Response{Err: err.Error()}
+		return errResponse(err)
 	} else {
 		return &Response{}
 	}
 }
 
-func (vh *VoipHandler) addMCont(node *Node, shares int64) {
-	vh.mnodes[node.id] = NewMContainer(node, vh.step_length, vh.period_length, shares, vh.reference, vh.alpha)
+func (vh *VoipHandler) addMCont(node *Node, ctrl Controller) {
+	vh.mnodes[node.id] = NewMContainer(node, vh.step_length, vh.period_length, ctrl)
+	vh.sched.AddNode(node, node.res.Shares)
 }
 
 func (vh *VoipHandler) delMCont(mcont *MContainer) {
+	vh.scaler.forget(mcont.node.id)
+	if p, ok := vh.pools[mcont.pool]; ok {
+		for i, id := range p.members {
+			if id == mcont.node.id {
+				p.members = append(p.members[:i], p.members[i+1:]...)
+				break
+			}
+		}
+
+		// move the clients of the stopped snort to other replicas
+		vh.rebalance(p)
+		if len(p.members) == 0 {
+			delete(vh.pools, p.id)
+		}
+	}
+
 	delete(vh.mnodes, mcont.node.id)
+	vh.dropNode(mcont.node)
+}
+
+// host is optional in requests, we ask the scheduler if it is not given.
+// affinity, if given, is the id of the container to be placed next to
+func (vh *VoipHandler) getHost(kv map[string]string, shares int64) (string, error) {
+	if host, ok := kv["host"]; ok && host != "" {
+		return host, nil
+	}
+
+	near := ""
+	if contid, ok := kv["affinity"]; ok {
+		if node, ok := vh.anodes[contid]; ok {
+			near = node.host
+		} else if mcont, ok := vh.mnodes[contid]; ok {
+			near = mcont.node.host
+		} else {
+			return "", ErrIdNotExists
+		}
+	}
+
+	return vh.sched.Place(shares, near)
 }
 
 func (vh *VoipHandler) setClientRate(cnode *Node, rate int) error {
-	runsh("sudo iptables -F")
-	addr, err := net.ResolveUDPAddr("udp", cnode.ip+":8888")
+	addr, err := net.ResolveUDPAddr("udp", cnode.ip+":"+strconv.Itoa(CLIENT_CTRL_PORT))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,139 @@
+package voip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	MIN_BLKIO_WEIGHT = 10
+	MAX_BLKIO_WEIGHT = 1000
+	MIN_MEMORY       = 4 * 1024 * 1024 // docker doesn't allow less
+)
+
+var (
+	ErrInvalidResources = errors.New("invalid resources")
+)
+
+// Resources is the vector of resources of a container. Shares are always
+// set, the other resources are left as they are when zero. The cpu quota
+// follows the shares unless given and the cpuset is a list of cpus such as
+// 0-2,4. The network priority is of the traffic the container sends from
+// its own sockets, packets forwarded by an NF keep their priority.
+type Resources struct {
+	Shares      int64  `json:"shares"`
+	Quota       int64  `json:"quota,omitempty"`
+	Cpuset      string `json:"cpuset,omitempty"`
+	Memory      int64  `json:"memory,omitempty"`
+	BlkioWeight int64  `json:"blkio_weight,omitempty"`
+	NetPrio     int64  `json:"net_prio,omitempty"`
+}
+
+func (r Resources) String() string {
+	return fmt.Sprintf("shares:%d quota:%d cpuset:%q memory:%d blkio:%d prio:%d",
+		r.Shares, r.quota(), r.Cpuset, r.Memory, r.BlkioWeight, r.NetPrio)
+}
+
+// quota in us of each CPU_PERIOD
+func (r Resources) quota() int64 {
+	if r.Quota != 0 {
+		return r.Quota
+	}
+	return r.Shares * CPU_PERIOD / 1024
+}
+
+// the resources given in kv on top of r, keys are the json names
+func (r Resources) parse(kv map[string]string) (Resources, error) {
+	ints := map[string]*int64{
+		"shares":       &r.Shares,
+		"quota":        &r.Quota,
+		"memory":       &r.Memory,
+		"blkio_weight": &r.BlkioWeight,
+		"net_prio":     &r.NetPrio,
+	}
+	for key, val := range ints {
+		s, ok := kv[key]
+		if !ok {
+			continue
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return r, err
+		}
+		*val = i
+	}
+	if cpuset, ok := kv["cpuset"]; ok {
+		r.Cpuset = cpuset
+	}
+
+	return r, r.validate()
+}
+
+// the keys parse reads, zero values are left out
+func (r Resources) keyVal() map[string]string {
+	kv := map[string]string{"shares": strconv.FormatInt(r.Shares, 10)}
+	ints := map[string]int64{
+		"quota":        r.Quota,
+		"memory":       r.Memory,
+		"blkio_weight": r.BlkioWeight,
+		"net_prio":     r.NetPrio,
+	}
+	for key, val := range ints {
+		if val != 0 {
+			kv[key] = strconv.FormatInt(val, 10)
+		}
+	}
+	if r.Cpuset != "" {
+		kv["cpuset"] = r.Cpuset
+	}
+	return kv
+}
+
+func (r Resources) validate() error {
+	switch {
+	case r.Shares <= 0, r.Quota < 0, r.NetPrio < 0:
+		return ErrInvalidResources
+	case r.Memory != 0 && r.Memory < MIN_MEMORY:
+		return ErrInvalidResources
+	case r.BlkioWeight != 0 && (r.BlkioWeight < MIN_BLKIO_WEIGHT || r.BlkioWeight > MAX_BLKIO_WEIGHT):
+		return ErrInvalidResources
+	case strings.Trim(r.Cpuset, "0123456789,-") != "":
+		return ErrInvalidResources
+	}
+	return nil
+}
+
+// the resources of the container not given in the request stay
+// as they are, shares of NFs may be changed by the controller later
+func (vh *VoipHandler) setResources(req *Request) *Response {
+	kv := req.KeyVal
+	id, ok := kv["cont"]
+	if !ok {
+		return errResponse(ErrKeyNotFound)
+	}
+
+	node := vh.node(id)
+	if node == nil {
+		return errResponse(ErrIdNotExists)
+	}
+	res, err := node.res.parse(kv)
+	if err != nil {
+		return errResponse(err)
+	}
+
+	if err := vh.cmgr.SetResources(node, res); err != nil {
+		return errResponse(err)
+	}
+	shares := node.res.Shares
+	node.res = res
+	vh.sched.SetShares(node, res.Shares)
+	if _, ok := vh.mnodes[node.id]; ok && shares != res.Shares {
+		vh.reweigh(map[*Node]bool{node: true})
+	}
+
+	log.Println("[INFO] set resources of", node.id, "to", res)
+	return &Response{}
+}
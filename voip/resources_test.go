@@ -0,0 +1,58 @@
+package voip
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	extra := "\n[VOIP]\nstate_file=" + filepath.Join(dir, "state.json") + "\n"
+
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, extra, cmgr)
+	if err := vh.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	snort := request(t, vh, ReqStartSnort, map[string]string{"shares": "256", "cpuset": "0-1"})
+	if res := cmgr.res[snort]; res.Shares != 256 || res.Cpuset != "0-1" || res.quota() != 25000 {
+		t.Errorf("expected snort started with shares and cpuset, got %v", res)
+	}
+	request(t, vh, ReqSetResources, map[string]string{"cont": snort, "memory": "268435456", "net_prio": "3"})
+	expected := Resources{Shares: 256, Cpuset: "0-1", Memory: 268435456, NetPrio: 3}
+	if res := cmgr.res[snort]; res != expected {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+
+	api := NewHttpApi(vh)
+	if code, _ := apiCall(t, api, "PUT", "/voip/containers/"+snort+"/resources", `{"shares": 512, "blkio_weight": 500}`); code != http.StatusNoContent {
+		t.Errorf("expected %d, got %d", http.StatusNoContent, code)
+	}
+	expected.Shares, expected.BlkioWeight = 512, 500
+	_, res := apiCall(t, api, "GET", "/voip/containers/"+snort, "")
+	if res.Node == nil || res.Node.Resources != expected || res.Node.Shares != 512 || vh.sched.Shares(snort) != 512 {
+		t.Errorf("expected %v in node info, got %+v", expected, res.Node)
+	}
+	for _, body := range []string{`{"memory": 1}`, `{"blkio_weight": 5000}`, `{"cpuset": "all"}`, `{"shares": 0}`} {
+		if code, _ := apiCall(t, api, "PUT", "/voip/containers/"+snort+"/resources", body); code != http.StatusBadRequest {
+			t.Errorf("expected %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+
+	// resources besides shares are kept across restarts
+	vh = testHandlerWith(t, extra, cmgr)
+	if err := vh.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if res := vh.mnodes[snort].node.res; res != expected {
+		t.Errorf("expected %v restored, got %v", expected, res)
+	}
+}
@@ -0,0 +1,226 @@
+package voip
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/influxdb/influxdb/models"
+)
+
+const (
+	POLICY_BINPACK  = "binpack"
+	POLICY_SPREAD   = "spread"
+	POLICY_AFFINITY = "affinity"
+	DEF_CAPACITY    = 4096
+)
+
+var (
+	ErrNoCapacity    = errors.New("no host has enough capacity")
+	ErrUnknownPolicy = errors.New("Invalid placement policy")
+)
+
+// capacity and load of a host, all in cpu shares (1024 = 1 core)
+type HostLoad struct {
+	name     string
+	capacity int64
+	shares   int64
+	usage    float64
+}
+
+// we take the worse of allocated shares and measured usage
+func (h *HostLoad) Load() int64 {
+	if int64(h.usage) > h.shares {
+		return int64(h.usage)
+	}
+	return h.shares
+}
+
+func (h *HostLoad) Fits(shares int64) bool {
+	return h.Load()+shares <= h.capacity
+}
+
+// Policy chooses a host among the hosts that can fit the container.
+// near is the host of the container we should be placed next to (may be empty)
+type Policy interface {
+	Select(hosts []*HostLoad, near string) *HostLoad
+}
+
+type BinPackPolicy struct{}
+
+func (BinPackPolicy) Select(hosts []*HostLoad, near string) *HostLoad {
+	var best *HostLoad
+	for _, h := range hosts {
+		if best == nil || h.Load()*best.capacity > best.Load()*h.capacity {
+			best = h
+		}
+	}
+	return best
+}
+
+type SpreadPolicy struct{}
+
+func (SpreadPolicy) Select(hosts []*HostLoad, near string) *HostLoad {
+	var best *HostLoad
+	for _, h := range hosts {
+		if best == nil || h.Load()*best.capacity < best.Load()*h.capacity {
+			best = h
+		}
+	}
+	return best
+}
+
+// falls back to spread if near host is full or not given
+type AffinityPolicy struct{}
+
+func (AffinityPolicy) Select(hosts []*HostLoad, near string) *HostLoad {
+	for _, h := range hosts {
+		if h.name == near {
+			return h
+		}
+	}
+	return SpreadPolicy{}.Select(hosts, near)
+}
+
+type contLoad struct {
+	host   string
+	shares int64
+	usage  float64
+	pval   int64
+	pts    time.Time
+}
+
+type Scheduler struct {
+	policy Policy
+	hosts  map[string]*HostLoad
+	conts  map[string]*contLoad
+}
+
+func NewScheduler(config *goconfig.ConfigFile) (*Scheduler, error) {
+	hosts := config.GetKeyList("VOIP.TOPO")
+	if hosts == nil {
+		return nil, ErrNoHosts
+	}
+
+	pname := POLICY_SPREAD
+	capacity := int64(DEF_CAPACITY)
+	if s, _ := config.GetSection("VOIP.SCHEDULER"); s != nil {
+		pname = config.MustValue("VOIP.SCHEDULER", "policy", POLICY_SPREAD)
+		capacity = config.MustInt64("VOIP.SCHEDULER", "capacity", DEF_CAPACITY)
+	}
+
+	var policy Policy
+	switch pname {
+	case POLICY_BINPACK:
+		policy = BinPackPolicy{}
+	case POLICY_SPREAD:
+		policy = SpreadPolicy{}
+	case POLICY_AFFINITY:
+		policy = AffinityPolicy{}
+	default:
+		return nil, ErrUnknownPolicy
+	}
+
+	hmap := make(map[string]*HostLoad)
+	for _, host := range hosts {
+		hcap := capacity
+		if s, _ := config.GetSection("VOIP.CAPACITY"); s != nil {
+			hcap = config.MustInt64("VOIP.CAPACITY", host, capacity)
+		}
+		hmap[host] = &HostLoad{name: host, capacity: hcap}
+	}
+
+	log.Println("[INFO] using", pname, "placement policy for", len(hmap), "hosts")
+	return &Scheduler{
+		policy: policy,
+		hosts:  hmap,
+		conts:  make(map[string]*contLoad),
+	}, nil
+}
+
+// returns the host for a new container with given shares
+func (s *Scheduler) Place(shares int64, near string) (string, error) {
+	names := make([]string, 0, len(s.hosts))
+	for name := range s.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	candidates := make([]*HostLoad, 0, len(names))
+	for _, name := range names {
+		if s.hosts[name].Fits(shares) {
+			candidates = append(candidates, s.hosts[name])
+		}
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoCapacity
+	}
+
+	host := s.policy.Select(candidates, near)
+	log.Println("[INFO] placing container with", shares, "shares on host", host.name)
+	return host.name, nil
+}
+
+func (s *Scheduler) AddNode(node *Node, shares int64) {
+	h, ok := s.hosts[node.host]
+	if !ok {
+		return
+	}
+
+	h.shares += shares
+	s.conts[node.id] = &contLoad{host: node.host, shares: shares}
+}
+
+// current shares of the container, 0 if unknown
+func (s *Scheduler) Shares(id string) int64 {
+	if c, ok := s.conts[id]; ok {
+		return c.shares
+	}
+	return 0
+}
+
+func (s *Scheduler) DelNode(node *Node) {
+	c, ok := s.conts[node.id]
+	if !ok {
+		return
+	}
+
+	h := s.hosts[c.host]
+	h.shares -= c.shares
+	h.usage -= c.usage
+	delete(s.conts, node.id)
+}
+
+func (s *Scheduler) SetShares(node *Node, shares int64) {
+	c, ok := s.conts[node.id]
+	if !ok {
+		return
+	}
+
+	s.hosts[c.host].shares += shares - c.shares
+	c.shares = shares
+}
+
+// cpu point has cumulative cpu usage in ns of a container
+func (s *Scheduler) AddPoint(point models.Point) {
+	c, ok := s.conts[point.Tags()["container_name"]]
+	if !ok {
+		return
+	}
+	fval, ok := point.Fields()["value"].(float64)
+	if !ok {
+		return
+	}
+
+	val := int64(fval)
+	if c.pval != 0 && point.Time().After(c.pts) {
+		// cores used by the container over the last interval
+		cores := float64(val-c.pval) / float64(point.Time().Sub(c.pts))
+		s.hosts[c.host].usage += cores*1024 - c.usage
+		c.usage = cores * 1024
+	}
+	c.pval = val
+	c.pts = point.Time()
+}
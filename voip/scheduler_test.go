@@ -0,0 +1,89 @@
+package voip
+
+import (
+	"testing"
+)
+
+func testScheduler(policy Policy) *Scheduler {
+	return &Scheduler{
+		policy: policy,
+		hosts: map[string]*HostLoad{
+			"h1": &HostLoad{name: "h1", capacity: 4096},
+			"h2": &HostLoad{name: "h2", capacity: 4096},
+			"h3": &HostLoad{name: "h3", capacity: 2048},
+		},
+		conts: make(map[string]*contLoad),
+	}
+}
+
+func place(t *testing.T, s *Scheduler, id string, shares int64, near string) string {
+	host, err := s.Place(shares, near)
+	if err != nil {
+		t.Fatal("unable to place container:", err)
+	}
+
+	s.AddNode(NewNode(id, "", "", host), shares)
+	return host
+}
+
+func TestSpreadPolicy(t *testing.T) {
+	s := testScheduler(SpreadPolicy{})
+
+	hosts := make(map[string]int)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		hosts[place(t, s, id, 1024, "")]++
+	}
+	if len(hosts) != 3 {
+		t.Errorf("expected containers on 3 hosts, got %v", hosts)
+	}
+
+	// h3 is now half full, the rest are a quarter full
+	if host := place(t, s, "c4", 1024, ""); host == "h3" {
+		t.Errorf("expected h1 or h2, got %s", host)
+	}
+}
+
+func TestBinPackPolicy(t *testing.T) {
+	s := testScheduler(BinPackPolicy{})
+
+	first := place(t, s, "c1", 1024, "")
+	for _, id := range []string{"c2", "c3"} {
+		if host := place(t, s, id, 1024, ""); host != first {
+			t.Errorf("expected %s, got %s", first, host)
+		}
+	}
+
+	s.DelNode(NewNode("c1", "", "", first))
+	if s.hosts[first].shares != 2048 {
+		t.Errorf("expected 2048 shares on %s, got %d", first, s.hosts[first].shares)
+	}
+}
+
+func TestAffinityPolicy(t *testing.T) {
+	s := testScheduler(AffinityPolicy{})
+
+	if host := place(t, s, "c1", 2048, "h3"); host != "h3" {
+		t.Errorf("expected h3, got %s", host)
+	}
+
+	// h3 is full, we fall back to spread
+	if host := place(t, s, "c2", 1024, "h3"); host == "h3" {
+		t.Errorf("expected h1 or h2, got %s", host)
+	}
+}
+
+func TestNoCapacity(t *testing.T) {
+	s := testScheduler(SpreadPolicy{})
+
+	if _, err := s.Place(8192, ""); err != ErrNoCapacity {
+		t.Errorf("expected ErrNoCapacity, got %v", err)
+	}
+
+	full := place(t, s, "c1", 1024, "")
+	s.SetShares(NewNode("c1", "", "", full), 4096)
+	if host, err := s.Place(4096, ""); err != nil {
+		t.Errorf("expected a host, got %v", err)
+	} else if host == full {
+		t.Errorf("expected a host other than %s", full)
+	}
+}
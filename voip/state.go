@@ -0,0 +1,276 @@
+package voip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// State is what we need to take over the containers and routes
+// of a previous run of the controller, stored as json
+type State struct {
+	Nodes  []*NodeState        `json:"nodes"`
+	Chains []*ChainInfo        `json:"chains"`
+	Pools  map[string][]string `json:"pools"`
+}
+
+type NodeState struct {
+	Id         string `json:"id"`
+	Ip         string `json:"ip"`
+	Mac        string `json:"mac"`
+	Host       string `json:"host"`
+	Role       string `json:"role"`
+	Other      string `json:"other,omitempty"`
+	Shares     int64  `json:"shares"`
+	Controller string `json:"controller,omitempty"`
+	Pool       string `json:"pool,omitempty"`
+	Limit      *Limit `json:"limit,omitempty"`
+	// resources besides shares, if any were set
+	Resources *Resources `json:"resources,omitempty"`
+}
+
+// returns nil state if the file doesn't exist
+func LoadState(file string) (*State, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// writes to a temporary file first so that a crash
+// never leaves a partially written state behind
+func (st *State) Save(file string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func (vh *VoipHandler) state() *State {
+	st := &State{
+		Nodes:  make([]*NodeState, 0, len(vh.anodes)+len(vh.mnodes)),
+		Chains: make([]*ChainInfo, 0, len(vh.chains)),
+		Pools:  make(map[string][]string),
+	}
+
+	for _, node := range vh.anodes {
+		ns := nodeState(node, vh.sched.Shares(node.id))
+		if limit, ok := vh.limits[node.id]; ok {
+			ns.Limit = &limit
+		}
+		st.Nodes = append(st.Nodes, ns)
+	}
+	for _, mcont := range vh.mnodes {
+		ns := nodeState(mcont.node, mcont.node.res.Shares)
+		ns.Controller = ControllerName(mcont.ctrl)
+		ns.Pool = mcont.pool
+		st.Nodes = append(st.Nodes, ns)
+	}
+	sort.Sort(byNodeId(st.Nodes))
+
+	for _, c := range vh.sortedChains() {
+		st.Chains = append(st.Chains, c.info())
+	}
+
+	for id, p := range vh.pools {
+		st.Pools[id] = append([]string{}, p.members...)
+	}
+	return st
+}
+
+// called after every change in topology or shares
+func (vh *VoipHandler) saveState() {
+	if vh.state_file == "" {
+		return
+	}
+
+	if err := vh.state().Save(vh.state_file); err != nil {
+		log.Println("[WARN] unable to save state:", err)
+	}
+}
+
+// takes over the containers of the saved state which are still running and
+// installs their chains again. Containers which are gone are cleaned up,
+// running ones missing from the state are removed.
+func (vh *VoipHandler) recover() error {
+	if vh.state_file == "" {
+		return nil
+	}
+
+	st, err := LoadState(vh.state_file)
+	if err != nil {
+		return err
+	} else if st == nil {
+		st = &State{}
+	}
+
+	pools := make(map[string]string)
+	known := make(map[string]bool)
+	for _, ns := range st.Nodes {
+		known[ns.Id] = true
+		node := &Node{
+			id:    ns.Id,
+			ip:    ns.Ip,
+			mac:   ns.Mac,
+			host:  ns.Host,
+			role:  ns.Role,
+			other: ns.Other,
+		}
+		if ns.Resources != nil {
+			node.res = *ns.Resources
+		}
+		node.res.Shares = ns.Shares
+		pools[ns.Id] = ns.Pool
+
+		// a container we can't reach may still be running, it is left alone
+		if err := vh.cmgr.Adopt(node); err == ErrNotRunning {
+			log.Println("[WARN] removing stopped container", ns.Id)
+			vh.cmgr.StopCont(node)
+			continue
+		} else if err != nil {
+			log.Println("[WARN] unable to adopt container", ns.Id, err)
+			continue
+		}
+
+		if !vh.catalog.router(ns.Role) {
+			vh.anodes[node.id] = node
+			vh.sched.AddNode(node, ns.Shares)
+			vh.restoreLimit(node, ns.Limit)
+			log.Println("[INFO] adopted", ns.Role, node.id, "on host", node.host)
+			continue
+		}
+
+		ctrl, err := vh.ctrl.NewController(ns.Role, ns.Controller)
+		if err != nil {
+			log.Println("[WARN] using default controller for", node.id, err)
+			ctrl, err = vh.ctrl.NewController(ns.Role, "")
+			if err != nil {
+				return err
+			}
+		}
+		vh.addMCont(node, ctrl)
+		vh.mnodes[node.id].pool = ns.Pool
+		log.Println("[INFO] adopted", ns.Role, node.id, "on host", node.host)
+	}
+
+	// started by a run which crashed before saving them
+	nodes, err := vh.cmgr.List()
+	if err != nil {
+		log.Println("[WARN] unable to list running containers", err)
+	}
+	for _, node := range nodes {
+		if !known[node.id] {
+			log.Println("[WARN] removing unknown container", node.id, "on host", node.host)
+			vh.cmgr.StopCont(node)
+		}
+	}
+
+	for id, members := range st.Pools {
+		p := &pool{id: id, members: make([]string, 0, len(members))}
+		for _, member := range members {
+			if _, ok := vh.mnodes[member]; ok {
+				p.members = append(p.members, member)
+			}
+		}
+		if len(p.members) != 0 {
+			vh.pools[id] = p
+		}
+	}
+
+	for _, ci := range st.Chains {
+		cnode, ok1 := vh.anodes[ci.Client]
+		snode, ok2 := vh.anodes[ci.Server]
+		if !ok1 || !ok2 {
+			log.Println("[WARN] dropping chain", ci.Id, "of client", ci.Client)
+			continue
+		}
+
+		// a lost snort is replaced by another replica of its pool
+		c := &chain{
+			id:        ci.Id,
+			cnode:     cnode,
+			hops:      make([]*Node, 0),
+			snode:     snode,
+			symmetric: ci.Symmetric,
+			balanced:  ci.Balanced,
+		}
+		for _, id := range ci.Hops {
+			if hop, err := vh.hop(id); err == nil {
+				c.hops = append(c.hops, hop)
+			} else if p, ok := vh.pools[pools[id]]; ok {
+				c.hops = append(c.hops, vh.mnodes[p.members[0]].node)
+			} else {
+				log.Println("[WARN] dropping hop", id, "of chain", ci.Id)
+			}
+		}
+
+		if c.balanced {
+			c.hops = vh.withPools(c.hops)
+		}
+
+		if err := vh.install(c); err != nil {
+			log.Println("[WARN] unable to restore chain", ci.Id, err)
+			continue
+		}
+		vh.chains[c.id] = c
+	}
+
+	for _, p := range vh.pools {
+		vh.rebalance(p)
+	}
+
+	log.Println("[INFO] recovered", len(vh.anodes)+len(vh.mnodes), "containers and",
+		len(vh.chains), "chains from", vh.state_file)
+	vh.saveState()
+	return nil
+}
+
+func nodeState(node *Node, shares int64) *NodeState {
+	ns := &NodeState{
+		Id:     node.id,
+		Ip:     node.ip,
+		Mac:    node.mac,
+		Host:   node.host,
+		Role:   node.role,
+		Other:  node.other,
+		Shares: shares,
+	}
+	if res := node.res; res != (Resources{Shares: res.Shares}) {
+		res.Shares = shares
+		ns.Resources = &res
+	}
+	return ns
+}
+
+type byNodeId []*NodeState
+
+func (b byNodeId) Len() int           { return len(b) }
+func (b byNodeId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byNodeId) Less(i, j int) bool { return b[i].Id < b[j].Id }
@@ -0,0 +1,82 @@
+package voip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func request(t *testing.T, vh *VoipHandler, code int, kv map[string]string) string {
+	resp := vh.HandleRequest(&Request{Code: code, KeyVal: kv})
+	if resp.Err != "" {
+		t.Fatalf("request %d %v failed: %s", code, kv, resp.Err)
+	}
+	return resp.Result
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "voip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	extra := "\n[VOIP]\nstate_file=" + filepath.Join(dir, "state.json") + "\n"
+
+	cmgr := newFakeCManager()
+	vh := testHandlerWith(t, extra, cmgr)
+	if err := vh.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := request(t, vh, ReqStartServer, map[string]string{"shares": "512"})
+	snort1 := request(t, vh, ReqStartSnort, map[string]string{"shares": "256", "controller": "queue"})
+	c1 := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	c2 := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+	request(t, vh, ReqRouteCont, map[string]string{"client": c1, "router": snort1, "server": server})
+	request(t, vh, ReqRouteCont, map[string]string{"client": c2, "router": snort1, "server": server})
+
+	c3 := request(t, vh, ReqStartClient, map[string]string{"shares": "128", "server": server})
+
+	// the controller crashes and c2 dies meanwhile, c3 can't be reached
+	// and orphan was started after the last save
+	delete(cmgr.conts, c2)
+	cmgr.lost[c3] = true
+	orphan, _ := cmgr.start("h1")
+	cmgr.routes = make(map[string][]*Node)
+	vh = testHandlerWith(t, extra, cmgr)
+	if err := vh.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cmgr.conts[c3]; !ok {
+		t.Errorf("container %s removed although it may be running", c3)
+	}
+	if _, ok := cmgr.conts[orphan.id]; ok {
+		t.Errorf("unknown container %s not removed", orphan.id)
+	}
+	if len(vh.anodes) != 2 || vh.anodes[c1] == nil || vh.anodes[c1].role != ROLE_CLIENT {
+		t.Errorf("expected server and client %s to be adopted, got %v", c1, vh.anodes)
+	}
+	mcont, ok := vh.mnodes[snort1]
+	if !ok {
+		t.Fatal("snort", snort1, "not adopted")
+	}
+	if mcont.node.res.Shares != 256 || ControllerName(mcont.ctrl) != CTRL_QUEUE || vh.pools[snort1] == nil {
+		t.Errorf("snort %s not restored: shares %d, controller %s",
+			snort1, mcont.node.res.Shares, ControllerName(mcont.ctrl))
+	}
+	c := vh.clientChain(vh.anodes[c1])
+	if len(vh.chains) != 1 || c == nil || len(c.hops) != 1 || c.hops[0].id != snort1 {
+		t.Errorf("expected only chain of %s through %s, got %v", c1, snort1, vh.chains)
+	}
+	if r := cmgr.routes[c1]; len(r) != 3 || r[1].id != snort1 {
+		t.Errorf("chain of %s not routed again, got %v", c1, r)
+	}
+
+	// a clean stop leaves nothing to recover
+	vh.Stop()
+	if st, err := LoadState(vh.state_file); st != nil || err != nil {
+		t.Errorf("expected no state after stop, got %v %v", st, err)
+	}
+}
@@ -5,42 +5,64 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/Unknwon/goconfig"
 	"github.com/influxdb/influxdb/models"
+	"github.com/mangalaman93/nfs/pkg/record"
 )
 
 type VoipLine struct {
 	database string
 	sockfile string
 	sock     *net.UnixListener
+	httpport string
+	httpl    net.Listener
 	vh       *VoipHandler
 	quit     chan bool
 	wg       sync.WaitGroup
 }
 
 func NewVoipLine(config *goconfig.ConfigFile) (*VoipLine, error) {
-	sockfile, err := config.GetValue("VOIP", "unix_sock")
+	vh, err := NewVoipHandler(config)
 	if err != nil {
 		return nil, err
 	}
-	db, err := config.GetValue("VOIP", "db")
+
+	return newVoipLine(config, vh)
+}
+
+// uses the given container manager instead of VOIP.MANAGER config
+func NewVoipLineWith(config *goconfig.ConfigFile, cmgr CManager) (*VoipLine, error) {
+	vh, err := NewVoipHandlerWith(config, cmgr)
 	if err != nil {
 		return nil, err
 	}
 
-	vh, err := NewVoipHandler(config)
+	return newVoipLine(config, vh)
+}
+
+func newVoipLine(config *goconfig.ConfigFile, vh *VoipHandler) (*VoipLine, error) {
+	sockfile, err := config.GetValue("VOIP", "unix_sock")
+	if err != nil {
+		return nil, err
+	}
+	db, err := config.GetValue("VOIP", "db")
 	if err != nil {
 		return nil, err
 	}
 
+	// http api is optional
+	httpport := config.MustValue("VOIP", "http_port", "")
+
 	return &VoipLine{
 		database: db,
 		sockfile: sockfile,
 		sock:     nil,
+		httpport: httpport,
 		vh:       vh,
 		quit:     make(chan bool),
 	}, nil
@@ -53,14 +75,29 @@ func (v *VoipLine) Start() error {
 		return err
 	}
 
+	if v.httpport != "" {
+		v.httpl, err = net.Listen("tcp", ":"+v.httpport)
+		if err != nil {
+			v.sock.Close()
+			return err
+		}
+	}
+
 	err = v.vh.Start()
 	if err != nil {
 		v.sock.Close()
+		if v.httpl != nil {
+			v.httpl.Close()
+		}
 		return err
 	}
 
 	v.wg.Add(1)
 	go v.accept()
+	if v.httpl != nil {
+		v.wg.Add(1)
+		go v.serveHTTP()
+	}
 	return nil
 }
 
@@ -70,6 +107,9 @@ func (v *VoipLine) Stop() {
 	// the receive on quit will return a value. We will, then,
 	// wait for the accept function to exit and stop the vh handler
 	close(v.quit)
+	if v.httpl != nil {
+		v.httpl.Close()
+	}
 	v.wg.Wait()
 	v.sock.Close()
 	v.vh.Stop()
@@ -86,6 +126,16 @@ func (v *VoipLine) Update(points models.Points) {
 	v.vh.UpdatePoints(points)
 }
 
+// records all the control actions, must be called before Start
+func (v *VoipLine) RecordTo(rec *record.Recorder) {
+	v.vh.cmgr = &recordCManager{CManager: v.vh.cmgr, rec: rec}
+}
+
+// same as a request received on the unix socket
+func (v *VoipLine) HandleRequest(req *Request) *Response {
+	return v.vh.HandleRequest(req)
+}
+
 func (v *VoipLine) accept() {
 	defer v.wg.Done()
 	log.Println("[INFO] listening voip commands on", v.sockfile)
@@ -112,6 +162,18 @@ func (v *VoipLine) accept() {
 	}
 }
 
+func (v *VoipLine) serveHTTP() {
+	defer v.wg.Done()
+	log.Println("[INFO] listening voip api on", v.httpl.Addr())
+
+	err := http.Serve(v.httpl, NewHttpApi(v.vh))
+	select {
+	case <-v.quit:
+	default:
+		log.Println("[WARN] voip api exited with error", err)
+	}
+}
+
 func (v *VoipLine) handleConn(conn *net.UnixConn) {
 	defer v.wg.Done()
 	defer conn.Close()
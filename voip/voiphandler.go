@@ -2,7 +2,9 @@ package voip
 
 import (
 	"errors"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/Unknwon/goconfig"
 	"github.com/influxdb/influxdb/models"
@@ -18,95 +20,130 @@ type VoipHandler struct {
 	sync.Mutex
 
 	// control parameters
-	mnodes map[string]*MContainer
-	anodes map[string]*Node
-	cmgr   CManager
+	mnodes  map[string]*MContainer
+	anodes  map[string]*Node
+	chains  map[string]*chain
+	pools   map[string]*pool
+	limits  map[string]Limit
+	catalog Catalog
+	cmgr    CManager
+	sched   *Scheduler
+	scaler  *Scaler
+	drifts  []*Drift
+	quit    chan struct{}
 
 	// config parameters
-	step_length   int64
-	period_length int64
-	reference     int64
-	alpha         float64
-	cpu_table     string
-	rx_table      string
-	tx_table      string
-	queue_table   string
+	step_length      int64
+	period_length    int64
+	ctrl             *ControlConfig
+	state_file       string
+	reconcile_period time.Duration
+	cpu_table        string
 }
 
 func NewVoipHandler(config *goconfig.ConfigFile) (*VoipHandler, error) {
-	step_length, err := config.Int64("VOIP.CONTROL", "step_length")
+	var cmgr CManager
+	mtype, err := config.GetValue("VOIP.MANAGER", "type")
 	if err != nil {
 		return nil, err
 	}
-	period_length, err := config.Int64("VOIP.CONTROL", "period_length")
-	if err != nil {
-		return nil, err
+	switch mtype {
+	case "docker":
+		cmgr, err = NewDockerCManager(config)
+	case "ostack":
+		cmgr, err = NewOStackCManager(config)
+	case "proc":
+		cmgr, err = NewProcCManager(config)
+	case "k8s":
+		cmgr, err = NewK8sCManager(config)
+	default:
+		err = ErrUnknownManager
 	}
-	reference, err := config.Int64("VOIP.CONTROL", "reference")
 	if err != nil {
 		return nil, err
 	}
-	alpha, err := config.Float64("VOIP.CONTROL", "alpha")
+
+	return NewVoipHandlerWith(config, cmgr)
+}
+
+// uses the given container manager instead of VOIP.MANAGER config
+func NewVoipHandlerWith(config *goconfig.ConfigFile, cmgr CManager) (*VoipHandler, error) {
+	step_length, err := config.Int64("VOIP.CONTROL", "step_length")
 	if err != nil {
 		return nil, err
 	}
-	cpu_table, err := config.GetValue("VOIP.CONTROL", "cpu_table")
+	period_length, err := config.Int64("VOIP.CONTROL", "period_length")
 	if err != nil {
 		return nil, err
 	}
-	rx_table, err := config.GetValue("VOIP.CONTROL", "rx_table")
+	ctrl, err := NewControlConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	tx_table, err := config.GetValue("VOIP.CONTROL", "tx_table")
+	cpu_table, err := config.GetValue("VOIP.CONTROL", "cpu_table")
 	if err != nil {
 		return nil, err
 	}
-	queue_table, err := config.GetValue("VOIP.CONTROL", "queue_table")
+	catalog, err := NewCatalog(config)
 	if err != nil {
 		return nil, err
 	}
 
-	var cmgr CManager
-	mtype, err := config.GetValue("VOIP.MANAGER", "type")
+	sched, err := NewScheduler(config)
 	if err != nil {
 		return nil, err
 	}
-	switch mtype {
-	case "docker":
-		cmgr, err = NewDockerCManager(config)
-	case "ostack":
-		cmgr, err = NewOStackCManager(config)
-	default:
-		err = ErrUnknownManager
-	}
+	scaler, err := NewScaler(config)
 	if err != nil {
 		return nil, err
 	}
 
 	return &VoipHandler{
-		mnodes:        make(map[string]*MContainer),
-		anodes:        make(map[string]*Node),
-		cmgr:          cmgr,
-		step_length:   step_length,
-		period_length: period_length,
-		reference:     reference,
-		alpha:         alpha,
-		cpu_table:     cpu_table,
-		rx_table:      rx_table,
-		tx_table:      tx_table,
-		queue_table:   queue_table,
+		mnodes:           make(map[string]*MContainer),
+		anodes:           make(map[string]*Node),
+		chains:           make(map[string]*chain),
+		pools:            make(map[string]*pool),
+		limits:           make(map[string]Limit),
+		catalog:          catalog,
+		cmgr:             cmgr,
+		sched:            sched,
+		scaler:           scaler,
+		step_length:      step_length,
+		period_length:    period_length,
+		ctrl:             ctrl,
+		state_file:       config.MustValue("VOIP", "state_file", ""),
+		reconcile_period: reconcilePeriod(config),
+		cpu_table:        cpu_table,
 	}, nil
 }
 
 func (vh *VoipHandler) Start() error {
-	return vh.cmgr.Setup()
+	vh.Lock()
+	defer vh.Unlock()
+
+	err := vh.cmgr.Setup()
+	if err != nil {
+		return err
+	}
+
+	if err := vh.recover(); err != nil {
+		return err
+	}
+	if vh.reconcile_period > 0 {
+		vh.quit = make(chan struct{})
+		go vh.reconcileLoop(vh.quit)
+	}
+	return nil
 }
 
 func (vh *VoipHandler) Stop() {
 	vh.Lock()
 	defer vh.Unlock()
 
+	if vh.quit != nil {
+		close(vh.quit)
+		vh.quit = nil
+	}
 	for _, mcont := range vh.mnodes {
 		vh.cmgr.StopCont(mcont.node)
 	}
@@ -115,27 +152,59 @@ func (vh *VoipHandler) Stop() {
 	}
 
 	vh.cmgr.Destroy()
+
+	// everything is stopped, nothing to recover anymore
+	if vh.state_file != "" {
+		os.Remove(vh.state_file)
+	}
 }
 
 func (vh *VoipHandler) HandleRequest(req *Request) *Response {
 	vh.Lock()
 	defer vh.Unlock()
 
+	switch req.Code {
+	case ReqStartServer, ReqStartSnort, ReqStartClient, ReqStopCont, ReqRouteCont,
+		ReqInsertHop, ReqRemoveHop, ReqDelChain, ReqSetLimit, ReqStartNF,
+		ReqSetResources:
+		defer vh.saveState()
+	}
+
 	switch req.Code {
 	case ReqStartServer:
-		return vh.addServer(req)
+		return vh.startNF(ROLE_SERVER, req)
 	case ReqStartSnort:
-		return vh.addSnort(req)
+		return vh.startNF(ROLE_SNORT, req)
 	case ReqStartClient:
-		return vh.addClient(req)
+		return vh.startNF(ROLE_CLIENT, req)
+	case ReqStartNF:
+		return vh.addNF(req)
 	case ReqStopCont:
 		return vh.stopCont(req)
 	case ReqRouteCont:
 		return vh.route(req)
 	case ReqSetRate:
 		return vh.setRate(req)
+	case ReqListNodes:
+		return vh.listNodes(req)
+	case ReqGetNode:
+		return vh.getNode(req)
+	case ReqInsertHop:
+		return vh.insertHop(req)
+	case ReqRemoveHop:
+		return vh.removeHop(req)
+	case ReqDelChain:
+		return vh.delChain(req)
+	case ReqListChains:
+		return vh.listChains(req)
+	case ReqGetDrift:
+		return vh.getDrift(req)
+	case ReqSetLimit:
+		return vh.setLimit(req)
+	case ReqSetResources:
+		return vh.setResources(req)
 	default:
-		return &Response{Err: ErrUnknownReq.Error()}
+		return errResponse(ErrUnknownReq)
 	}
 }
 
@@ -143,35 +212,52 @@ func (vh *VoipHandler) UpdatePoints(points models.Points) {
 	vh.Lock()
 	defer vh.Unlock()
 
+	// the scheduler keeps track of cpu usage of all the containers
+	for _, point := range points {
+		if point.Name() == vh.cpu_table {
+			vh.sched.AddPoint(point)
+		}
+	}
+
 	if len(vh.mnodes) == 0 {
 		return
 	}
 
-	// update points
+	// update points, the tables differ by kind of NF
 	for _, point := range points {
 		cont, ok := vh.mnodes[point.Tags()["container_name"]]
 		if !ok {
 			continue
 		}
 
-		switch point.Name() {
-		case vh.cpu_table:
-			cont.AddPoint(CPU_TABLE, point)
-		case vh.rx_table:
-			cont.AddPoint(RX_TABLE, point)
-		case vh.tx_table:
-			cont.AddPoint(TX_TABLE, point)
-		case vh.queue_table:
-			cont.AddPoint(QUEUE_TABLE, point)
-		default:
+		if table, ok := vh.catalog.table(cont.node.role, point.Name()); ok {
+			cont.AddPoint(table, point)
 		}
 	}
 
 	// run the algorithm
+	changed := make(map[*Node]bool)
+	save := false
 	for _, mcont := range vh.mnodes {
-		shares := mcont.Trigger()
-		if shares != 0 {
-			vh.cmgr.SetShares(mcont.node, shares)
+		res, ok := mcont.Trigger()
+		if !ok || vh.cmgr.SetResources(mcont.node, res) != nil {
+			continue
+		}
+		if res.Shares != mcont.node.res.Shares {
+			vh.sched.SetShares(mcont.node, res.Shares)
+			changed[mcont.node] = true
 		}
+		// memory set by the controller is saved as well
+		save = save || res != mcont.node.res
+		mcont.node.res = res
 	}
+	if len(changed) != 0 {
+		vh.reweigh(changed)
+	}
+	if save {
+		vh.saveState()
+	}
+
+	// and then scale snorts in or out if required
+	vh.autoscale()
 }